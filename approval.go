@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// permCallbackPrefix marks inline button callbacks on permission requests.
+// Format: perm:<action>:<request id>, where action is a (approve once),
+// g (approve for otpGrantDuration) or d (deny)
+const permCallbackPrefix = "perm:"
+
+// Permission modes for tool use in Telegram-driven sessions
+const (
+	permModeAuto    = "auto"    // approve everything
+	permModeButtons = "buttons" // Approve/Deny buttons
+	permModeOTP     = "otp"     // buttons, approvals confirmed with a TOTP code
+)
+
+// maxOTPAttempts is how many wrong codes deny a request
+const maxOTPAttempts = 5
+
+// permissionMode returns the configured permission mode. Configs written
+// before permission_mode existed use otp if a TOTP secret is set.
+func permissionMode(config *Config) string {
+	switch config.PermissionMode {
+	case permModeAuto, permModeButtons:
+		return config.PermissionMode
+	case permModeOTP:
+		if isOTPEnabled(config) {
+			return permModeOTP
+		}
+		return permModeButtons // no secret to check codes against
+	}
+	if isOTPEnabled(config) {
+		return permModeOTP
+	}
+	return permModeAuto
+}
+
+// newPermissionRequestID returns a random ID for a permission request
+func newPermissionRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// permissionButtons builds the inline keyboard for a permission request
+func permissionButtons(reqID string) [][]InlineKeyboardButton {
+	return [][]InlineKeyboardButton{
+		{
+			{Text: "✅ Approve", CallbackData: permCallbackPrefix + "a:" + reqID},
+			{Text: "❌ Deny", CallbackData: permCallbackPrefix + "d:" + reqID},
+		},
+		{
+			{Text: fmt.Sprintf("⏱ Approve for %d min", int(otpGrantDuration.Minutes())), CallbackData: permCallbackPrefix + "g:" + reqID},
+		},
+	}
+}
+
+// pendingOTPConfirm is an approve button press waiting for its TOTP code
+type pendingOTPConfirm struct {
+	RequestID string
+	Grant     bool
+	UserID    int64
+}
+
+var (
+	otpConfirms = make(map[int64]*pendingOTPConfirm) // topic -> button press awaiting code
+	otpAttempts = make(map[string]int)               // permission request ID -> failed attempts
+	otpStateMu  sync.Mutex                           // guards otpConfirms and otpAttempts
+)
+
+// clearOTPConfirm drops the button press waiting for a code in a topic
+func clearOTPConfirm(threadID int64) {
+	otpStateMu.Lock()
+	delete(otpConfirms, threadID)
+	otpStateMu.Unlock()
+}
+
+// resolvePermission answers a request for the waiting hook and updates its message.
+// by names the Telegram user who decided.
+func resolvePermission(config *Config, req *OTPPermissionRequest, approved bool, grant bool, via string, by string) {
+	if approved && grant {
+		writeOTPGrant(tmuxSafeName(req.SessionName))
+	}
+	writeOTPResponse(req.ID, approved, via, by)
+	otpStateMu.Lock()
+	delete(otpAttempts, req.ID)
+	otpStateMu.Unlock()
+	listenLog("[permission] %s session=%s tool=%s approved=%v grant=%v via=%s by=%s", req.ID, req.SessionName, req.ToolName, approved, grant, via, by)
+	logEvent(req.SessionName, "permission_decided", "listener", req.ID,
+		fmt.Sprintf("approved=%v grant=%v via=%s by=%s tool=%s", approved, grant, via, by, req.ToolName))
+
+	if req.MsgID == 0 || config.GroupID == 0 {
+		return
+	}
+	status := "❌ Denied"
+	if approved && grant {
+		status = fmt.Sprintf("✅ Approved for %d min", int(otpGrantDuration.Minutes()))
+	} else if approved {
+		status = "✅ Approved"
+	}
+	editMessageRemoveKeyboard(config, config.GroupID, int(req.MsgID), req.Message+"\n\n"+status+byline(config, by))
+}
+
+// handlePermissionCallback handles Approve/Deny button presses
+func handlePermissionCallback(config *Config, cb *CallbackQuery) {
+	parts := strings.SplitN(strings.TrimPrefix(cb.Data, permCallbackPrefix), ":", 2)
+	if len(parts) != 2 || cb.Message == nil {
+		return
+	}
+	action, reqID := parts[0], parts[1]
+	by := userLabel(cb.From.ID, cb.From.Username, cb.From.FirstName)
+
+	req, err := getPendingOTPRequest(reqID)
+	if err != nil {
+		editMessageRemoveKeyboard(config, cb.Message.Chat.ID, cb.Message.MessageID, cb.Message.Text+"\n\n⌛ No longer pending")
+		return
+	}
+	if req.MsgID == 0 {
+		req.MsgID = int64(cb.Message.MessageID)
+	}
+	if req.Message == "" {
+		req.Message = cb.Message.Text
+	}
+
+	switch action {
+	case "d":
+		resolvePermission(config, req, false, false, "button", by)
+	case "a", "g":
+		if permissionMode(config) != permModeOTP {
+			resolvePermission(config, req, true, action == "g", "button", by)
+			return
+		}
+		// Second factor: the next message in this topic must be the TOTP code,
+		// sent by the same user who pressed the button
+		otpStateMu.Lock()
+		otpConfirms[cb.Message.MessageThreadID] = &pendingOTPConfirm{RequestID: req.ID, Grant: action == "g", UserID: cb.From.ID}
+		otpStateMu.Unlock()
+		sendMessage(config, cb.Message.Chat.ID, cb.Message.MessageThreadID, "🔢 Send your OTP code to confirm")
+	}
+}
+
+// handlePermissionCode treats text as a TOTP code for a pending request in
+// this topic. Returns false if there is nothing waiting for a code.
+func handlePermissionCode(config *Config, msg *TelegramMessage, text string) bool {
+	if permissionMode(config) != permModeOTP {
+		return false
+	}
+	chatID, threadID := msg.Chat.ID, msg.MessageThreadID
+	by := userLabel(msg.From.ID, msg.From.Username, msg.From.FirstName)
+
+	var req *OTPPermissionRequest
+	grant := false
+	otpStateMu.Lock()
+	pc := otpConfirms[threadID]
+	otpStateMu.Unlock()
+	if pc != nil && pc.UserID == msg.From.ID {
+		req, _ = getPendingOTPRequest(pc.RequestID)
+		grant = pc.Grant
+		if req == nil {
+			clearOTPConfirm(threadID)
+		}
+	}
+	if req == nil {
+		// Code typed without pressing a button: approves this topic's newest request once
+		req = findPendingOTPRequest(getSessionByTopic(config, threadID))
+		if req == nil {
+			return false
+		}
+	}
+	if !canAccessSession(config, msg.From.ID, req.SessionName) {
+		return false
+	}
+
+	if validateOTP(config.OTPSecret, text) {
+		clearOTPConfirm(threadID)
+		resolvePermission(config, req, true, grant, "otp", by)
+		if req.MsgID == 0 {
+			sendMessage(config, chatID, threadID, "✅ Permission approved")
+		}
+		return true
+	}
+
+	otpStateMu.Lock()
+	otpAttempts[req.ID]++
+	remaining := maxOTPAttempts - otpAttempts[req.ID]
+	otpStateMu.Unlock()
+	if remaining <= 0 {
+		clearOTPConfirm(threadID)
+		resolvePermission(config, req, false, false, "otp", by)
+		sendMessage(config, chatID, threadID, "❌ Too many failed attempts - permission denied")
+	} else {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Invalid code — %d attempts remaining", remaining))
+	}
+	return true
+}
+
+// requestRemotePermission sends a permission request to the session's topic
+// and blocks until it is decided or times out. Called from the PreToolUse hook.
+// The listener posts the request and edits it once decided; only when its
+// socket is unavailable does the hook talk to Telegram itself.
+func requestRemotePermission(config *Config, sessName string, topicID int64, toolName, toolDesc, inputStr string) (*OTPPermissionResponse, error) {
+	msg := fmt.Sprintf("🔐 Permission request:\n\n🔧 %s\n📋 %s", toolDesc, inputStr)
+	if permissionMode(config) == permModeOTP {
+		msg += "\n\nTap a button, then send your OTP code to confirm."
+	}
+
+	req := &OTPPermissionRequest{
+		ID:          newPermissionRequestID(),
+		SessionName: sessName,
+		ToolName:    toolName,
+		ToolInput:   inputStr,
+		Message:     msg,
+		TopicID:     topicID,
+		Timestamp:   time.Now().Unix(),
+	}
+	if err := ipcCall("request_permission", req, nil, ipcCallTimeout); err == nil {
+		hookLog("permission: waiting for %s session=%s tool=%s", req.ID, sessName, toolName)
+		return waitForOTPResponse(req, tmuxSafeName(sessName), otpPermissionTimeout)
+	}
+
+	// No listener socket: post the request ourselves and hand it over as a file.
+	// Write it before sending so an immediate tap finds it.
+	writeOTPRequestFile(req)
+	if msgID, err := sendMessageWithKeyboardGetID(config, config.GroupID, topicID, msg, permissionButtons(req.ID)); err == nil {
+		req.MsgID = msgID
+		writeOTPRequestFile(req)
+	} else {
+		hookLog("permission: failed to send request %s: %v", req.ID, err)
+	}
+
+	hookLog("permission: waiting for %s session=%s tool=%s (file)", req.ID, sessName, toolName)
+	resp, err := waitForOTPResponse(req, tmuxSafeName(sessName), otpPermissionTimeout)
+	if req.MsgID != 0 {
+		finishPermissionMessage(config, req, resp, err)
+	}
+	return resp, err
+}
+
+// postPermissionRequest sends a request registered over the socket to its
+// topic with Approve/Deny buttons. Called in the listener.
+func postPermissionRequest(req *OTPPermissionRequest) {
+	if req.MsgID != 0 || req.TopicID == 0 {
+		return
+	}
+	config, err := loadConfig()
+	if err != nil || config.GroupID == 0 {
+		return
+	}
+	msgID, err := sendMessageWithKeyboardGetID(config, config.GroupID, req.TopicID, req.Message, permissionButtons(req.ID))
+	if err != nil {
+		listenLog("[permission] %s: failed to send request: %v", req.ID, err)
+		return
+	}
+	req.MsgID = msgID
+}
+
+// finishPermissionMessage reports outcomes resolvePermission doesn't see on
+// the request message: a timeout, or approval by another request's grant
+func finishPermissionMessage(config *Config, req *OTPPermissionRequest, resp *OTPPermissionResponse, err error) {
+	if err != nil {
+		editMessageRemoveKeyboard(config, config.GroupID, int(req.MsgID), req.Message+"\n\n⏰ Timed out - denied")
+	} else if resp.Via == "grant" {
+		editMessageRemoveKeyboard(config, config.GroupID, int(req.MsgID), req.Message+"\n\n✅ Approved (active grant)")
+	}
+}
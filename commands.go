@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -14,6 +15,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -33,27 +35,36 @@ func listenLog(format string, args ...interface{}) {
 }
 
 var authInProgress sync.Mutex
-var authWaitingCode bool
-var otpAttempts = make(map[string]int) // session -> failed attempts
+var authWaitingCode atomic.Bool // set by /auth until the owner sends the code
 
 // deliveryLoop polls the DB every 2 seconds and sends pending messages to Telegram
 // in created_at order. If one message fails, subsequent messages for that session
 // are blocked until it succeeds (preserves ordering).
-// Retry up to 5 times. After 2+ failures, send error notification.
-// Permanent errors (bot blocked, chat not found) skip retries.
-// SIGUSR1 from hooks triggers immediate delivery; 2s polling is the fallback.
+// Failed sends are retried with exponential backoff (see retryBackoff) up to
+// maxRetries times; after 2+ failures the topic is told. Messages that still
+// fail, or hit a permanent error (bot blocked, chat not found), are marked
+// failed and kept for `ccc queue retry` or /queue retry.
+// Tool calls and the text between them are collected into one blockquote
+// per turn (see addToolEvent).
+// Hooks trigger immediate delivery over the IPC socket or with SIGUSR1;
+// 2s polling is the fallback.
 var deliveryNotify = make(chan struct{}, 1)
 
+// wakeDelivery makes deliveryLoop run now instead of at the next tick
+func wakeDelivery() {
+	select {
+	case deliveryNotify <- struct{}{}:
+	default: // already pending
+	}
+}
+
 func deliveryLoop(config *Config) {
 	// Listen for SIGUSR1 signals from hook processes
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGUSR1)
 	go func() {
 		for range sigCh {
-			select {
-			case deliveryNotify <- struct{}{}:
-			default: // already pending
-			}
+			wakeDelivery()
 		}
 	}()
 
@@ -68,57 +79,125 @@ func deliveryLoop(config *Config) {
 		if cfg, err := loadConfig(); err == nil && cfg != nil {
 			config = cfg
 		}
-		sessions := allSessions()
-		for _, sessName := range sessions {
+		// Sessions whose turn ended get their next queued prompt
+		flushPromptQueues(config)
+		// Dialogs Claude shows in the terminal get buttons in their topic
+		checkPaneDialogs(config)
+		// Replies flushed after the Stop hook read the transcript
+		watchTranscripts(config)
+
+		for _, sessName := range allSessions() {
 			info, ok := config.Sessions[sessName]
 			if !ok || info == nil || info.TopicID == 0 || config.GroupID == 0 {
 				continue
 			}
-			pending := findPending(sessName)
-			for _, msg := range pending {
-				var html string
-				switch msg.Type {
-				case "user_prompt":
-					html = fmt.Sprintf("💬 %s", markdownToHTML(msg.Text))
-				case "assistant_text":
-					html = fmt.Sprintf("<b>%s:</b>\n%s", sessName, markdownToHTML(msg.Text))
-				case "notification":
-					html = markdownToHTML(msg.Text)
-				default:
-					// tool_call etc — already handled via tool_state
-					markDelivered(msg.ID, 0)
-					continue
-				}
-				tgMsgID, err := sendMessageHTMLGetID(config, config.GroupID, info.TopicID, html)
-				if err != nil {
-					errMsg := err.Error()
-					incRetry(msg.ID)
-					retry := msg.RetryCount + 1
-					logEvent(sessName, "send_failed", "listener", msg.ID, fmt.Sprintf("retry=%d err=%s", retry, errMsg))
-					listenLog("deliveryLoop: send failed (%d/%d) for %s: %v", retry, maxRetries, msg.ID, err)
-
-					if isPermanentError(errMsg) {
-						// Permanent error — mark as delivered to stop retrying, notify user
-						markDelivered(msg.ID, 0)
-						sendMessage(config, config.GroupID, info.TopicID,
-							fmt.Sprintf("❌ Message dropped (permanent error): %s", errMsg))
-					} else if retry >= maxRetries {
-						// Max retries exceeded — give up, notify user
-						markDelivered(msg.ID, 0)
-						sendMessage(config, config.GroupID, info.TopicID,
-							fmt.Sprintf("❌ Message dropped after %d retries: %s", retry, errMsg))
-					} else if retry >= 2 {
-						// 2+ failures — notify user but keep retrying
-						sendMessage(config, config.GroupID, info.TopicID,
-							fmt.Sprintf("⚠️ Send failed (%d/%d): %s", retry, maxRetries, errMsg))
-					}
-					break // stop this session, retry next tick
+			if !deliverSession(config, sessName, info.TopicID) {
+				break // rate limited: the other sessions wait too
+			}
+		}
+	}
+}
+
+// deliverSession sends a session's pending messages in order. Returns false
+// when Telegram flood control stopped it, so the pass doesn't go on to other
+// sessions.
+func deliverSession(config *Config, sessName string, topicID int64) bool {
+	pending := findPending(sessName)
+	for _, msg := range pending {
+		if msg.NextAttempt > time.Now().UnixMilli() {
+			break // backing off; later messages wait behind it
+		}
+		var html string
+		toolEvent := false
+		// Text Claude revised after it was sent is edited in place
+		revision := msg.TgMsgID != 0 && (msg.Type == "assistant_text" || msg.Type == "tool_text")
+		switch msg.Type {
+		case "user_prompt":
+			endToolMessage(config, sessName, topicID)
+			html = fmt.Sprintf("💬 %s", markdownToHTML(msg.Text))
+		case "assistant_text":
+			if !revision {
+				endToolMessage(config, sessName, topicID)
+			}
+			html = fmt.Sprintf("<b>%s:</b>\n%s", sessName, markdownToHTML(msg.Text))
+		case "tool_text":
+			// Text between tool calls goes into the blockquote if there is one
+			toolEvent = !revision && hasToolMessage(sessName)
+			html = fmt.Sprintf("<b>%s:</b>\n%s", sessName, markdownToHTML(msg.Text))
+		case "tool_call":
+			toolEvent = true
+		case "notification":
+			html = markdownToHTML(msg.Text)
+		case "diff":
+			// Sent below the blockquote, which stays open for the call's
+			// result; the call is edited in first so it reads above its diff
+			flushToolEdit(config, sessName, topicID, true)
+		case "todos": // edits the topic's pinned plan
+		case "plan_reset":
+			resetPlan(config, sessName)
+			markDelivered(msg.ID, 0)
+			continue
+		case "question": // sent with its option buttons below
+		case "tool_result": // marks its call in the blockquote
+		default:
+			markDelivered(msg.ID, 0)
+			continue
+		}
+		var tgMsgID int64
+		var err error
+		switch {
+		case revision:
+			tgMsgID, err = reviseText(config, sessName, topicID, msg, html)
+		case msg.Type == "tool_result":
+			tgMsgID = applyToolResult(sessName, msg)
+		case toolEvent:
+			tgMsgID, err = addToolEvent(config, sessName, topicID, msg)
+		case msg.Type == "question":
+			tgMsgID, err = sendQuestion(config, topicID, msg)
+		case msg.Type == "todos":
+			tgMsgID, err = updatePlan(config, sessName, topicID, msg)
+		case msg.Type == "diff":
+			tgMsgID, err = sendDiff(config, topicID, msg)
+		default:
+			tgMsgID, err = sendMessageHTMLGetID(config, config.GroupID, topicID, html)
+		}
+		var rateErr *RateLimitError
+		if errors.As(err, &rateErr) {
+			// Flood control is not the message's fault: leave it pending without
+			// spending a retry, and pause delivery until retry_after has passed
+			logEvent(sessName, "send_throttled", "listener", msg.ID, fmt.Sprintf("retry_after=%v", rateErr.RetryAfter))
+			listenLog("deliveryLoop: rate limited, retrying %s in %v", msg.ID, rateErr.RetryAfter)
+			return false
+		}
+		if err != nil {
+			errMsg := err.Error()
+			retry := msg.RetryCount + 1
+			logEvent(sessName, "send_failed", "listener", msg.ID, fmt.Sprintf("retry=%d err=%s", retry, errMsg))
+			listenLog("deliveryLoop: send failed (%d/%d) for %s: %v", retry, maxRetries, msg.ID, err)
+
+			if isPermanentError(errMsg) || retry >= maxRetries {
+				// Give up for now: park it in the failed list, notify user
+				markFailed(msg.ID, errMsg)
+				logEvent(sessName, "send_gave_up", "listener", msg.ID, errMsg)
+				sendMessage(config, config.GroupID, topicID,
+					fmt.Sprintf("❌ Message not delivered after %d attempt(s): %s\n/queue failed to see it, /queue retry all to send it again", retry, errMsg))
+			} else {
+				delay := retryBackoff(retry)
+				scheduleRetry(msg.ID, time.Now().Add(delay), errMsg)
+				if retry >= 2 {
+					// 2+ failures — notify user but keep retrying
+					sendMessage(config, config.GroupID, topicID,
+						fmt.Sprintf("⚠️ Send failed (%d/%d), retrying in %s: %s", retry, maxRetries, formatAge(delay), errMsg))
 				}
-				markDelivered(msg.ID, tgMsgID)
-				logEvent(sessName, "send_ok", "listener", msg.ID, fmt.Sprintf("tg_msg_id=%d", tgMsgID))
 			}
+			break // stop this session so later messages keep their order
 		}
+		markDelivered(msg.ID, tgMsgID)
+		logEvent(sessName, "send_ok", "listener", msg.ID, fmt.Sprintf("tg_msg_id=%d", tgMsgID))
 	}
+	// Tool events of this pass go out as one edit
+	flushToolEdit(config, sessName, topicID, false)
+	return true
 }
 
 // getSystemStats returns machine stats (works on Linux and macOS)
@@ -340,6 +419,7 @@ func setup(botToken string) error {
 	// Stop listener to avoid getUpdates conflict (409 Conflict)
 	fmt.Println("Stopping listener...")
 	stopListenerService()
+	deleteWebhook(config)
 
 	// Step 1: Permission mode
 	fmt.Println("Step 1/6: Permission mode")
@@ -355,9 +435,15 @@ func setup(botToken string) error {
 					"  physical access to your machine.",
 				"auto"),
 			huh.NewOption[string](
-				"OTP (secure)\n"+
-					"  Each permission requires a 6-digit TOTP code from your\n"+
-					"  authenticator app (Google Authenticator, Authy, etc.).\n"+
+				"Approve buttons\n"+
+					"  Each permission is sent to Telegram with Approve / Deny /\n"+
+					"  Approve for 5 min buttons. One tap decides.\n"+
+					"  Local terminal sessions keep their normal interactive UI.",
+				"buttons"),
+			huh.NewOption[string](
+				"Approve buttons + OTP (secure)\n"+
+					"  Like buttons, but approving also requires a 6-digit TOTP code\n"+
+					"  from your authenticator app (Google Authenticator, Authy, etc.).\n"+
 					"  Local terminal sessions keep their normal interactive UI.",
 				"otp"),
 		).
@@ -375,7 +461,7 @@ func setup(botToken string) error {
 
 	offset := 0
 	for {
-		resp, err := telegramGet(botToken, fmt.Sprintf("https://api.telegram.org/bot%s/getUpdates?offset=%d&timeout=30", botToken, offset))
+		resp, err := telegramGet(botToken, fmt.Sprintf("%s?offset=%d&timeout=30", botURL(config, "getUpdates"), offset))
 		if err != nil {
 			return fmt.Errorf("failed to get updates: %w", err)
 		}
@@ -421,7 +507,7 @@ step2:
 	deadline := time.Now().Add(30 * time.Second)
 
 	for time.Now().Before(deadline) {
-		reqURL := fmt.Sprintf("https://api.telegram.org/bot%s/getUpdates?offset=%d&timeout=5", config.BotToken, offset)
+		reqURL := fmt.Sprintf("%s?offset=%d&timeout=5", botURL(config, "getUpdates"), offset)
 		resp, err := telegramClientGet(client, config.BotToken, reqURL)
 		if err != nil {
 			continue
@@ -470,6 +556,7 @@ step3:
 
 	// Step 6: Apply permission mode
 	fmt.Println("Step 6/6: Configuring permission mode...")
+	config.PermissionMode = permMode
 	if permMode == "otp" {
 		msg, err := setupOTP(config)
 		if err != nil {
@@ -485,7 +572,11 @@ step3:
 		if err := saveConfig(config); err != nil {
 			fmt.Printf("⚠️  Failed to save config: %v\n", err)
 		}
-		fmt.Println("✅ Auto-approve mode — all remote permissions granted automatically")
+		if permMode == "buttons" {
+			fmt.Println("✅ Button mode — remote permissions are approved with a tap in Telegram")
+		} else {
+			fmt.Println("✅ Auto-approve mode — all remote permissions granted automatically")
+		}
 	}
 
 	// Done!
@@ -520,11 +611,15 @@ func setGroup(config *Config) error {
 	fmt.Println("Send a message in the group where you want to use topics...")
 	fmt.Println("(Make sure Topics are enabled in group settings)")
 
-	offset := 0
+	// getUpdates is rejected while a webhook is registered
+	deleteWebhook(config)
+
+	// Resume after the last handled update, so nothing is replayed or skipped
+	offset := loadUpdateOffset()
 	client := &http.Client{Timeout: 35 * time.Second}
 
 	for {
-		reqURL := fmt.Sprintf("https://api.telegram.org/bot%s/getUpdates?offset=%d&timeout=30", config.BotToken, offset)
+		reqURL := fmt.Sprintf("%s?offset=%d&timeout=30", botURL(config, "getUpdates"), offset)
 		resp, err := telegramClientGet(client, config.BotToken, reqURL)
 		if err != nil {
 			return err
@@ -721,12 +816,19 @@ func doctor() {
 		fmt.Println("⚠️  not set (optional)")
 	}
 
-	// Check OTP (permission approval)
-	fmt.Print("OTP (permissions). ")
-	if config != nil && isOTPEnabled(config) {
-		fmt.Println("✅ enabled")
+	// Check permission approval mode
+	fmt.Print("Permissions........ ")
+	if config == nil {
+		fmt.Println("⚠️  not configured")
 	} else {
-		fmt.Println("⚠️  disabled (run: ccc setup <token> to enable)")
+		switch permissionMode(config) {
+		case permModeOTP:
+			fmt.Println("✅ buttons + OTP")
+		case permModeButtons:
+			fmt.Println("✅ buttons")
+		default:
+			fmt.Println("⚠️  auto-approve (run: ccc setup <token> to require approval)")
+		}
 	}
 
 	fmt.Println()
@@ -767,8 +869,9 @@ func send(message string) error {
 	return sendMessage(config, config.ChatID, 0, message)
 }
 
-// Main listen loop
-func listen() error {
+// Main listen loop. Polls getUpdates unless webhookURL is set, in which case
+// updates are received over HTTP on webhookAddr.
+func listen(webhookURL string, webhookAddr string) error {
 	// Small random delay to avoid race conditions when multiple instances start
 	time.Sleep(time.Duration(os.Getpid()%500) * time.Millisecond)
 
@@ -799,7 +902,12 @@ func listen() error {
 
 	listenLog("Bot started (chat: %d, group: %d, sessions: %d)", config.ChatID, config.GroupID, len(config.Sessions))
 
-	setBotCommands(config.BotToken)
+	setBotCommands(config)
+
+	// Hooks talk to us over a Unix socket; without it they use files and SIGUSR1
+	if err := startIPCServer(); err != nil {
+		listenLog("[ipc] %v", err)
+	}
 
 	// Start delivery goroutine: polls DB and sends pending messages in order
 	go deliveryLoop(config)
@@ -807,12 +915,19 @@ func listen() error {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	offset := 0
+	// Finish updates taken on before a restart, then continue after the last
+	// dispatched one, so nothing is replayed or skipped
+	disp := newUpdateDispatcher(config, loadUpdateOffset())
+	disp.resume()
 	client := &http.Client{Timeout: 35 * time.Second}
 
 	go func() {
 		sig := <-sigChan
 		listenLog("Shutting down (signal: %v)", sig)
+		if webhookURL != "" {
+			// Unregister so setup/setgroup (and a polling listener) can use getUpdates
+			deleteWebhook(config)
+		}
 		os.Exit(0)
 	}()
 
@@ -828,9 +943,9 @@ func listen() error {
 				if info == nil || info.TopicID == 0 || cfg.GroupID == 0 {
 					continue
 				}
-				if flagInfo, err := os.Stat(thinkingFlag(sessName)); err == nil {
+				if since, ok := stateSince(stateThinking, sessName); ok {
 					// Auto-expire after 10 minutes to handle missed stop hooks
-					if time.Since(flagInfo.ModTime()) > 10*time.Minute {
+					if time.Since(since) > 10*time.Minute {
 						clearThinking(sessName)
 						continue
 					}
@@ -840,8 +955,17 @@ func listen() error {
 		}
 	}()
 
+	if webhookURL != "" {
+		return listenWebhook(config, disp, webhookURL, webhookAddr)
+	}
+
+	// A webhook left over from a previous webhook-mode run makes getUpdates fail with 409
+	if err := deleteWebhook(config); err != nil {
+		listenLog("Failed to delete webhook: %v", err)
+	}
+
 	for {
-		reqURL := fmt.Sprintf("https://api.telegram.org/bot%s/getUpdates?offset=%d&timeout=30", config.BotToken, offset)
+		reqURL := fmt.Sprintf("%s?offset=%d&timeout=30", botURL(config, "getUpdates"), disp.offset())
 		resp, err := telegramClientGet(client, config.BotToken, reqURL)
 		if err != nil {
 			listenLog("Network error: %v (retrying...)", err)
@@ -866,566 +990,686 @@ func listen() error {
 		}
 
 		for _, update := range updates.Result {
-			offset = update.UpdateID + 1
+			disp.dispatch(update)
+		}
+	}
+}
 
-			// Handle callback queries (button presses)
-			if update.CallbackQuery != nil {
-				cb := update.CallbackQuery
-				// Only accept from authorized user
-				if cb.From.ID != config.ChatID {
-					continue
-				}
+// handleUpdate handles a single Telegram update (message or button press).
+// Called by updateDispatcher's workers in both polling and webhook mode. An
+// update cut short by a crash is handled again; its side effects (/c, /update,
+// prompts sent to Claude) are claimed by update ID so they don't run twice.
+func handleUpdate(config *Config, update Update) {
+	// Handle callback queries (button presses)
+	if update.CallbackQuery != nil {
+		cb := update.CallbackQuery
+		// Only accept from registered users whose role covers this button
+		if userRole(config, cb.From.ID) == "" {
+			return
+		}
+		if minRole, sessName := callbackAccess(cb); !authorize(config, cb.From.ID, minRole, sessName) {
+			answerCallbackQueryText(config, cb.ID, "⛔ Not allowed for your role")
+			return
+		}
 
-					answerCallbackQuery(config, cb.ID)
-
-				// Parse callback data: session:questionIndex:totalQuestions:optionIndex
-				parts := strings.Split(cb.Data, ":")
-				if len(parts) >= 3 {
-					sessionName := parts[0]
-					questionIndex, _ := strconv.Atoi(parts[1])
-					var totalQuestions, optionIndex int
-					if len(parts) == 4 {
-						totalQuestions, _ = strconv.Atoi(parts[2])
-						optionIndex, _ = strconv.Atoi(parts[3])
-					} else {
-						// Legacy format: session:questionIndex:optionIndex
-						optionIndex, _ = strconv.Atoi(parts[2])
-					}
+		answerCallbackQuery(config, cb.ID)
 
-					// Edit message to show selection and remove buttons
-					if cb.Message != nil {
-						originalText := cb.Message.Text
-						newText := fmt.Sprintf("%s\n\n✓ Selected option %d", originalText, optionIndex+1)
-						editMessageRemoveKeyboard(config, cb.Message.Chat.ID, cb.Message.MessageID, newText)
-					}
+		// /list dashboard buttons
+		if strings.HasPrefix(cb.Data, listCallbackPrefix) {
+			handleListCallback(config, cb)
+			return
+		}
 
-					tmuxName := tmuxSafeName(sessionName)
-					windowID := getWindowID(config, sessionName)
-					if tmuxWindowExistsByID(windowID, tmuxName) {
-						target := tmuxTargetByID(windowID, tmuxName)
-						// Send arrow down keys to select option, then Enter
-						for i := 0; i < optionIndex; i++ {
-							exec.Command(tmuxPath, "send-keys", "-t", target, "Down").Run()
-							time.Sleep(50 * time.Millisecond)
-						}
-						exec.Command(tmuxPath, "send-keys", "-t", target, "Enter").Run()
-						listenLog("[callback] Selected option %d for %s (question %d/%d)", optionIndex, sessionName, questionIndex+1, totalQuestions)
-
-						// After the last question, send Enter to confirm "Submit answers"
-						if totalQuestions > 0 && questionIndex == totalQuestions-1 {
-							time.Sleep(300 * time.Millisecond)
-							exec.Command(tmuxPath, "send-keys", "-t", target, "Enter").Run()
-							listenLog("[callback] Auto-submitted answers for %s", sessionName)
-						}
-					}
-				}
+		// Buttons answering a dialog shown in a session's pane
+		if strings.HasPrefix(cb.Data, dialogCallbackPrefix) {
+			handleDialogCallback(config, cb)
+			return
+		}
 
-				continue
-			}
+		// "Show output" button of a tool blockquote
+		if strings.HasPrefix(cb.Data, outputCallbackPrefix) {
+			handleOutputCallback(config, cb)
+			return
+		}
 
-			msg := update.Message
+		// Permission request Approve/Deny buttons
+		if strings.HasPrefix(cb.Data, permCallbackPrefix) {
+			handlePermissionCallback(config, cb)
+			return
+		}
 
-			// Only accept from authorized user
-			if msg.From.ID != config.ChatID {
-				continue
+		// Parse callback data: session:questionIndex:totalQuestions:optionIndex
+		parts := strings.Split(cb.Data, ":")
+		if len(parts) >= 3 {
+			sessionName := parts[0]
+			questionIndex, _ := strconv.Atoi(parts[1])
+			var totalQuestions, optionIndex int
+			if len(parts) == 4 {
+				totalQuestions, _ = strconv.Atoi(parts[2])
+				optionIndex, _ = strconv.Atoi(parts[3])
+			} else {
+				// Legacy format: session:questionIndex:optionIndex
+				optionIndex, _ = strconv.Atoi(parts[2])
 			}
 
-			chatID := msg.Chat.ID
-			threadID := msg.MessageThreadID
-			isGroup := msg.Chat.Type == "supergroup"
-
-			// Handle voice messages
-			if msg.Voice != nil && isGroup && threadID > 0 {
-				config, _ = loadConfig()
-				sessionName := getSessionByTopic(config, threadID)
-				if sessionName != "" {
-					tmuxName := tmuxSafeName(sessionName)
-					windowID := getWindowID(config, sessionName)
-					if tmuxWindowExistsByID(windowID, tmuxName) {
-						sendMessage(config, chatID, threadID, "🎤 Transcribing...")
-						// Download and transcribe
-						audioPath := filepath.Join(os.TempDir(), fmt.Sprintf("voice_%d.ogg", time.Now().UnixNano()))
-						if err := downloadTelegramFile(config, msg.Voice.FileID, audioPath); err != nil {
-							sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Download failed: %v", err))
-						} else {
-							transcription, err := transcribeAudio(config, audioPath)
-							os.Remove(audioPath)
-							if err != nil {
-								sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Transcription failed: %v", err))
-							} else if transcription != "" {
-								listenLog("[voice] @%s: %s", msg.From.Username, transcription)
-								sendMessage(config, chatID, threadID, fmt.Sprintf("📝 %s", transcription))
-								voiceText := "[Audio transcription, may contain errors]: " + transcription
-								clearToolState(sessionName)
-								appendMessage(&MessageRecord{
-									ID: fmt.Sprintf("tg:%d:voice", msg.MessageID), Session: sessionName, Type: "user_prompt",
-									Text: voiceText, Origin: "telegram", TgDelivered: true,
-								})
-								sendToTmuxFromTelegram(tmuxTargetByID(windowID, tmuxName), tmuxName, voiceText)
-							}
-						}
-					}
-				}
-				continue
+			// Edit message to show selection and remove buttons
+			if cb.Message != nil {
+				originalText := cb.Message.Text
+				by := byline(config, userLabel(cb.From.ID, cb.From.Username, cb.From.FirstName))
+				newText := fmt.Sprintf("%s\n\n✓ Selected option %d%s", originalText, optionIndex+1, by)
+				editMessageRemoveKeyboard(config, cb.Message.Chat.ID, cb.Message.MessageID, newText)
 			}
 
-			// Handle photo messages
-			if len(msg.Photo) > 0 && isGroup && threadID > 0 {
-				config, _ = loadConfig()
-				sessionName := getSessionByTopic(config, threadID)
-				if sessionName != "" {
-					tmuxName := tmuxSafeName(sessionName)
-					windowID := getWindowID(config, sessionName)
-					if tmuxWindowExistsByID(windowID, tmuxName) {
-						// Get largest photo (last in array)
-						photo := msg.Photo[len(msg.Photo)-1]
-						imgPath := filepath.Join(os.TempDir(), fmt.Sprintf("telegram_%d.jpg", time.Now().UnixNano()))
-						if err := downloadTelegramFile(config, photo.FileID, imgPath); err != nil {
-							sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Download failed: %v", err))
-						} else {
-							caption := msg.Caption
-							if caption == "" {
-								caption = "Analyze this image:"
-							}
-							prompt := fmt.Sprintf("%s %s", caption, imgPath)
-							listenLog("[photo] caption=%q imgPath=%s prompt=%q", caption, imgPath, prompt)
-							sendMessage(config, chatID, threadID, fmt.Sprintf("📷 Image saved, sending to Claude..."))
-							clearToolState(sessionName)
-							appendMessage(&MessageRecord{
-								ID: fmt.Sprintf("tg:%d:photo", msg.MessageID), Session: sessionName, Type: "user_prompt",
-								Text: caption, Origin: "telegram", TgDelivered: true,
-							})
-							listenLog("[photo] sending to tmux: target=%s window=%s", tmuxTargetByID(windowID, tmuxName), tmuxName)
-							if err := sendToTmuxFromTelegramWithDelay(tmuxTargetByID(windowID, tmuxName), tmuxName, prompt, 2*time.Second); err != nil {
-								listenLog("[photo] sendToTmux FAILED: %v", err)
-							} else {
-								listenLog("[photo] sendToTmux OK")
-							}
-						}
-					}
+			tmuxName := tmuxSafeName(sessionName)
+			windowID := getWindowID(config, sessionName)
+			if tmuxWindowExistsByID(windowID, tmuxName) {
+				target := tmuxTargetByID(windowID, tmuxName)
+				// Send arrow down keys to select option, then Enter
+				for i := 0; i < optionIndex; i++ {
+					exec.Command(tmuxPath, "send-keys", "-t", target, "Down").Run()
+					time.Sleep(50 * time.Millisecond)
 				}
-				continue
-			}
+				exec.Command(tmuxPath, "send-keys", "-t", target, "Enter").Run()
+				listenLog("[callback] Selected option %d for %s (question %d/%d)", optionIndex, sessionName, questionIndex+1, totalQuestions)
 
-			// Handle document messages
-			if msg.Document != nil && isGroup && threadID > 0 {
-				config, _ = loadConfig()
-				sessionName := getSessionByTopic(config, threadID)
-				if sessionName != "" {
-					tmuxName := tmuxSafeName(sessionName)
-					windowID := getWindowID(config, sessionName)
-					if tmuxWindowExistsByID(windowID, tmuxName) {
-						sessionInfo := config.Sessions[sessionName]
-						destDir := sessionInfo.Path
-						if destDir == "" {
-							destDir = resolveProjectPath(config, sessionName)
-						}
-						destPath := filepath.Join(destDir, msg.Document.FileName)
-						if err := downloadTelegramFile(config, msg.Document.FileID, destPath); err != nil {
-							sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Download failed: %v", err))
-						} else {
-							caption := msg.Caption
-							if caption == "" {
-								caption = fmt.Sprintf("I sent you this file: %s", destPath)
-							} else {
-								caption = fmt.Sprintf("%s\n\nFile: %s", caption, destPath)
-							}
-							sendMessage(config, chatID, threadID, fmt.Sprintf("📎 File saved: %s", destPath))
-							clearToolState(sessionName)
-							appendMessage(&MessageRecord{
-								ID: fmt.Sprintf("tg:%d:doc", msg.MessageID), Session: sessionName, Type: "user_prompt",
-								Text: caption, Origin: "telegram", TgDelivered: true,
-							})
-							sendToTmuxFromTelegram(tmuxTargetByID(windowID, tmuxName), tmuxName, caption)
-						}
-					}
+				// After the last question, send Enter to confirm "Submit answers"
+				if totalQuestions > 0 && questionIndex == totalQuestions-1 {
+					time.Sleep(300 * time.Millisecond)
+					exec.Command(tmuxPath, "send-keys", "-t", target, "Enter").Run()
+					listenLog("[callback] Auto-submitted answers for %s", sessionName)
 				}
-				continue
 			}
+		}
 
-			text := strings.TrimSpace(msg.Text)
-			if text == "" {
-				continue
-			}
+		return
+	}
 
-			// Strip bot mention from commands (e.g., /ping@botname -> /ping)
-			if strings.HasPrefix(text, "/") {
-				if idx := strings.Index(text, "@"); idx != -1 {
-					spaceIdx := strings.Index(text, " ")
-					if spaceIdx == -1 || idx < spaceIdx {
-						text = text[:idx] + text[strings.Index(text+" ", " "):]
+	msg := update.Message
+
+	// Only accept from registered users
+	role := userRole(config, msg.From.ID)
+	if role == "" {
+		if msg.Chat.Type == "private" && msg.From.ID != 0 {
+			// Tell strangers their ID so the owner can add them with /users add
+			listenLog("[auth] ignored private message from unknown user %d (@%s)", msg.From.ID, msg.From.Username)
+			sendMessage(config, msg.Chat.ID, 0, fmt.Sprintf("⛔ Not authorized. Your Telegram user ID is %d — ask the owner to add you.", msg.From.ID))
+		}
+		return
+	}
+	author := userLabel(msg.From.ID, msg.From.Username, msg.From.FirstName)
+
+	chatID := msg.Chat.ID
+	threadID := msg.MessageThreadID
+	isGroup := msg.Chat.Type == "supergroup"
+
+	// Voice, photos and documents become prompts for the topic's session
+	if (msg.Voice != nil || len(msg.Photo) > 0 || msg.Document != nil) && isGroup && threadID > 0 {
+		if !authorize(config, msg.From.ID, roleOperator, getSessionByTopic(config, threadID)) {
+			return
+		}
+	}
+
+	// Handle voice messages
+	if msg.Voice != nil && isGroup && threadID > 0 {
+		config, _ = loadConfig()
+		sessionName := getSessionByTopic(config, threadID)
+		if sessionName != "" {
+			tmuxName := tmuxSafeName(sessionName)
+			windowID := getWindowID(config, sessionName)
+			if tmuxWindowExistsByID(windowID, tmuxName) {
+				sendMessage(config, chatID, threadID, "🎤 Transcribing...")
+				// Download and transcribe
+				audioPath := filepath.Join(os.TempDir(), fmt.Sprintf("voice_%d.ogg", time.Now().UnixNano()))
+				if err := downloadTelegramFile(config, msg.Voice.FileID, audioPath); err != nil {
+					sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Download failed: %v", err))
+				} else {
+					transcription, err := transcribeAudio(config, audioPath)
+					os.Remove(audioPath)
+					if err != nil {
+						sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Transcription failed: %v", err))
+					} else if transcription != "" {
+						listenLog("[voice] @%s: %s", msg.From.Username, transcription)
+						sendMessage(config, chatID, threadID, fmt.Sprintf("📝 %s", transcription))
+						voiceText := "[Audio transcription, may contain errors]: " + transcription
+						if !claimEffect(update.UpdateID, "prompt") {
+							return
+						}
+						clearToolState(sessionName)
+						appendMessage(&MessageRecord{
+							ID: fmt.Sprintf("tg:%d:voice", msg.MessageID), Session: sessionName, Type: "user_prompt",
+							Text: voiceText, Origin: "telegram", Author: author, TgDelivered: true, TgMsgID: int64(msg.MessageID),
+						})
+						sendToTmuxFromTelegram(tmuxTargetByID(windowID, tmuxName), tmuxName, voiceText)
 					}
 				}
-				text = strings.TrimSpace(text)
 			}
+		}
+		return
+	}
 
-			listenLog("[%s] @%s: %s", msg.Chat.Type, msg.From.Username, text)
-
-			// Handle OTP code responses (for permission approval)
-			if isOTPEnabled(config) && !strings.HasPrefix(text, "/") {
-				pendingSession := findPendingOTPSession()
-				if pendingSession != "" {
-					code := strings.TrimSpace(text)
-					if validateOTP(config.OTPSecret, code) {
-						writeOTPResponse(pendingSession, true)
-						delete(otpAttempts, pendingSession)
-						sendMessage(config, chatID, threadID, "✅ Permission approved (valid for 5 min)")
+	// Handle photo messages
+	if len(msg.Photo) > 0 && isGroup && threadID > 0 {
+		config, _ = loadConfig()
+		sessionName := getSessionByTopic(config, threadID)
+		if sessionName != "" {
+			tmuxName := tmuxSafeName(sessionName)
+			windowID := getWindowID(config, sessionName)
+			if tmuxWindowExistsByID(windowID, tmuxName) {
+				// Get largest photo (last in array)
+				photo := msg.Photo[len(msg.Photo)-1]
+				imgPath := filepath.Join(os.TempDir(), fmt.Sprintf("telegram_%d.jpg", time.Now().UnixNano()))
+				if err := downloadTelegramFile(config, photo.FileID, imgPath); err != nil {
+					sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Download failed: %v", err))
+				} else {
+					caption := msg.Caption
+					if caption == "" {
+						caption = "Analyze this image:"
+					}
+					prompt := fmt.Sprintf("%s %s", caption, imgPath)
+					listenLog("[photo] caption=%q imgPath=%s prompt=%q", caption, imgPath, prompt)
+					if !claimEffect(update.UpdateID, "prompt") {
+						return
+					}
+					sendMessage(config, chatID, threadID, fmt.Sprintf("📷 Image saved, sending to Claude..."))
+					clearToolState(sessionName)
+					appendMessage(&MessageRecord{
+						ID: fmt.Sprintf("tg:%d:photo", msg.MessageID), Session: sessionName, Type: "user_prompt",
+						Text: caption, Origin: "telegram", Author: author, TgDelivered: true, TgMsgID: int64(msg.MessageID),
+					})
+					listenLog("[photo] sending to tmux: target=%s window=%s", tmuxTargetByID(windowID, tmuxName), tmuxName)
+					if err := sendToTmuxFromTelegramWithDelay(tmuxTargetByID(windowID, tmuxName), tmuxName, prompt, 2*time.Second); err != nil {
+						listenLog("[photo] sendToTmux FAILED: %v", err)
 					} else {
-						otpAttempts[pendingSession]++
-						remaining := 5 - otpAttempts[pendingSession]
-						if remaining <= 0 {
-							writeOTPResponse(pendingSession, false)
-							delete(otpAttempts, pendingSession)
-							sendMessage(config, chatID, threadID, "❌ Too many failed attempts - permission denied")
-						} else {
-							sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Invalid code — %d attempts remaining", remaining))
-						}
+						listenLog("[photo] sendToTmux OK")
 					}
-					continue
 				}
 			}
+		}
+		return
+	}
 
-			// Handle commands
-			if strings.HasPrefix(text, "/c ") {
-				cmdStr := strings.TrimPrefix(text, "/c ")
-				output, err := executeCommand(cmdStr)
-				if err != nil {
-					output = fmt.Sprintf("⚠️ %s\n\nExit: %v", output, err)
+	// Handle document messages
+	if msg.Document != nil && isGroup && threadID > 0 {
+		config, _ = loadConfig()
+		sessionName := getSessionByTopic(config, threadID)
+		if sessionName != "" {
+			tmuxName := tmuxSafeName(sessionName)
+			windowID := getWindowID(config, sessionName)
+			if tmuxWindowExistsByID(windowID, tmuxName) {
+				sessionInfo := config.Sessions[sessionName]
+				destDir := sessionInfo.Path
+				if destDir == "" {
+					destDir = resolveProjectPath(config, sessionName)
 				}
-				sendMessage(config, chatID, threadID, output)
-				continue
-			}
-
-			if text == "/update" {
-				updateCCC(config, chatID, threadID, offset)
-				continue
-			}
-
-			if text == "/restart" {
-				sendMessage(config, chatID, threadID, "🔄 Restarting ccc service...")
-				// Re-exec ourselves to restart cleanly
-				go func() {
-					time.Sleep(500 * time.Millisecond)
-					exe, err := os.Executable()
-					if err != nil {
+				destPath := filepath.Join(destDir, msg.Document.FileName)
+				if int64(msg.Document.FileSize) > maxDownloadSize(config) {
+					sendMessage(config, chatID, threadID, fmt.Sprintf("❌ File too large (%d MB, limit %d MB). Set api_base_url to a self-hosted Bot API server to raise the limit.",
+						msg.Document.FileSize/(1024*1024), maxDownloadSize(config)/(1024*1024)))
+					return
+				}
+				if err := downloadTelegramFile(config, msg.Document.FileID, destPath); err != nil {
+					sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Download failed: %v", err))
+				} else {
+					caption := msg.Caption
+					if caption == "" {
+						caption = fmt.Sprintf("I sent you this file: %s", destPath)
+					} else {
+						caption = fmt.Sprintf("%s\n\nFile: %s", caption, destPath)
+					}
+					if !claimEffect(update.UpdateID, "prompt") {
 						return
 					}
-					exec.Command(exe, "listen").Start()
-					os.Exit(0)
-				}()
-				continue
+					sendMessage(config, chatID, threadID, fmt.Sprintf("📎 File saved: %s", destPath))
+					clearToolState(sessionName)
+					appendMessage(&MessageRecord{
+						ID: fmt.Sprintf("tg:%d:doc", msg.MessageID), Session: sessionName, Type: "user_prompt",
+						Text: caption, Origin: "telegram", Author: author, TgDelivered: true, TgMsgID: int64(msg.MessageID),
+					})
+					sendToTmuxFromTelegram(tmuxTargetByID(windowID, tmuxName), tmuxName, caption)
+				}
 			}
+		}
+		return
+	}
 
-			if text == "/stats" {
-				stats := getSystemStats()
-				sendMessage(config, chatID, threadID, stats)
-				continue
-			}
+	text := strings.TrimSpace(msg.Text)
+	if text == "" {
+		return
+	}
 
-			if text == "/version" {
-				sendMessage(config, chatID, threadID, fmt.Sprintf("ccc %s", version))
-				continue
+	// Strip bot mention from commands (e.g., /ping@botname -> /ping)
+	if strings.HasPrefix(text, "/") {
+		if idx := strings.Index(text, "@"); idx != -1 {
+			spaceIdx := strings.Index(text, " ")
+			if spaceIdx == -1 || idx < spaceIdx {
+				text = text[:idx] + text[strings.Index(text+" ", " "):]
 			}
+		}
+		text = strings.TrimSpace(text)
+	}
 
-			if text == "/auth" {
-				go handleAuth(config, chatID, threadID)
-				continue
-			}
+	listenLog("[%s] @%s: %s", msg.Chat.Type, msg.From.Username, text)
 
-			// If auth is waiting for code, send it
-			if authWaitingCode && !strings.HasPrefix(text, "/") {
-				go handleAuthCode(config, chatID, threadID, text)
-				continue
-			}
+	// Handle OTP code responses (for permission approval)
+	if !strings.HasPrefix(text, "/") && authorize(config, msg.From.ID, roleApprover, "") &&
+		handlePermissionCode(config, &msg, text) {
+		return
+	}
 
-			// /continue command - restart session preserving conversation history
-			if text == "/continue" && isGroup && threadID > 0 {
-				config, _ = loadConfig()
-				sessName := getSessionByTopic(config, threadID)
-				if sessName == "" {
-					sendMessage(config, chatID, threadID, "❌ No session mapped to this topic. Use /new <name> to create one.")
-					continue
-				}
-				tmuxName := tmuxSafeName(sessName)
-				windowID := getWindowID(config, sessName)
-				if tmuxWindowExistsByID(windowID, tmuxName) {
-					killTmuxWindow(windowID, tmuxName)
-					time.Sleep(300 * time.Millisecond)
-				}
-				// Use the stored path from config, fallback to resolveProjectPath
-				sessionInfo := config.Sessions[sessName]
-				workDir := sessionInfo.Path
-				if workDir == "" {
-					workDir = resolveProjectPath(config, sessName)
-				}
-				if _, err := os.Stat(workDir); os.IsNotExist(err) {
-					os.MkdirAll(workDir, 0755)
-				}
-				newWindowID, err := createTmuxWindow(tmuxName, workDir, true)
-				if err != nil {
-					sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to start: %v", err))
-				} else {
-					config.Sessions[sessName].WindowID = newWindowID
-					saveConfig(config)
-					time.Sleep(500 * time.Millisecond)
-					if tmuxWindowExistsByID(newWindowID, tmuxName) {
-						sendMessage(config, chatID, threadID, fmt.Sprintf("🔄 Session '%s' restarted with conversation history", sessName))
-					} else {
-						sendMessage(config, chatID, threadID, "⚠️ Session died immediately")
-					}
-				}
-				continue
-			}
+	// Commands: check the role (and the topic's session for session commands)
+	if strings.HasPrefix(text, "/") {
+		sessName := ""
+		if isGroup && threadID > 0 {
+			sessName = getSessionByTopic(config, threadID)
+		}
+		if minRole := commandRole(text); !authorize(config, msg.From.ID, minRole, sessName) {
+			cmd, _, _ := strings.Cut(text, " ")
+			sendMessage(config, chatID, threadID, fmt.Sprintf("⛔ %s needs the %s role (you are %s)", cmd, minRole, role))
+			return
+		}
+	} else if !authorize(config, msg.From.ID, roleOperator, "") {
+		return // approvers and viewers can talk in topics without prompting Claude
+	}
 
-			// /delete command - delete session and thread
-			if text == "/delete" && isGroup && threadID > 0 {
-				config, _ = loadConfig()
-				sessName := getSessionByTopic(config, threadID)
-				if sessName == "" {
-					sendMessage(config, chatID, threadID, "❌ No session mapped to this topic.")
-					continue
-				}
-				// Kill tmux window
-				tmuxName := tmuxSafeName(sessName)
-				windowID := getWindowID(config, sessName)
-				if tmuxWindowExistsByID(windowID, tmuxName) {
-					killTmuxWindow(windowID, tmuxName)
-				}
-				// Remove from config
-				topicID := config.Sessions[sessName].TopicID
-				delete(config.Sessions, sessName)
-				saveConfig(config)
-				// Delete telegram thread
-				if err := deleteForumTopic(config, topicID); err != nil {
-					sendMessage(config, chatID, threadID, fmt.Sprintf("⚠️ Session deleted but failed to delete thread: %v", err))
-				}
-				// No message needed - thread is gone
-				continue
+	if text == "/users" || strings.HasPrefix(text, "/users ") {
+		handleUsersCommand(config, &msg, strings.Fields(text)[1:])
+		return
+	}
+
+	// Handle commands
+	if strings.HasPrefix(text, "/c ") {
+		cmdStr := strings.TrimPrefix(text, "/c ")
+		if !claimEffect(update.UpdateID, "shell") {
+			sendMessage(config, chatID, threadID, "⚠️ This command started before the listener restarted; not running it again: "+cmdStr)
+			return
+		}
+		output, err := executeCommand(cmdStr)
+		if err != nil {
+			output = fmt.Sprintf("⚠️ %s\n\nExit: %v", output, err)
+		}
+		sendMessage(config, chatID, threadID, output)
+		return
+	}
+
+	if text == "/update" {
+		if !claimEffect(update.UpdateID, "update") {
+			return
+		}
+		updateCCC(config, chatID, threadID)
+		return
+	}
+
+	if text == "/restart" {
+		sendMessage(config, chatID, threadID, "🔄 Restarting ccc service...")
+		// Re-exec ourselves to restart cleanly
+		go func() {
+			time.Sleep(500 * time.Millisecond)
+			exe, err := os.Executable()
+			if err != nil {
+				return
 			}
+			// Keep the original flags (e.g. --webhook) across the restart
+			exec.Command(exe, os.Args[1:]...).Start()
+			os.Exit(0)
+		}()
+		return
+	}
 
-			// /cleanup command - delete tmux sessions and Telegram topics (NOT folders)
-			if text == "/cleanup" {
-				config, _ = loadConfig()
-				if len(config.Sessions) == 0 {
-					sendMessage(config, chatID, threadID, "No sessions to clean up.")
-					continue
-				}
+	if text == "/stats" {
+		stats := getSystemStats()
+		sendMessage(config, chatID, threadID, stats)
+		return
+	}
 
-				var cleaned []string
-				var errors []string
+	if text == "/search" || strings.HasPrefix(text, "/search ") {
+		handleSearchCommand(config, &msg, strings.Fields(text)[1:])
+		return
+	}
 
-				for sessName, info := range config.Sessions {
-					// Kill tmux window
-					tmuxName := tmuxSafeName(sessName)
-					windowID := getWindowID(config, sessName)
-					if tmuxWindowExistsByID(windowID, tmuxName) {
-						killTmuxWindow(windowID, tmuxName)
-					}
+	if text == "/export" || strings.HasPrefix(text, "/export ") {
+		handleExportCommand(config, &msg, strings.Fields(text)[1:])
+		return
+	}
 
-					// NOTE: No longer deleting project folders - only tmux sessions and threads
-					_ = info // Keep info reference for TopicID below
+	if text == "/list" {
+		config, _ = loadConfig()
+		listText, buttons := buildSessionList(config, msg.From.ID)
+		if len(buttons) > 0 {
+			sendMessageWithKeyboard(config, chatID, threadID, listText, buttons)
+		} else {
+			sendMessage(config, chatID, threadID, listText)
+		}
+		return
+	}
 
-					// Delete telegram thread
-					if info.TopicID > 0 && config.GroupID > 0 {
-						if err := deleteForumTopic(config, info.TopicID); err != nil {
-							errors = append(errors, fmt.Sprintf("%s: %v", sessName, err))
-						}
-					}
+	if text == "/version" {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("ccc %s", version))
+		return
+	}
 
-					cleaned = append(cleaned, sessName)
-				}
+	if text == "/auth" {
+		go handleAuth(config, chatID, threadID)
+		return
+	}
 
-				// Clear all sessions from config
-				config.Sessions = make(map[string]*SessionInfo)
-				saveConfig(config)
+	// If auth is waiting for code, send it
+	if role == roleOwner && !strings.HasPrefix(text, "/") && authWaitingCode.CompareAndSwap(true, false) {
+		go handleAuthCode(config, chatID, threadID, text)
+		return
+	}
 
-				msg := fmt.Sprintf("🧹 Cleaned %d sessions: %s", len(cleaned), strings.Join(cleaned, ", "))
-				if len(errors) > 0 {
-					msg += fmt.Sprintf("\n\n⚠️ Errors:\n%s", strings.Join(errors, "\n"))
-				}
-				sendMessage(config, chatID, threadID, msg)
-				continue
+	// /continue command - restart session preserving conversation history
+	if text == "/continue" && isGroup && threadID > 0 {
+		config, _ = loadConfig()
+		sessName := getSessionByTopic(config, threadID)
+		if sessName == "" {
+			sendMessage(config, chatID, threadID, "❌ No session mapped to this topic. Use /new <name> to create one.")
+			return
+		}
+		alive, err := restartSessionWindow(config, sessName, true)
+		if err != nil {
+			sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to start: %v", err))
+		} else if alive {
+			sendMessage(config, chatID, threadID, fmt.Sprintf("🔄 Session '%s' restarted with conversation history", sessName))
+		} else {
+			sendMessage(config, chatID, threadID, "⚠️ Session died immediately")
+		}
+		return
+	}
+
+	// /delete command - delete session and thread
+	if text == "/delete" && isGroup && threadID > 0 {
+		config, _ = loadConfig()
+		sessName := getSessionByTopic(config, threadID)
+		if sessName == "" {
+			sendMessage(config, chatID, threadID, "❌ No session mapped to this topic.")
+			return
+		}
+		// Kill tmux window
+		tmuxName := tmuxSafeName(sessName)
+		windowID := getWindowID(config, sessName)
+		if tmuxWindowExistsByID(windowID, tmuxName) {
+			killTmuxWindow(windowID, tmuxName)
+		}
+		// Remove from the registry
+		topicID := config.Sessions[sessName].TopicID
+		deleteSession(sessName)
+		delete(config.Sessions, sessName)
+		// Delete telegram thread
+		if err := deleteForumTopic(config, topicID); err != nil {
+			sendMessage(config, chatID, threadID, fmt.Sprintf("⚠️ Session deleted but failed to delete thread: %v", err))
+		}
+		// No message needed - thread is gone
+		return
+	}
+
+	// /cleanup command - delete tmux sessions and Telegram topics (NOT folders)
+	if text == "/cleanup" {
+		config, _ = loadConfig()
+		if len(config.Sessions) == 0 {
+			sendMessage(config, chatID, threadID, "No sessions to clean up.")
+			return
+		}
+
+		var cleaned []string
+		var errors []string
+
+		for sessName, info := range config.Sessions {
+			// Kill tmux window
+			tmuxName := tmuxSafeName(sessName)
+			windowID := getWindowID(config, sessName)
+			if tmuxWindowExistsByID(windowID, tmuxName) {
+				killTmuxWindow(windowID, tmuxName)
 			}
 
-			// /new command - create/restart session
-			if strings.HasPrefix(text, "/new") && isGroup {
-				config, _ = loadConfig()
-				arg := strings.TrimSpace(strings.TrimPrefix(text, "/new"))
+			// NOTE: No longer deleting project folders - only tmux sessions and threads
+			_ = info // Keep info reference for TopicID below
 
-				// /new <name> - create brand new session + topic
-				if arg != "" {
-					existing, exists := config.Sessions[arg]
-					if exists && existing != nil && existing.TopicID != 0 {
-						sendMessage(config, chatID, threadID, fmt.Sprintf("⚠️ Session '%s' already exists. Use /new without args in that topic to restart.", arg))
-						continue
-					}
-					topicID, err := createForumTopic(config, arg)
-					if err != nil {
-						sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to create topic: %v", err))
-						continue
-					}
-					// Use pre-configured path if session was preset, otherwise resolve from name
-					workDir := resolveProjectPath(config, arg)
-					if exists && existing != nil && existing.Path != "" {
-						workDir = existing.Path
-					}
-					config.Sessions[arg] = &SessionInfo{
-						TopicID: topicID,
-						Path:    workDir,
-					}
-					saveConfig(config)
-					if _, err := os.Stat(workDir); os.IsNotExist(err) {
-						os.MkdirAll(workDir, 0755)
-					}
-					tmuxName := tmuxSafeName(arg)
-					newWindowID, err := createTmuxWindow(tmuxName, workDir, false)
-					if err != nil {
-						sendMessage(config, config.GroupID, topicID, fmt.Sprintf("❌ Failed to start tmux: %v", err))
-					} else {
-						config.Sessions[arg].WindowID = newWindowID
-						saveConfig(config)
-						time.Sleep(500 * time.Millisecond)
-						if tmuxWindowExistsByID(newWindowID, tmuxName) {
-							sendMessage(config, config.GroupID, topicID, fmt.Sprintf("🚀 Session '%s' started!\n\nSend messages here to interact with Claude.", arg))
-						} else {
-							sendMessage(config, config.GroupID, topicID, fmt.Sprintf("⚠️ Session '%s' created but died immediately. Check if ~/bin/ccc works.", arg))
-						}
-					}
-					continue
+			// Delete telegram thread
+			if info.TopicID > 0 && config.GroupID > 0 {
+				if err := deleteForumTopic(config, info.TopicID); err != nil {
+					errors = append(errors, fmt.Sprintf("%s: %v", sessName, err))
 				}
+			}
 
-				// Without args - restart session in current topic
-				if threadID > 0 {
-					sessionName := getSessionByTopic(config, threadID)
-					if sessionName == "" {
-						sendMessage(config, chatID, threadID, "❌ No session mapped to this topic. Use /new <name> to create one.")
-						continue
-					}
-					tmuxName := tmuxSafeName(sessionName)
-					windowID := getWindowID(config, sessionName)
-					if tmuxWindowExistsByID(windowID, tmuxName) {
-						killTmuxWindow(windowID, tmuxName)
-						time.Sleep(300 * time.Millisecond)
-					}
-					sessionInfo := config.Sessions[sessionName]
-					workDir := sessionInfo.Path
-					if workDir == "" {
-						workDir = resolveProjectPath(config, sessionName)
-					}
-					if _, err := os.Stat(workDir); os.IsNotExist(err) {
-						os.MkdirAll(workDir, 0755)
-					}
-					newWindowID, err := createTmuxWindow(tmuxName, workDir, false)
-					if err != nil {
-						sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to start: %v", err))
-					} else {
-						config.Sessions[sessionName].WindowID = newWindowID
-						saveConfig(config)
-						time.Sleep(500 * time.Millisecond)
-						if tmuxWindowExistsByID(newWindowID, tmuxName) {
-							sendMessage(config, chatID, threadID, fmt.Sprintf("🚀 Session '%s' restarted", sessionName))
-						} else {
-							sendMessage(config, chatID, threadID, "⚠️ Session died immediately")
-						}
-					}
+			deleteSession(sessName)
+			cleaned = append(cleaned, sessName)
+		}
+		config.Sessions = make(map[string]*SessionInfo)
+
+		msg := fmt.Sprintf("🧹 Cleaned %d sessions: %s", len(cleaned), strings.Join(cleaned, ", "))
+		if len(errors) > 0 {
+			msg += fmt.Sprintf("\n\n⚠️ Errors:\n%s", strings.Join(errors, "\n"))
+		}
+		sendMessage(config, chatID, threadID, msg)
+		return
+	}
+
+	// /new command - create/restart session
+	if strings.HasPrefix(text, "/new") && isGroup {
+		config, _ = loadConfig()
+		arg := strings.TrimSpace(strings.TrimPrefix(text, "/new"))
+
+		// /new <name> - create brand new session + topic
+		if arg != "" {
+			existing, exists := config.Sessions[arg]
+			if exists && existing != nil && existing.TopicID != 0 {
+				sendMessage(config, chatID, threadID, fmt.Sprintf("⚠️ Session '%s' already exists. Use /new without args in that topic to restart.", arg))
+				return
+			}
+			topicID, err := createForumTopic(config, arg)
+			if err != nil {
+				sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to create topic: %v", err))
+				return
+			}
+			// Use pre-configured path if session was preset, otherwise resolve from name
+			workDir := resolveProjectPath(config, arg)
+			if exists && existing != nil && existing.Path != "" {
+				workDir = existing.Path
+			}
+			config.Sessions[arg] = &SessionInfo{
+				TopicID: topicID,
+				Path:    workDir,
+			}
+			saveSession(arg, config.Sessions[arg])
+			if _, err := os.Stat(workDir); os.IsNotExist(err) {
+				os.MkdirAll(workDir, 0755)
+			}
+			tmuxName := tmuxSafeName(arg)
+			newWindowID, err := createTmuxWindow(tmuxName, workDir, false)
+			if err != nil {
+				sendMessage(config, config.GroupID, topicID, fmt.Sprintf("❌ Failed to start tmux: %v", err))
+			} else {
+				config.Sessions[arg].WindowID = newWindowID
+				updateSession(arg, func(i *SessionInfo) { i.WindowID = newWindowID })
+				time.Sleep(500 * time.Millisecond)
+				if tmuxWindowExistsByID(newWindowID, tmuxName) {
+					sendMessage(config, config.GroupID, topicID, fmt.Sprintf("🚀 Session '%s' started!\n\nSend messages here to interact with Claude.", arg))
 				} else {
-					sendMessage(config, chatID, threadID, "Usage: /new <name> to create a new session")
+					sendMessage(config, config.GroupID, topicID, fmt.Sprintf("⚠️ Session '%s' created but died immediately. Check if ~/bin/ccc works.", arg))
 				}
-				continue
 			}
+			return
+		}
 
-			// Check if message is in a topic (interactive session)
-			if isGroup && threadID > 0 {
-				// Reload config to get latest sessions
-				config, _ = loadConfig()
-				sessName := getSessionByTopic(config, threadID)
-				if sessName != "" {
-					// Send to tmux session
-					tmuxName := tmuxSafeName(sessName)
-					windowID := getWindowID(config, sessName)
-					if !tmuxWindowExistsByID(windowID, tmuxName) {
-						// Auto-start session if not running
-						sessionInfo := config.Sessions[sessName]
-						workDir := sessionInfo.Path
-						if _, err := os.Stat(workDir); os.IsNotExist(err) {
-							os.MkdirAll(workDir, 0755)
-						}
-						newWindowID, err := createTmuxWindow(tmuxName, workDir, false)
-						if err != nil {
-							sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to start session: %v", err))
-							continue
-						}
-						windowID = newWindowID
-						config.Sessions[sessName].WindowID = newWindowID
-						saveConfig(config)
-						sendMessage(config, chatID, threadID, fmt.Sprintf("🚀 Session '%s' auto-started", sessName))
-						time.Sleep(3 * time.Second) // Wait for Claude to fully start
-
-						// Small delay for tmux to be ready
-						time.Sleep(500 * time.Millisecond)
-					}
-					target := tmuxTargetByID(windowID, tmuxName)
-					listenLog("sendToTmux: target=%s window=%s", target, tmuxName)
+		// Without args - restart session in current topic
+		if threadID > 0 {
+			sessionName := getSessionByTopic(config, threadID)
+			if sessionName == "" {
+				sendMessage(config, chatID, threadID, "❌ No session mapped to this topic. Use /new <name> to create one.")
+				return
+			}
+			alive, err := restartSessionWindow(config, sessionName, false)
+			if err != nil {
+				sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to start: %v", err))
+			} else if alive {
+				sendMessage(config, chatID, threadID, fmt.Sprintf("🚀 Session '%s' restarted", sessionName))
+			} else {
+				sendMessage(config, chatID, threadID, "⚠️ Session died immediately")
+			}
+		} else {
+			sendMessage(config, chatID, threadID, "Usage: /new <name> to create a new session")
+		}
+		return
+	}
 
-					// Clear tool state so new tool calls start fresh
-					clearToolState(sessName)
+	// /queue and /now manage prompts queued while Claude is busy
+	if (text == "/queue" || strings.HasPrefix(text, "/queue ") || text == "/now") && isGroup && threadID > 0 {
+		config, _ = loadConfig()
+		sessName := getSessionByTopic(config, threadID)
+		if sessName == "" {
+			sendMessage(config, chatID, threadID, "❌ No session mapped to this topic.")
+		} else if text == "/now" {
+			handleNowCommand(config, sessName, chatID, threadID)
+		} else {
+			handleQueueCommand(config, sessName, chatID, threadID, strings.Fields(text)[1:])
+		}
+		return
+	}
 
-					// Record in DB
-					appendMessage(&MessageRecord{
-						ID:      fmt.Sprintf("tg:%d", update.UpdateID),
-						Session: sessName,
-						Type:    "user_prompt",
-						Text:    text,
-						Origin:  "telegram",
-						TgDelivered: true,
-					})
+	// /screen [png] [lines] shows what the topic's Claude pane looks like
+	if (text == "/screen" || strings.HasPrefix(text, "/screen ")) && isGroup && threadID > 0 {
+		config, _ = loadConfig()
+		sessName := getSessionByTopic(config, threadID)
+		if sessName == "" {
+			sendMessage(config, chatID, threadID, "❌ No session mapped to this topic.")
+			return
+		}
+		handleScreenCommand(config, sessName, chatID, threadID, strings.Fields(text)[1:])
+		return
+	}
 
-					if err := sendToTmuxFromTelegram(target, tmuxName, text); err != nil {
-						listenLog("sendToTmux FAILED: target=%s err=%v", target, err)
-						sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to send: %v", err))
-					}
-				} else {
-					sendMessage(config, chatID, threadID, "⚠️ No session linked to this topic. Use /new <name> to create one.")
+	// /diffs [on|off] toggles sending the diffs of Claude's edits to the topic
+	if (text == "/diffs" || strings.HasPrefix(text, "/diffs ")) && isGroup && threadID > 0 {
+		config, _ = loadConfig()
+		sessName := getSessionByTopic(config, threadID)
+		if sessName == "" {
+			sendMessage(config, chatID, threadID, "❌ No session mapped to this topic.")
+			return
+		}
+		handleDiffsCommand(config, sessName, chatID, threadID, strings.Fields(text)[1:])
+		return
+	}
+
+	// /stop, /interrupt, /mode and /keys send keys to the topic's Claude pane
+	if cmd, _, _ := strings.Cut(text, " "); (keyCommands[cmd] != nil || cmd == "/keys") && isGroup && threadID > 0 {
+		config, _ = loadConfig()
+		sessName := getSessionByTopic(config, threadID)
+		if sessName == "" {
+			sendMessage(config, chatID, threadID, "❌ No session mapped to this topic.")
+			return
+		}
+		handleKeyCommand(config, sessName, chatID, threadID, text)
+		return
+	}
+
+	// Check if message is in a topic (interactive session)
+	if isGroup && threadID > 0 {
+		// Reload config to get latest sessions
+		config, _ = loadConfig()
+		sessName := getSessionByTopic(config, threadID)
+		if sessName != "" && !canAccessSession(config, msg.From.ID, sessName) {
+			return
+		}
+		// /now <text> skips the queue
+		force := strings.HasPrefix(text, "/now ")
+		if force {
+			text = strings.TrimSpace(strings.TrimPrefix(text, "/now "))
+		}
+		if sessName != "" {
+			// Send to tmux session
+			tmuxName := tmuxSafeName(sessName)
+			windowID := getWindowID(config, sessName)
+			if !tmuxWindowExistsByID(windowID, tmuxName) {
+				// Auto-start session if not running
+				sessionInfo := config.Sessions[sessName]
+				workDir := sessionInfo.Path
+				if _, err := os.Stat(workDir); os.IsNotExist(err) {
+					os.MkdirAll(workDir, 0755)
 				}
-				continue
+				newWindowID, err := createTmuxWindow(tmuxName, workDir, false)
+				if err != nil {
+					sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to start session: %v", err))
+					return
+				}
+				windowID = newWindowID
+				config.Sessions[sessName].WindowID = newWindowID
+				updateSession(sessName, func(i *SessionInfo) { i.WindowID = newWindowID })
+				sendMessage(config, chatID, threadID, fmt.Sprintf("🚀 Session '%s' auto-started", sessName))
+				time.Sleep(3 * time.Second) // Wait for Claude to fully start
+
+				// Small delay for tmux to be ready
+				time.Sleep(500 * time.Millisecond)
+			}
+			rec := &MessageRecord{
+				ID:          fmt.Sprintf("tg:%d", update.UpdateID),
+				Session:     sessName,
+				Type:        "user_prompt",
+				Text:        text,
+				Origin:      "telegram",
+				Author:      author,
+				TgDelivered: true,
+				TgMsgID:     int64(msg.MessageID), // linked from /search
 			}
 
-			// Private chat: run one-shot Claude
-			if !isGroup {
-				sendMessage(config, chatID, threadID, "🤖 Running Claude...")
-
-				prompt := text
-				if msg.ReplyToMessage != nil && msg.ReplyToMessage.Text != "" {
-					origText := msg.ReplyToMessage.Text
-					origWords := strings.Fields(origText)
-					if len(origWords) > 0 {
-						home, _ := os.UserHomeDir()
-						potentialDir := filepath.Join(home, origWords[0])
-						if info, err := os.Stat(potentialDir); err == nil && info.IsDir() {
-							prompt = origWords[0] + " " + text
-						}
-					}
-					prompt = fmt.Sprintf("Original message:\n%s\n\nReply:\n%s", origText, prompt)
-				}
+			// Typing into a working TUI interleaves with Claude's output: queue
+			// until the turn ends (and behind anything already queued)
+			if !force && (isThinking(sessName) || hasQueuedPrompts(sessName)) {
+				enqueueTopicPrompt(config, sessName, rec, chatID, threadID)
+				return
+			}
 
-				go func(p string, cid int64) {
-					defer func() {
-						if r := recover(); r != nil {
-							sendMessage(config, cid, 0, fmt.Sprintf("💥 Panic: %v", r))
-						}
-					}()
-					output, err := runClaude(p)
-					if err != nil {
-						if strings.Contains(err.Error(), "context deadline exceeded") {
-							output = fmt.Sprintf("⏱️ Timeout (10min)\n\n%s", output)
-						} else {
-							output = fmt.Sprintf("⚠️ %s\n\nExit: %v", output, err)
-						}
-					}
-					sendMessage(config, cid, 0, output)
-				}(prompt, chatID)
+			// Record in DB
+			appendMessage(rec)
+
+			if !claimEffect(update.UpdateID, "prompt") {
+				listenLog("Not sending update %d to %s again", update.UpdateID, sessName)
+				return
 			}
+			if err := injectPrompt(config, sessName, text); err != nil {
+				listenLog("sendToTmux FAILED: session=%s err=%v", sessName, err)
+				sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to send: %v", err))
+			}
+		} else {
+			sendMessage(config, chatID, threadID, "⚠️ No session linked to this topic. Use /new <name> to create one.")
 		}
+		return
+	}
+
+	// Private chat: run one-shot Claude (runs outside any session, so owner only)
+	if !isGroup && role == roleOwner {
+		sendMessage(config, chatID, threadID, "🤖 Running Claude...")
+
+		prompt := text
+		if msg.ReplyToMessage != nil && msg.ReplyToMessage.Text != "" {
+			origText := msg.ReplyToMessage.Text
+			origWords := strings.Fields(origText)
+			if len(origWords) > 0 {
+				home, _ := os.UserHomeDir()
+				potentialDir := filepath.Join(home, origWords[0])
+				if info, err := os.Stat(potentialDir); err == nil && info.IsDir() {
+					prompt = origWords[0] + " " + text
+				}
+			}
+			prompt = fmt.Sprintf("Original message:\n%s\n\nReply:\n%s", origText, prompt)
+		}
+
+		go func(p string, cid int64) {
+			defer func() {
+				if r := recover(); r != nil {
+					sendMessage(config, cid, 0, fmt.Sprintf("💥 Panic: %v", r))
+				}
+			}()
+			output, err := runClaude(p)
+			if err != nil {
+				if strings.Contains(err.Error(), "context deadline exceeded") {
+					output = fmt.Sprintf("⏱️ Timeout (10min)\n\n%s", output)
+				} else {
+					output = fmt.Sprintf("⚠️ %s\n\nExit: %v", output, err)
+				}
+			}
+			sendMessage(config, cid, 0, output)
+		}(prompt, chatID)
 	}
 }
 
@@ -1447,8 +1691,21 @@ COMMANDS:
     config oauth-token <token>  Set OAuth token
     setgroup                Configure Telegram group for topics (if skipped during setup)
     listen                  Start the Telegram bot listener manually
+    listen --webhook <url> [--addr :8443]
+                            Receive updates via webhook instead of polling
     install                 Install Claude hook manually
     send <file>             Send file to current session's Telegram topic
+    policy                  Show permission policy files
+    policy test '<json>'    Dry-run the policy against PreToolUse hook JSON
+    queue [ls]              List messages that could not be delivered to Telegram
+    queue retry <id|all>    Send failed messages again
+    queue drop <id|all>     Give up on failed messages
+    search [-s <session>] <query>
+                            Search prompts and replies of all sessions
+    export <session> [--format md|html|json] [--since 24h|7d|<date>]
+                            Write a session's conversation to stdout
+    transcript <path|session> [--tail N] [--csv] [--follow]
+                            Inspect a Claude transcript entry by entry
     relay [port]            Start relay server for large files (default: 8080)
     run                     Run Claude directly (used by tmux sessions)
 
@@ -1457,13 +1714,29 @@ TELEGRAM COMMANDS:
     /new ~/path/name        Create session with custom path
     /new                    Restart session in current topic
     /continue               Restart session keeping conversation history
+    /list                   Show all sessions with their state and actions
     /c <cmd>                Execute shell command
     /update                 Update ccc binary from GitHub
     /restart                Restart ccc service
-
-OTP (permission approval):
-    When OTP is enabled (via 'ccc setup'), Claude's permission requests
-    are forwarded to Telegram. Reply with your OTP code to approve.
+    /diffs [on|off]         Send diffs of Claude's edits to the topic
+    /screen [png] [lines]   Snapshot of the session's terminal (text or image)
+    /stop                   Cancel Claude's current turn (Escape)
+    /interrupt              Send Ctrl-C to the session
+    /mode                   Cycle Claude's permission mode (Shift-Tab)
+    /keys <key...>          Send tmux keys, e.g. /keys Down Enter
+    /queue                  List, reorder or drop prompts queued while Claude is busy
+    /queue failed           Messages that could not be delivered; /queue retry <n|all>
+    /search <query> [session]  Search prompts and replies of all sessions
+    /export [md|html|json] [since]  Send the session's conversation as a document
+    /now [text]             Send the next queued prompt (or text) right away
+    /users                  Manage users and roles (owner)
+
+PERMISSION APPROVAL:
+    When enabled (via 'ccc setup'), Claude's permission requests from
+    Telegram-driven sessions are sent with Approve / Deny / Approve for
+    5 min buttons. In OTP mode, reply with your OTP code to confirm.
+    Policy rules (~/.config/ccc/policy.json) can allow, deny or ask
+    per tool, command, path or session before that happens.
 
 FLAGS:
     -h, --help              Show this help
@@ -1537,12 +1810,11 @@ func handleAuth(config *Config, chatID, threadID int64) {
 		return
 	}
 
-	authWaitingCode = true
+	authWaitingCode.Store(true)
 	sendMessage(config, chatID, threadID, fmt.Sprintf("🔗 Open this URL and authorize:\n\n%s\n\nThen paste the code here.", oauthURL))
 }
 
 func handleAuthCode(config *Config, chatID, threadID int64, code string) {
-	authWaitingCode = false
 	code = strings.TrimSpace(code)
 
 	sendMessage(config, chatID, threadID, "🔄 Sending code to Claude...")
@@ -67,6 +67,7 @@ func loadConfig() (*Config, error) {
 	}
 
 	var config Config
+	var fileSessions map[string]*SessionInfo
 	if needsMigration {
 		// Parse everything except sessions first
 		type ConfigWithoutSessions struct {
@@ -87,7 +88,7 @@ func loadConfig() (*Config, error) {
 
 		// Migrate sessions
 		home, _ := os.UserHomeDir()
-		config.Sessions = make(map[string]*SessionInfo)
+		fileSessions = make(map[string]*SessionInfo)
 		for name, topicID := range oldSessions {
 			// For old sessions, try to figure out the path
 			var sessionPath string
@@ -107,27 +108,40 @@ func loadConfig() (*Config, error) {
 			} else {
 				sessionPath = filepath.Join(home, name)
 			}
-			config.Sessions[name] = &SessionInfo{
+			fileSessions[name] = &SessionInfo{
 				TopicID: topicID,
 				Path:    sessionPath,
 			}
 		}
-		// Save migrated config
-		saveConfig(&config)
 	} else {
 		// Parse with new format
 		if err := json.Unmarshal(data, &config); err != nil {
 			return nil, err
 		}
+		if sessionsRaw, ok := rawConfig["sessions"]; ok {
+			json.Unmarshal(sessionsRaw, &fileSessions)
+		}
 	}
 
-	if config.Sessions == nil {
-		config.Sessions = make(map[string]*SessionInfo)
+	// Sessions live in ccc.db. Move any still in config.json there once, then
+	// rewrite the file without them.
+	if _, ok := rawConfig["sessions"]; ok {
+		if err := importSessions(fileSessions); err != nil {
+			config.Sessions = fileSessions
+			if config.Sessions == nil {
+				config.Sessions = make(map[string]*SessionInfo)
+			}
+			return &config, nil
+		}
+		saveConfig(&config)
 	}
+	config.Sessions = loadSessions()
 
 	return &config, nil
 }
 
+// saveConfig writes the static settings to config.json. Sessions are not
+// part of it; use saveSession / updateSession / deleteSession.
 func saveConfig(config *Config) error {
 	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// listCallbackPrefix marks inline button callbacks coming from the /list dashboard.
+// Format: ls:<action>:<session>
+const listCallbackPrefix = "ls:"
+
+// sessionActiveWindow is how recent the last event must be for an idle-looking
+// session (no thinking flag) to still count as running
+const sessionActiveWindow = time.Minute
+
+// SessionStatus is a point-in-time view of one session for the dashboard
+type SessionStatus struct {
+	Name       string
+	State      string // dead / otp / thinking / running / idle
+	Pending    int
+	Queued     int
+	LastEvent  *EventRecord
+	TopicLink  string
+	WindowDead bool
+}
+
+// sessionStateLabels maps a session state to its dashboard icon and label
+var sessionStateLabels = map[string]string{
+	"dead":     "💀 dead",
+	"otp":      "🔐 waiting for approval",
+	"thinking": "🧠 thinking",
+	"running":  "▶️ running",
+	"idle":     "💤 idle",
+}
+
+// getSessionStatus inspects tmux, flag files and the DB to determine a session's state
+func getSessionStatus(config *Config, name string, info *SessionInfo) SessionStatus {
+	st := SessionStatus{
+		Name:      name,
+		Pending:   len(findPending(name)),
+		Queued:    len(queuedPrompts(name)),
+		LastEvent: lastEvent(name),
+		TopicLink: topicLink(config, info.TopicID),
+	}
+
+	switch {
+	case !tmuxWindowExistsByID(info.WindowID, tmuxSafeName(name)):
+		st.State = "dead"
+		st.WindowDead = true
+	case hasPendingOTPRequestFor(name):
+		st.State = "otp"
+	case isThinking(name):
+		st.State = "thinking"
+	case st.Pending > 0:
+		st.State = "running"
+	case st.LastEvent != nil && time.Since(time.UnixMilli(st.LastEvent.Timestamp)) < sessionActiveWindow:
+		st.State = "running"
+	default:
+		st.State = "idle"
+	}
+	return st
+}
+
+// topicLink builds a t.me deep link to a forum topic, or "" if unavailable.
+// Supergroup IDs look like -100XXXXXXXXXX; links use the XXXXXXXXXX part.
+func topicLink(config *Config, topicID int64) string {
+	if config.GroupID == 0 || topicID == 0 {
+		return ""
+	}
+	internalID := strings.TrimPrefix(fmt.Sprintf("%d", config.GroupID), "-100")
+	if strings.HasPrefix(internalID, "-") {
+		return "" // basic group, topics not linkable
+	}
+	return fmt.Sprintf("https://t.me/c/%s/%d", internalID, topicID)
+}
+
+// formatAge renders a duration as a compact "5s" / "3m" / "2h" / "4d" string
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
+
+// buildSessionList renders the /list dashboard text and its inline keyboard,
+// listing only the sessions userID may act on
+func buildSessionList(config *Config, userID int64) (string, [][]InlineKeyboardButton) {
+	names := make([]string, 0, len(config.Sessions))
+	for name, info := range config.Sessions {
+		if name != "" && info != nil && canAccessSession(config, userID, name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "No sessions. Use /new <name> to create one.", nil
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	var buttons [][]InlineKeyboardButton
+	sb.WriteString(fmt.Sprintf("📋 Sessions (%d)\n", len(names)))
+
+	for _, name := range names {
+		st := getSessionStatus(config, name, config.Sessions[name])
+
+		sb.WriteString(fmt.Sprintf("\n%s — %s", name, sessionStateLabels[st.State]))
+		if st.Pending > 0 {
+			sb.WriteString(fmt.Sprintf(" · 📨 %d pending", st.Pending))
+		}
+		if st.Queued > 0 {
+			sb.WriteString(fmt.Sprintf(" · ⏳ %d queued", st.Queued))
+		}
+		if st.LastEvent != nil {
+			age := time.Since(time.UnixMilli(st.LastEvent.Timestamp))
+			sb.WriteString(fmt.Sprintf("\n   last: %s %s ago", st.LastEvent.Type, formatAge(age)))
+		}
+		sb.WriteString("\n")
+
+		// Callback data is limited to 64 bytes; skip actions for names that don't fit
+		if len(listCallbackPrefix)+2+len(name) > 64 {
+			continue
+		}
+		restartLabel := "🔄 Restart"
+		if st.WindowDead {
+			restartLabel = "▶️ Start"
+		}
+		row := []InlineKeyboardButton{}
+		if st.TopicLink != "" {
+			row = append(row, InlineKeyboardButton{Text: "↗️ " + name, URL: st.TopicLink})
+		}
+		row = append(row,
+			InlineKeyboardButton{Text: restartLabel, CallbackData: listCallbackPrefix + "r:" + name},
+			InlineKeyboardButton{Text: "⏩ Continue", CallbackData: listCallbackPrefix + "c:" + name},
+			InlineKeyboardButton{Text: "🗑", CallbackData: listCallbackPrefix + "d:" + name},
+		)
+		buttons = append(buttons, row)
+	}
+
+	return sb.String(), buttons
+}
+
+// handleListCallback handles button presses from the /list dashboard
+func handleListCallback(config *Config, cb *CallbackQuery) {
+	parts := strings.SplitN(strings.TrimPrefix(cb.Data, listCallbackPrefix), ":", 2)
+	if len(parts) != 2 || cb.Message == nil {
+		return
+	}
+	action, sessName := parts[0], parts[1]
+	chatID := cb.Message.Chat.ID
+	threadID := cb.Message.MessageThreadID
+
+	config, _ = loadConfig()
+	info := config.Sessions[sessName]
+	if info == nil {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Session '%s' no longer exists", sessName))
+		return
+	}
+
+	// Report restarts in the session's own topic so the result sits next to its history
+	replyChat, replyThread := chatID, threadID
+	if config.GroupID != 0 && info.TopicID != 0 {
+		replyChat, replyThread = config.GroupID, info.TopicID
+	}
+
+	switch action {
+	case "r", "c":
+		continueSession := action == "c"
+		listenLog("[list] restart session=%s continue=%v", sessName, continueSession)
+		alive, err := restartSessionWindow(config, sessName, continueSession)
+		if err != nil {
+			sendMessage(config, replyChat, replyThread, fmt.Sprintf("❌ Failed to start: %v", err))
+		} else if !alive {
+			sendMessage(config, replyChat, replyThread, "⚠️ Session died immediately")
+		} else if continueSession {
+			sendMessage(config, replyChat, replyThread, fmt.Sprintf("🔄 Session '%s' restarted with conversation history", sessName))
+		} else {
+			sendMessage(config, replyChat, replyThread, fmt.Sprintf("🚀 Session '%s' restarted", sessName))
+		}
+
+	case "d":
+		// Deleting removes the topic and its history, so ask first
+		sendMessageWithKeyboard(config, chatID, threadID,
+			fmt.Sprintf("🗑 Delete session '%s' and its topic?", sessName),
+			[][]InlineKeyboardButton{{
+				{Text: "Yes, delete", CallbackData: listCallbackPrefix + "D:" + sessName},
+				{Text: "Cancel", CallbackData: listCallbackPrefix + "x:" + sessName},
+			}})
+
+	case "D":
+		listenLog("[list] delete session=%s", sessName)
+		topicID := info.TopicID
+		killSession(config, sessName)
+		result := fmt.Sprintf("🗑 Session '%s' deleted", sessName)
+		if topicID != 0 {
+			if err := deleteForumTopic(config, topicID); err != nil {
+				result += fmt.Sprintf(" (failed to delete thread: %v)", err)
+			}
+		}
+		editMessageRemoveKeyboard(config, chatID, cb.Message.MessageID, result)
+
+	case "x":
+		editMessageRemoveKeyboard(config, chatID, cb.Message.MessageID, "Cancelled")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
@@ -9,7 +10,6 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -19,12 +19,17 @@ import (
 type MessageRecord struct {
 	ID          string `json:"id"`
 	Session     string `json:"session"`
-	Type        string `json:"type"`   // user_prompt / assistant_text / tool_call / notification
+	Type        string `json:"type"` // user_prompt / assistant_text / tool_call / notification
 	Text        string `json:"text"`
-	Origin      string `json:"origin"` // terminal / telegram / claude
+	Origin      string `json:"origin"`           // terminal / telegram / claude
+	Author      string `json:"author,omitempty"` // Telegram user who sent a telegram-origin prompt
+	State       string `json:"state,omitempty"`  // "" (sent) / queued / dropped for Telegram prompts, failed for undeliverable messages
 	TgDelivered bool   `json:"tg_delivered"`
 	TgMsgID     int64  `json:"tg_msg_id,omitempty"`
+	NoticeMsgID int64  `json:"notice_msg_id,omitempty"` // "queued" notice of a queued prompt
 	RetryCount  int    `json:"retry_count"`
+	NextAttempt int64  `json:"next_attempt,omitempty"` // unix ms before which a failed send isn't retried
+	LastError   string `json:"last_error,omitempty"`
 	Timestamp   int64  `json:"timestamp"`
 }
 
@@ -84,6 +89,59 @@ func openDB() *sql.DB {
 				tools_json TEXT DEFAULT '[]'
 			)`,
 
+			// Sessions: registry of session name -> topic, path, window, Claude session
+			`CREATE TABLE IF NOT EXISTS sessions (
+				name              TEXT PRIMARY KEY,
+				topic_id          INTEGER NOT NULL DEFAULT 0,
+				path              TEXT NOT NULL DEFAULT '',
+				claude_session_id TEXT NOT NULL DEFAULT '',
+				window_id         TEXT NOT NULL DEFAULT '',
+				transcript_path   TEXT NOT NULL DEFAULT '',
+				hide_diffs        INTEGER NOT NULL DEFAULT 0,
+				updated_at        INTEGER NOT NULL
+			)`,
+
+			// Updates: Telegram update IDs the listener has finished handling,
+			// so a redelivered update isn't handled twice
+			`CREATE TABLE IF NOT EXISTS updates (
+				update_id  INTEGER PRIMARY KEY,
+				created_at INTEGER NOT NULL
+			)`,
+
+			// Side effects (shell command, prompt, self-update) already started
+			// for an update, so redelivering one that was cut short by a crash
+			// doesn't run them twice
+			`CREATE TABLE IF NOT EXISTS update_effects (
+				update_id  INTEGER NOT NULL,
+				effect     TEXT NOT NULL,
+				created_at INTEGER NOT NULL,
+				PRIMARY KEY (update_id, effect)
+			)`,
+
+			// Pending updates: fetched from Telegram (and so confirmed to it)
+			// but not handled yet, replayed when the listener restarts
+			`CREATE TABLE IF NOT EXISTS pending_updates (
+				update_id  INTEGER PRIMARY KEY,
+				data       TEXT NOT NULL,
+				created_at INTEGER NOT NULL
+			)`,
+
+			// Key/value state of the listener (getUpdates offset)
+			`CREATE TABLE IF NOT EXISTS kv (
+				key   TEXT PRIMARY KEY,
+				value TEXT NOT NULL
+			)`,
+
+			// Transcript cursors: how far hooks and the listener have read
+			// each Claude transcript
+			`CREATE TABLE IF NOT EXISTS transcript_cursors (
+				path        TEXT PRIMARY KEY,
+				byte_offset INTEGER NOT NULL DEFAULT 0,
+				inode       INTEGER NOT NULL DEFAULT 0,
+				size        INTEGER NOT NULL DEFAULT 0,
+				updated_at  INTEGER NOT NULL
+			)`,
+
 			// Migration: drop old columns if they exist (SQLite ignores unknown columns in SELECT)
 			// We handle this by creating new table if old one has terminal_delivered
 		} {
@@ -97,6 +155,17 @@ func openDB() *sql.DB {
 
 		// Add retry_count column if missing (from earlier schema)
 		db.Exec(`ALTER TABLE messages ADD COLUMN retry_count INTEGER DEFAULT 0`)
+		db.Exec(`ALTER TABLE messages ADD COLUMN author TEXT DEFAULT ''`)
+		db.Exec(`ALTER TABLE messages ADD COLUMN state TEXT DEFAULT ''`)
+		db.Exec(`ALTER TABLE messages ADD COLUMN queue_pos INTEGER DEFAULT 0`)
+		db.Exec(`ALTER TABLE messages ADD COLUMN notice_msg_id INTEGER DEFAULT 0`)
+		db.Exec(`ALTER TABLE messages ADD COLUMN next_attempt_at INTEGER DEFAULT 0`)
+		db.Exec(`ALTER TABLE messages ADD COLUMN last_error TEXT DEFAULT ''`)
+		db.Exec(`ALTER TABLE sessions ADD COLUMN transcript_path TEXT NOT NULL DEFAULT ''`)
+		db.Exec(`ALTER TABLE sessions ADD COLUMN hide_diffs INTEGER NOT NULL DEFAULT 0`)
+
+		// Full-text index over prompts and replies, for /search
+		initSearchIndex(db)
 
 		dbInstance = db
 	})
@@ -158,6 +227,40 @@ func migrateMessages(db *sql.DB) {
 	}
 }
 
+// searchableTypes are the message types indexed for /search: what was said,
+// not tool calls or notifications
+const searchableTypes = `('user_prompt', 'assistant_text', 'tool_text')`
+
+// initSearchIndex creates the messages_fts index and the triggers that keep
+// it in sync with messages. Existing messages are indexed when it is created.
+func initSearchIndex(db *sql.DB) {
+	var exists int
+	db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'messages_fts'`).Scan(&exists)
+
+	for _, stmt := range []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(text)`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages
+		 WHEN new.type IN ` + searchableTypes + ` BEGIN
+		   INSERT INTO messages_fts (rowid, text) VALUES (new.rowid, new.text);
+		 END`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF text ON messages BEGIN
+		   DELETE FROM messages_fts WHERE rowid = old.rowid;
+		   INSERT INTO messages_fts (rowid, text) SELECT new.rowid, new.text WHERE new.type IN ` + searchableTypes + `;
+		 END`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+		   DELETE FROM messages_fts WHERE rowid = old.rowid;
+		 END`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			hookLog("db: search index setup failed: %v", err)
+			return
+		}
+	}
+	if exists == 0 {
+		db.Exec(`INSERT INTO messages_fts (rowid, text) SELECT rowid, text FROM messages WHERE type IN ` + searchableTypes)
+	}
+}
+
 // closeDB closes the database connection
 func closeDB() {
 	if dbInstance != nil {
@@ -179,6 +282,36 @@ func logEvent(session, eventType, source, refID, detail string) {
 	)
 }
 
+// EventRecord is a single row from the events timeline
+type EventRecord struct {
+	Session   string
+	Type      string
+	Source    string
+	RefID     string
+	Detail    string
+	Timestamp int64
+}
+
+// lastEvent returns the most recent timeline event for a session, or nil if none
+func lastEvent(session string) *EventRecord {
+	db := openDB()
+	if db == nil {
+		return nil
+	}
+	var e EventRecord
+	var refID, detail sql.NullString
+	err := db.QueryRow(
+		`SELECT session, type, source, ref_id, detail, created_at
+		 FROM events WHERE session = ? ORDER BY id DESC LIMIT 1`, session,
+	).Scan(&e.Session, &e.Type, &e.Source, &refID, &detail, &e.Timestamp)
+	if err != nil {
+		return nil
+	}
+	e.RefID = refID.String
+	e.Detail = detail.String
+	return &e
+}
+
 // --- Messages (current state) ---
 
 // appendMessage inserts a message record. If the ID already exists,
@@ -192,12 +325,12 @@ func appendMessage(rec *MessageRecord) error {
 		rec.Timestamp = time.Now().UnixMilli()
 	}
 	_, err := db.Exec(
-		`INSERT INTO messages (id, session, type, text, origin, tg_delivered, tg_msg_id, retry_count, created_at)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?)
+		`INSERT INTO messages (id, session, type, text, origin, author, tg_delivered, tg_msg_id, retry_count, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, 0, ?)
 		 ON CONFLICT(id) DO UPDATE SET
 		   tg_delivered = MAX(tg_delivered, excluded.tg_delivered),
 		   tg_msg_id = CASE WHEN excluded.tg_msg_id > 0 THEN excluded.tg_msg_id ELSE tg_msg_id END`,
-		rec.ID, rec.Session, rec.Type, rec.Text, rec.Origin,
+		rec.ID, rec.Session, rec.Type, rec.Text, rec.Origin, rec.Author,
 		boolToInt(rec.TgDelivered), rec.TgMsgID, rec.Timestamp,
 	)
 	return err
@@ -216,6 +349,56 @@ func markDelivered(msgID string, tgMsgID int64) error {
 	return err
 }
 
+// hasMessage checks if a message has been recorded, delivered or not
+func hasMessage(msgID string) bool {
+	db := openDB()
+	if db == nil {
+		return false
+	}
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM messages WHERE id = ?`, msgID).Scan(&n)
+	return n > 0
+}
+
+// messageText returns the text of a recorded message, or "" if there is none
+func messageText(msgID string) string {
+	db := openDB()
+	if db == nil {
+		return ""
+	}
+	var text string
+	db.QueryRow(`SELECT COALESCE(text, '') FROM messages WHERE id = ?`, msgID).Scan(&text)
+	return text
+}
+
+// reviseMessage replaces the text of a recorded message. A delivered message
+// becomes pending again, keeping its tg_msg_id, so deliveryLoop edits it on
+// Telegram instead of sending a new one. Returns false if the text is the same.
+func reviseMessage(msgID string, text string) bool {
+	db := openDB()
+	if db == nil {
+		return false
+	}
+	res, err := db.Exec(`UPDATE messages SET text = ?, tg_delivered = 0 WHERE id = ? AND text != ?`, text, msgID, text)
+	if err != nil {
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+// sharesTgMessage reports whether other messages of a session were
+// delivered into the same Telegram message, i.e. it is a tool blockquote
+func sharesTgMessage(session string, tgMsgID int64, msgID string) bool {
+	db := openDB()
+	if db == nil {
+		return false
+	}
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM messages WHERE session = ? AND tg_msg_id = ? AND id != ?`, session, tgMsgID, msgID).Scan(&n)
+	return n > 0
+}
+
 // isDelivered checks if a message has been delivered to Telegram
 func isDelivered(msgID string) bool {
 	db := openDB()
@@ -232,20 +415,20 @@ func isDelivered(msgID string) bool {
 	return delivered != 0
 }
 
-const maxRetries = 5
+const maxRetries = 8
 
 // findPending returns messages not yet delivered to Telegram for a session, ordered by created_at.
-// Messages that exceeded maxRetries are excluded.
+// Failed messages are excluded until they are retried (see retryFailed).
 func findPending(session string) []*MessageRecord {
 	db := openDB()
 	if db == nil {
 		return nil
 	}
 	rows, err := db.Query(
-		`SELECT id, session, type, text, origin, tg_delivered, tg_msg_id, retry_count, created_at
-		 FROM messages WHERE session = ? AND tg_delivered = 0 AND retry_count < ?
+		`SELECT id, session, type, text, origin, tg_delivered, tg_msg_id, retry_count, COALESCE(next_attempt_at, 0), created_at
+		 FROM messages WHERE session = ? AND tg_delivered = 0 AND COALESCE(state, '') = ''
 		 ORDER BY created_at`,
-		session, maxRetries,
+		session,
 	)
 	if err != nil {
 		return nil
@@ -257,7 +440,7 @@ func findPending(session string) []*MessageRecord {
 		var r MessageRecord
 		var tgDel int
 		if err := rows.Scan(&r.ID, &r.Session, &r.Type, &r.Text, &r.Origin,
-			&tgDel, &r.TgMsgID, &r.RetryCount, &r.Timestamp); err != nil {
+			&tgDel, &r.TgMsgID, &r.RetryCount, &r.NextAttempt, &r.Timestamp); err != nil {
 			continue
 		}
 		r.TgDelivered = tgDel != 0
@@ -266,13 +449,88 @@ func findPending(session string) []*MessageRecord {
 	return result
 }
 
-// incRetry increments the retry count for a message
-func incRetry(msgID string) {
+// scheduleRetry counts a failed send and holds the message back until next
+func scheduleRetry(msgID string, next time.Time, errMsg string) {
 	db := openDB()
 	if db == nil {
 		return
 	}
-	db.Exec(`UPDATE messages SET retry_count = retry_count + 1 WHERE id = ?`, msgID)
+	db.Exec(`UPDATE messages SET retry_count = retry_count + 1, next_attempt_at = ?, last_error = ? WHERE id = ?`,
+		next.UnixMilli(), errMsg, msgID)
+}
+
+// markFailed counts a failed send and moves the message to the failed list
+func markFailed(msgID string, errMsg string) {
+	db := openDB()
+	if db == nil {
+		return
+	}
+	db.Exec(`UPDATE messages SET retry_count = retry_count + 1, state = ?, last_error = ? WHERE id = ?`,
+		msgStateFailed, errMsg, msgID)
+}
+
+// failedMessages returns messages that could not be delivered, oldest first.
+// An empty session returns those of all sessions.
+func failedMessages(session string) []*MessageRecord {
+	db := openDB()
+	if db == nil {
+		return nil
+	}
+	rows, err := db.Query(
+		`SELECT id, session, type, text, origin, retry_count, COALESCE(last_error, ''), created_at
+		 FROM messages WHERE state = ? AND tg_delivered = 0 AND (? = '' OR session = ?)
+		 ORDER BY created_at`,
+		msgStateFailed, session, session,
+	)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var result []*MessageRecord
+	for rows.Next() {
+		var r MessageRecord
+		var text sql.NullString
+		if err := rows.Scan(&r.ID, &r.Session, &r.Type, &text, &r.Origin, &r.RetryCount, &r.LastError, &r.Timestamp); err != nil {
+			continue
+		}
+		r.Text = text.String
+		r.State = msgStateFailed
+		result = append(result, &r)
+	}
+	return result
+}
+
+// retryFailed puts a failed message back in line for delivery with a fresh
+// retry budget. Returns false if it wasn't failed.
+func retryFailed(msgID string) bool {
+	db := openDB()
+	if db == nil {
+		return false
+	}
+	res, err := db.Exec(
+		`UPDATE messages SET state = '', retry_count = 0, next_attempt_at = 0, last_error = ''
+		 WHERE id = ? AND state = ?`, msgID, msgStateFailed)
+	if err != nil {
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+// dropFailed gives up on a failed message for good. Returns false if it
+// wasn't failed.
+func dropFailed(msgID string) bool {
+	db := openDB()
+	if db == nil {
+		return false
+	}
+	res, err := db.Exec(`UPDATE messages SET state = ? WHERE id = ? AND state = ?`, msgStateDropped, msgID, msgStateFailed)
+	if err != nil {
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
 }
 
 // isPermanentError checks if an error should not be retried
@@ -284,6 +542,8 @@ func isPermanentError(errMsg string) bool {
 		"chat_id is empty",
 		"not enough rights",
 		"PEER_ID_INVALID",
+		"message to edit not found",
+		"message can't be edited",
 	}
 	lower := strings.ToLower(errMsg)
 	for _, p := range permanent {
@@ -304,7 +564,8 @@ func isFromTelegram(session, promptText string) bool {
 	var count int
 	err := db.QueryRow(
 		`SELECT COUNT(*) FROM messages
-		 WHERE session = ? AND origin = 'telegram' AND type = 'user_prompt' AND text = ?`,
+		 WHERE session = ? AND origin = 'telegram' AND type = 'user_prompt' AND text = ?
+		   AND COALESCE(state, '') = ''`,
 		session, promptText,
 	).Scan(&count)
 	if err != nil {
@@ -320,7 +581,7 @@ func allSessions() []string {
 		return nil
 	}
 	rows, err := db.Query(
-		`SELECT DISTINCT session FROM messages WHERE tg_delivered = 0`,
+		`SELECT DISTINCT session FROM messages WHERE tg_delivered = 0 AND COALESCE(state, '') = ''`,
 	)
 	if err != nil {
 		return nil
@@ -337,34 +598,186 @@ func allSessions() []string {
 	return sessions
 }
 
-// --- Tool State ---
+// sessionHistory returns a session's prompts, replies and tool calls created
+// at or after since (unix ms), oldest first. Prompts that were queued but
+// never sent are left out.
+func sessionHistory(session string, since int64) []*MessageRecord {
+	db := openDB()
+	if db == nil {
+		return nil
+	}
+	rows, err := db.Query(
+		`SELECT id, session, type, text, origin, author, created_at
+		 FROM messages WHERE session = ? AND created_at >= ?
+		   AND type IN ('user_prompt', 'assistant_text', 'tool_text', 'tool_call')
+		   AND NOT (type = 'user_prompt' AND COALESCE(state, '') IN (?, ?))
+		 ORDER BY created_at`,
+		session, since, msgStateQueued, msgStateDropped,
+	)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
 
-// ToolState tracks tool calls and the Telegram message ID for live updates
-type ToolState struct {
-	MsgID int64      `json:"msg_id"`
-	Tools []ToolCall `json:"tools"`
+	var result []*MessageRecord
+	for rows.Next() {
+		var r MessageRecord
+		var text, origin, author sql.NullString
+		if err := rows.Scan(&r.ID, &r.Session, &r.Type, &text, &origin, &author, &r.Timestamp); err != nil {
+			continue
+		}
+		r.Text, r.Origin, r.Author = text.String, origin.String, author.String
+		result = append(result, &r)
+	}
+	return result
 }
 
-// lockToolState acquires a file lock for tool_state operations.
-// Returns unlock function. Caller must defer unlock().
-func lockToolState(session string) func() {
-	lockPath := filepath.Join(cacheDir(), "tool-state-"+session+".lock")
-	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+// --- Prompt queue ---
+
+// queuePrompt stores a Telegram prompt at the end of its session's queue.
+// Returns its position in the queue (1 = next).
+func queuePrompt(rec *MessageRecord) (int, error) {
+	db := openDB()
+	if db == nil {
+		return 0, fmt.Errorf("db not open")
+	}
+	if rec.Timestamp == 0 {
+		rec.Timestamp = time.Now().UnixMilli()
+	}
+	rec.State = msgStateQueued
+	_, err := db.Exec(
+		`INSERT OR IGNORE INTO messages (id, session, type, text, origin, author, tg_delivered, tg_msg_id, retry_count, created_at, state, queue_pos)
+		 VALUES (?, ?, ?, ?, ?, ?, 1, ?, 0, ?, ?,
+		   (SELECT COALESCE(MAX(queue_pos), 0) + 1 FROM messages WHERE session = ? AND state = ?))`,
+		rec.ID, rec.Session, rec.Type, rec.Text, rec.Origin, rec.Author, rec.TgMsgID, rec.Timestamp,
+		msgStateQueued, rec.Session, msgStateQueued,
+	)
 	if err != nil {
-		return func() {}
+		return 0, err
+	}
+	return len(queuedPrompts(rec.Session)), nil
+}
+
+// queuedPrompts returns a session's queued prompts, next first
+func queuedPrompts(session string) []*MessageRecord {
+	db := openDB()
+	if db == nil {
+		return nil
 	}
-	syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
-	return func() {
-		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
-		f.Close()
+	rows, err := db.Query(
+		`SELECT id, session, type, text, origin, author, tg_msg_id, notice_msg_id, created_at
+		 FROM messages WHERE session = ? AND state = ? ORDER BY queue_pos, created_at`,
+		session, msgStateQueued,
+	)
+	if err != nil {
+		return nil
 	}
+	defer rows.Close()
+
+	var result []*MessageRecord
+	for rows.Next() {
+		var r MessageRecord
+		var author sql.NullString
+		if err := rows.Scan(&r.ID, &r.Session, &r.Type, &r.Text, &r.Origin, &author, &r.TgMsgID, &r.NoticeMsgID, &r.Timestamp); err != nil {
+			continue
+		}
+		r.Author = author.String
+		r.State = msgStateQueued
+		r.TgDelivered = true
+		result = append(result, &r)
+	}
+	return result
+}
+
+// queuedSessions returns the sessions that have queued prompts
+func queuedSessions() []string {
+	db := openDB()
+	if db == nil {
+		return nil
+	}
+	rows, err := db.Query(`SELECT DISTINCT session FROM messages WHERE state = ?`, msgStateQueued)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var sessions []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err == nil {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
+
+// hasQueuedPrompts reports whether a session has prompts waiting
+func hasQueuedPrompts(session string) bool {
+	db := openDB()
+	if db == nil {
+		return false
+	}
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM messages WHERE session = ? AND state = ?`, session, msgStateQueued).Scan(&count)
+	return count > 0
+}
+
+// setQueuedState moves a queued prompt to a new state ("" once sent).
+// Returns false if it was no longer queued, so two callers can't both take it.
+func setQueuedState(msgID string, state string) bool {
+	db := openDB()
+	if db == nil {
+		return false
+	}
+	res, err := db.Exec(`UPDATE messages SET state = ? WHERE id = ? AND state = ?`, state, msgID, msgStateQueued)
+	if err != nil {
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+// setQueueNotice records the "queued" notice sent for a queued prompt, which
+// is edited once the prompt is sent
+func setQueueNotice(msgID string, noticeMsgID int64) {
+	db := openDB()
+	if db == nil {
+		return
+	}
+	db.Exec(`UPDATE messages SET notice_msg_id = ? WHERE id = ?`, noticeMsgID, msgID)
+}
+
+// reorderQueue rewrites queue positions to follow ids
+func reorderQueue(ids []string) {
+	db := openDB()
+	if db == nil {
+		return
+	}
+	for i, id := range ids {
+		db.Exec(`UPDATE messages SET queue_pos = ? WHERE id = ? AND state = ?`, i+1, id, msgStateQueued)
+	}
+}
+
+// --- Tool State ---
+
+// ToolState tracks tool calls and the Telegram message ID for live updates.
+// Only the listener reads and writes it (see addToolEvent).
+type ToolState struct {
+	MsgID int64      `json:"msg_id"`
+	Tools []ToolCall `json:"tools"`
 }
 
 type ToolCall struct {
 	Name   string `json:"name"`
 	Input  string `json:"input"`
 	IsText bool   `json:"is_text,omitempty"`
-	Time   int64  `json:"time,omitempty"`
+	Ref    string `json:"ref,omitempty"` // message ID it was recorded as, to apply revisions and results
+
+	// Set when the call finished (PostToolUse, or a failure in the transcript)
+	Status   string `json:"status,omitempty"` // ok / error
+	Duration int64  `json:"duration_ms,omitempty"`
+	Excerpt  string `json:"excerpt,omitempty"` // last line of the output
+	Time     int64  `json:"time,omitempty"`
 }
 
 func loadToolState(session string) *ToolState {
@@ -405,6 +818,402 @@ func clearToolState(session string) {
 	db.Exec(`DELETE FROM tool_state WHERE session = ?`, session)
 }
 
+// --- Sessions ---
+
+// loadSessions returns all registered sessions
+func loadSessions() map[string]*SessionInfo {
+	sessions := make(map[string]*SessionInfo)
+	db := openDB()
+	if db == nil {
+		return sessions
+	}
+	rows, err := db.Query(`SELECT name, topic_id, path, claude_session_id, window_id, transcript_path, hide_diffs FROM sessions`)
+	if err != nil {
+		return sessions
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		info := &SessionInfo{}
+		if rows.Scan(&name, &info.TopicID, &info.Path, &info.ClaudeSessionID, &info.WindowID, &info.TranscriptPath, &info.HideDiffs) == nil {
+			sessions[name] = info
+		}
+	}
+	return sessions
+}
+
+// saveSession registers a session or replaces its info
+func saveSession(name string, info *SessionInfo) error {
+	db := openDB()
+	if db == nil {
+		return fmt.Errorf("db not open")
+	}
+	_, err := db.Exec(
+		`INSERT OR REPLACE INTO sessions (name, topic_id, path, claude_session_id, window_id, transcript_path, hide_diffs, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		name, info.TopicID, info.Path, info.ClaudeSessionID, info.WindowID, info.TranscriptPath, info.HideDiffs, time.Now().UnixMilli(),
+	)
+	return err
+}
+
+// deleteSession removes a session from the registry
+func deleteSession(name string) error {
+	db := openDB()
+	if db == nil {
+		return fmt.Errorf("db not open")
+	}
+	_, err := db.Exec(`DELETE FROM sessions WHERE name = ?`, name)
+	return err
+}
+
+// updateSession applies fn to a session's stored info in a write transaction,
+// so processes updating different fields (window ID from the listener, Claude
+// session ID from hooks) don't overwrite each other. Returns the updated info.
+func updateSession(name string, fn func(info *SessionInfo)) (*SessionInfo, error) {
+	info := &SessionInfo{}
+	err := withWriteTx(func(ctx context.Context, conn *sql.Conn) error {
+		err := conn.QueryRowContext(ctx,
+			`SELECT topic_id, path, claude_session_id, window_id, transcript_path, hide_diffs FROM sessions WHERE name = ?`, name,
+		).Scan(&info.TopicID, &info.Path, &info.ClaudeSessionID, &info.WindowID, &info.TranscriptPath, &info.HideDiffs)
+		if err != nil {
+			return fmt.Errorf("session '%s' not found", name)
+		}
+		fn(info)
+		_, err = conn.ExecContext(ctx,
+			`UPDATE sessions SET topic_id = ?, path = ?, claude_session_id = ?, window_id = ?, transcript_path = ?, hide_diffs = ?, updated_at = ? WHERE name = ?`,
+			info.TopicID, info.Path, info.ClaudeSessionID, info.WindowID, info.TranscriptPath, info.HideDiffs, time.Now().UnixMilli(), name,
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// importSessions registers sessions found in an old config.json. Sessions
+// already in the registry are kept as they are.
+func importSessions(sessions map[string]*SessionInfo) error {
+	return withWriteTx(func(ctx context.Context, conn *sql.Conn) error {
+		for name, info := range sessions {
+			if info == nil {
+				continue
+			}
+			_, err := conn.ExecContext(ctx,
+				`INSERT OR IGNORE INTO sessions (name, topic_id, path, claude_session_id, window_id, transcript_path, hide_diffs, updated_at)
+				 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				name, info.TopicID, info.Path, info.ClaudeSessionID, info.WindowID, info.TranscriptPath, info.HideDiffs, time.Now().UnixMilli(),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// withWriteTx runs fn in a transaction that takes the write lock up front
+// (BEGIN IMMEDIATE), so read-modify-write from concurrent processes waits
+// for busy_timeout instead of failing when its read lock can't be upgraded
+func withWriteTx(fn func(ctx context.Context, conn *sql.Conn) error) error {
+	db := openDB()
+	if db == nil {
+		return fmt.Errorf("db not open")
+	}
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE`); err != nil {
+		return err
+	}
+	if err := fn(ctx, conn); err != nil {
+		conn.ExecContext(ctx, `ROLLBACK`)
+		return err
+	}
+	_, err = conn.ExecContext(ctx, `COMMIT`)
+	return err
+}
+
+// --- Telegram updates ---
+
+// updateRetention is how long handled update IDs are remembered. Telegram
+// keeps unconfirmed updates for 24 hours.
+const updateRetention = 7 * 24 * time.Hour
+
+// updateHandled reports whether an update was handled before: a redelivery
+// after a restart or a webhook retry
+func updateHandled(updateID int) bool {
+	db := openDB()
+	if db == nil {
+		return false
+	}
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM updates WHERE update_id = ?`, updateID).Scan(&n)
+	return n > 0
+}
+
+// markUpdateHandled records that an update's handler has returned. An update
+// in progress when the listener stops is handled again when redelivered.
+func markUpdateHandled(updateID int) {
+	db := openDB()
+	if db == nil {
+		return
+	}
+	db.Exec(`INSERT OR IGNORE INTO updates (update_id, created_at) VALUES (?, ?)`, updateID, time.Now().UnixMilli())
+	if updateID%100 == 0 {
+		cutoff := time.Now().Add(-updateRetention).UnixMilli()
+		db.Exec(`DELETE FROM updates WHERE created_at < ?`, cutoff)
+		db.Exec(`DELETE FROM update_effects WHERE created_at < ?`, cutoff)
+	}
+}
+
+// claimEffect records that an update's side effect (effect names it: "shell",
+// "prompt", "update") is about to happen. Returns false if it was claimed
+// before, i.e. the update is being handled again after a crash and the side
+// effect must not be repeated.
+func claimEffect(updateID int, effect string) bool {
+	db := openDB()
+	if db == nil {
+		return true
+	}
+	res, err := db.Exec(`INSERT OR IGNORE INTO update_effects (update_id, effect, created_at) VALUES (?, ?, ?)`,
+		updateID, effect, time.Now().UnixMilli())
+	if err != nil {
+		return true
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+// savePendingUpdate stores an update until its handler has run
+func savePendingUpdate(update Update) {
+	db := openDB()
+	if db == nil {
+		return
+	}
+	data, _ := json.Marshal(update)
+	db.Exec(`INSERT OR IGNORE INTO pending_updates (update_id, data, created_at) VALUES (?, ?, ?)`,
+		update.UpdateID, string(data), time.Now().UnixMilli())
+}
+
+// removePendingUpdate forgets an update once it is handled
+func removePendingUpdate(updateID int) {
+	db := openDB()
+	if db == nil {
+		return
+	}
+	db.Exec(`DELETE FROM pending_updates WHERE update_id = ?`, updateID)
+}
+
+// loadPendingUpdates returns the updates a previous listener didn't finish,
+// oldest first
+func loadPendingUpdates() []Update {
+	db := openDB()
+	if db == nil {
+		return nil
+	}
+	rows, err := db.Query(`SELECT data FROM pending_updates ORDER BY update_id`)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	var updates []Update
+	for rows.Next() {
+		var data string
+		var update Update
+		if rows.Scan(&data) == nil && json.Unmarshal([]byte(data), &update) == nil {
+			updates = append(updates, update)
+		}
+	}
+	return updates
+}
+
+// loadUpdateOffset returns the getUpdates offset saved by the last listener
+func loadUpdateOffset() int {
+	db := openDB()
+	if db == nil {
+		return 0
+	}
+	var offset int
+	db.QueryRow(`SELECT CAST(value AS INTEGER) FROM kv WHERE key = 'update_offset'`).Scan(&offset)
+	return offset
+}
+
+// saveUpdateOffset stores the getUpdates offset once updates below it are
+// dispatched (and saved in pending_updates)
+func saveUpdateOffset(offset int) {
+	db := openDB()
+	if db == nil {
+		return
+	}
+	db.Exec(`INSERT OR REPLACE INTO kv (key, value) VALUES ('update_offset', ?)`, fmt.Sprint(offset))
+}
+
+// loadPlanMessage returns the message ID of a session's pinned plan, or 0
+func loadPlanMessage(session string) int64 {
+	db := openDB()
+	if db == nil {
+		return 0
+	}
+	var msgID int64
+	db.QueryRow(`SELECT CAST(value AS INTEGER) FROM kv WHERE key = ?`, "plan:"+session).Scan(&msgID)
+	return msgID
+}
+
+// savePlanMessage stores the message ID of a session's pinned plan; 0 forgets it
+func savePlanMessage(session string, msgID int64) {
+	db := openDB()
+	if db == nil {
+		return
+	}
+	if msgID == 0 {
+		db.Exec(`DELETE FROM kv WHERE key = ?`, "plan:"+session)
+		return
+	}
+	db.Exec(`INSERT OR REPLACE INTO kv (key, value) VALUES (?, ?)`, "plan:"+session, fmt.Sprint(msgID))
+}
+
+// toolResults returns the tool_result messages shown in a blockquote, in order
+func toolResults(session string, tgMsgID int64) []*MessageRecord {
+	db := openDB()
+	if db == nil {
+		return nil
+	}
+	rows, err := db.Query(
+		`SELECT id, text, created_at FROM messages
+		 WHERE session = ? AND type = 'tool_result' AND tg_msg_id = ? ORDER BY created_at`,
+		session, tgMsgID,
+	)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var result []*MessageRecord
+	for rows.Next() {
+		r := MessageRecord{Session: session, Type: "tool_result", TgMsgID: tgMsgID}
+		if rows.Scan(&r.ID, &r.Text, &r.Timestamp) == nil {
+			result = append(result, &r)
+		}
+	}
+	return result
+}
+
+// --- Transcript cursors ---
+
+// transcriptCursor is how far a transcript has been read. Inode and size
+// identify the file read, so a transcript that is replaced or rewritten
+// (rotation, compaction) is noticed instead of read from a stale offset.
+type transcriptCursor struct {
+	Offset int64
+	Inode  int64
+	Size   int64
+}
+
+// loadTranscriptCursor returns the cursor of a transcript, or nil if it
+// was never read
+func loadTranscriptCursor(path string) *transcriptCursor {
+	db := openDB()
+	if db == nil {
+		return nil
+	}
+	var c transcriptCursor
+	if db.QueryRow(`SELECT byte_offset, inode, size FROM transcript_cursors WHERE path = ?`, path).Scan(&c.Offset, &c.Inode, &c.Size) != nil {
+		return nil
+	}
+	return &c
+}
+
+// advanceTranscriptCursor calls read with the transcript's cursor (nil if
+// none) and stores the cursor it returns. It holds the write lock, so hooks
+// and the listener reading concurrently never get the same lines.
+func advanceTranscriptCursor(path string, read func(cur *transcriptCursor) (*transcriptCursor, error)) error {
+	return withWriteTx(func(ctx context.Context, conn *sql.Conn) error {
+		var cur *transcriptCursor
+		var c transcriptCursor
+		if conn.QueryRowContext(ctx, `SELECT byte_offset, inode, size FROM transcript_cursors WHERE path = ?`, path).Scan(&c.Offset, &c.Inode, &c.Size) == nil {
+			cur = &c
+		}
+		next, err := read(cur)
+		if err != nil {
+			return err
+		}
+		_, err = conn.ExecContext(ctx, `INSERT OR REPLACE INTO transcript_cursors (path, byte_offset, inode, size, updated_at) VALUES (?, ?, ?, ?, ?)`,
+			path, next.Offset, next.Inode, next.Size, time.Now().UnixMilli())
+		return err
+	})
+}
+
+// --- Search ---
+
+// Snippet markers around matched terms; formatters turn them into bold or «»
+const (
+	matchStart = "\x02"
+	matchEnd   = "\x03"
+)
+
+// SearchHit is a message matching a search query
+type SearchHit struct {
+	MessageRecord
+	Snippet string // text around the match, terms between matchStart and matchEnd
+}
+
+// searchMessages returns prompts and replies matching query, newest first.
+// An empty session searches all sessions.
+func searchMessages(query string, session string, limit int) ([]*SearchHit, error) {
+	db := openDB()
+	if db == nil {
+		return nil, fmt.Errorf("db not open")
+	}
+	rows, err := db.Query(
+		`SELECT m.id, m.session, m.type, m.origin, m.tg_msg_id, m.created_at,
+		   snippet(messages_fts, 0, ?, ?, '…', 16)
+		 FROM messages_fts JOIN messages m ON m.rowid = messages_fts.rowid
+		 WHERE messages_fts MATCH ? AND (? = '' OR m.session = ?)
+		   AND NOT (m.type = 'user_prompt' AND COALESCE(m.state, '') IN (?, ?))
+		 ORDER BY m.created_at DESC LIMIT ?`,
+		matchStart, matchEnd, ftsQuery(query), session, session, msgStateQueued, msgStateDropped, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hits []*SearchHit
+	for rows.Next() {
+		var h SearchHit
+		var origin sql.NullString
+		if err := rows.Scan(&h.ID, &h.Session, &h.Type, &origin, &h.TgMsgID, &h.Timestamp, &h.Snippet); err != nil {
+			continue
+		}
+		h.Origin = origin.String
+		hits = append(hits, &h)
+	}
+	return hits, rows.Err()
+}
+
+// ftsQuery turns typed words into an FTS5 query matching all of them, so
+// punctuation and FTS operators in the input are taken literally. A trailing
+// * keeps its prefix meaning (migrat* matches migration).
+func ftsQuery(q string) string {
+	var terms []string
+	for _, word := range strings.Fields(q) {
+		prefix := len(word) > 1 && strings.HasSuffix(word, "*")
+		if prefix {
+			word = strings.TrimSuffix(word, "*")
+		}
+		term := `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+		if prefix {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " ")
+}
+
 // --- Helpers ---
 
 func boolToInt(b bool) int {
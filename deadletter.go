@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Delivery retry backoff: the delay doubles with each failed send, up to
+// maxRetryDelay. After maxRetries the message is marked failed and waits in
+// the failed list for `ccc queue retry` or /queue retry.
+const (
+	retryBaseDelay = 2 * time.Second
+	maxRetryDelay  = 5 * time.Minute
+)
+
+// retryBackoff returns how long to wait after the retry'th failed send. Half
+// of the delay is random, so sessions hit by the same outage don't retry in
+// lockstep.
+func retryBackoff(retry int) time.Duration {
+	d := maxRetryDelay
+	if retry < 20 {
+		d = min(retryBaseDelay<<max(retry-1, 0), maxRetryDelay)
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// formatFailed renders the failed messages of a session for /queue failed
+func formatFailed(sessName string, failed []*MessageRecord) string {
+	if len(failed) == 0 {
+		return fmt.Sprintf("✅ No failed messages for '%s'", sessName)
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("⚠️ Not delivered in '%s'\n\n", sessName))
+	for i, rec := range failed {
+		age := formatAge(time.Since(time.UnixMilli(rec.Timestamp)))
+		sb.WriteString(fmt.Sprintf("%d. [%s, %s ago] %s\n   ↳ %s\n", i+1, rec.Type, age, truncateRunes(rec.Text, 80), truncateRunes(rec.LastError, 80)))
+	}
+	sb.WriteString("\n/queue retry <n|all> · /queue discard <n|all>")
+	return sb.String()
+}
+
+// handleFailedCommand implements /queue failed, /queue retry <n|all> and
+// /queue discard <n|all> for a topic's session
+func handleFailedCommand(config *Config, sessName string, chatID int64, threadID int64, args []string) {
+	failed := failedMessages(sessName)
+	if args[0] == "failed" || len(args) != 2 {
+		sendMessage(config, chatID, threadID, formatFailed(sessName, failed))
+		return
+	}
+
+	picked := failed
+	if args[1] != "all" {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 || n > len(failed) {
+			sendMessage(config, chatID, threadID, fmt.Sprintf("❌ No failed message #%s", args[1]))
+			return
+		}
+		picked = failed[n-1 : n]
+	}
+
+	count := 0
+	for _, rec := range picked {
+		if args[0] == "retry" && retryFailed(rec.ID) {
+			logEvent(sessName, "send_retried", "listener", rec.ID, "")
+			count++
+		} else if args[0] == "discard" && dropFailed(rec.ID) {
+			logEvent(sessName, "send_dropped", "listener", rec.ID, "")
+			count++
+		}
+	}
+	if args[0] == "retry" {
+		wakeDelivery()
+		sendMessage(config, chatID, threadID, fmt.Sprintf("🔁 Retrying %d message(s)", count))
+	} else {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("🗑 Discarded %d failed message(s)", count))
+	}
+}
+
+// queueCommand implements `ccc queue [ls | retry <id|all> | drop <id|all>]`
+// for messages that could not be delivered to Telegram. discard is accepted
+// for drop, as in the topic, where /queue drop is for waiting prompts.
+func queueCommand(args []string) error {
+	failed := failedMessages("")
+	if len(args) == 0 || args[0] == "ls" {
+		if len(failed) == 0 {
+			fmt.Println("No failed messages")
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSESSION\tTYPE\tAGE\tATTEMPTS\tERROR\tTEXT")
+		for _, rec := range failed {
+			age := formatAge(time.Since(time.UnixMilli(rec.Timestamp)))
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", rec.ID, rec.Session, rec.Type, age, rec.RetryCount,
+				truncateRunes(rec.LastError, 40), truncateRunes(strings.ReplaceAll(rec.Text, "\n", " "), 50))
+		}
+		return w.Flush()
+	}
+
+	if len(args) != 2 || (args[0] != "retry" && args[0] != "drop" && args[0] != "discard") {
+		return fmt.Errorf("usage: ccc queue [ls | retry <id|all> | drop <id|all>]")
+	}
+	var ids []string
+	for _, rec := range failed {
+		if args[1] == "all" || rec.ID == args[1] {
+			ids = append(ids, rec.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("no failed message %s", args[1])
+	}
+	for _, id := range ids {
+		if args[0] == "retry" {
+			retryFailed(id)
+		} else {
+			dropFailed(id)
+		}
+	}
+	if args[0] == "retry" {
+		notifyListener()
+		fmt.Printf("Retrying %d message(s)\n", len(ids))
+	} else {
+		fmt.Printf("Dropped %d message(s)\n", len(ids))
+	}
+	return nil
+}
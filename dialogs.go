@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// dialogCallbackPrefix marks inline button callbacks answering a pane dialog.
+// Format: dlg:<kind>:<option>:<dialog hash>:<session>
+const dialogCallbackPrefix = "dlg:"
+
+// Kinds of Claude TUI dialogs that can be answered from Telegram
+const (
+	dialogPermission = "permission" // "Do you want to proceed?" tool approval
+	dialogTrust      = "trust"      // folder trust prompt at startup
+	dialogPlan       = "plan"       // plan mode approval
+)
+
+// dialogPattern recognizes a dialog by the question line above its options
+type dialogPattern struct {
+	Kind   string
+	Marker *regexp.Regexp
+}
+
+// dialogPatterns are matched against pane lines with box borders removed.
+// When several match, the one lowest on the screen wins.
+var dialogPatterns = []dialogPattern{
+	{dialogPermission, regexp.MustCompile(`(?i)^Do you want to (proceed|make this edit|create|allow|run|fetch|use)\b`)},
+	{dialogTrust, regexp.MustCompile(`(?i)(Do you trust the files in this folder|Is this a project you (created|trust))`)},
+	{dialogPlan, regexp.MustCompile(`(?i)^Would you like to proceed\?`)},
+}
+
+// dialogOptionRe matches a numbered option; ❯ marks the selected one
+var dialogOptionRe = regexp.MustCompile(`^(❯\s*)?(\d+)\.\s+(.+)$`)
+
+// Limits on text around a dialog's options, so questions and numbered
+// lists in Claude's own output aren't taken for dialogs
+const (
+	maxDialogDetailLines   = 8 // between the question and the options
+	maxDialogTrailingLines = 2 // below the options (hints like "Esc to exit")
+)
+
+// dialogBoxChars are trimmed from pane lines before matching
+const dialogBoxChars = " │┃║╭╮╰╯─"
+
+// paneDialog is a dialog found on a pane
+type paneDialog struct {
+	Kind     string
+	Text     string   // question and context shown above the options
+	Options  []string // option labels, option 1 first
+	Selected int      // index of the highlighted option
+}
+
+// hash identifies a dialog so stale buttons can't answer a newer one
+func (d *paneDialog) hash() string {
+	return contentHash(d.Kind + d.Text + strings.Join(d.Options, "\n"))
+}
+
+// detectPaneDialog finds a Claude dialog waiting for an answer in pane
+// content, or returns nil
+func detectPaneDialog(content string) *paneDialog {
+	raw := strings.Split(content, "\n")
+	lines := make([]string, len(raw))
+	for i := range raw {
+		lines[i] = strings.Trim(raw[i], dialogBoxChars)
+	}
+
+	// The question closest to the bottom is the one on screen now
+	markerLine, kind := -1, ""
+	for i := len(lines) - 1; i >= 0 && markerLine < 0; i-- {
+		for _, p := range dialogPatterns {
+			if p.Marker.MatchString(lines[i]) {
+				markerLine, kind = i, p.Kind
+				break
+			}
+		}
+	}
+	if markerLine < 0 {
+		return nil
+	}
+
+	d := &paneDialog{Kind: kind}
+	var details []string // text between the question and the options
+	end := len(lines)
+	for i := markerLine + 1; i < len(lines); i++ {
+		line := lines[i]
+		m := dialogOptionRe.FindStringSubmatch(line)
+		if m != nil {
+			if n, _ := strconv.Atoi(m[2]); n == len(d.Options)+1 {
+				if m[1] != "" {
+					d.Selected = len(d.Options)
+				}
+				d.Options = append(d.Options, strings.TrimSpace(m[3]))
+				continue
+			}
+		}
+		if len(d.Options) > 0 {
+			end = i
+			break
+		}
+		if line != "" {
+			details = append(details, line)
+		}
+	}
+	if len(d.Options) < 2 || len(details) > maxDialogDetailLines {
+		return nil
+	}
+	// A live dialog sits at the bottom of the pane in place of the input
+	// box; a question in Claude's output is followed by more text or the box
+	trailing := 0
+	for _, line := range lines[end:] {
+		if strings.HasPrefix(line, ">") || strings.HasPrefix(line, "❯") {
+			return nil
+		}
+		if line != "" {
+			trailing++
+		}
+	}
+	if trailing > maxDialogTrailingLines {
+		return nil
+	}
+
+	// Context: lines up to the question, back to the dialog's top border
+	start := markerLine
+	for start > 0 && markerLine-start < 15 {
+		above := strings.TrimSpace(raw[start-1])
+		if strings.HasPrefix(above, "╭") || (above != "" && strings.Trim(above, "─━") == "") {
+			break
+		}
+		start--
+	}
+	var text []string
+	for _, line := range lines[start : markerLine+1] {
+		if line != "" {
+			text = append(text, line)
+		}
+	}
+	d.Text = strings.Join(append(text, details...), "\n")
+	return d
+}
+
+// dialogKeys returns the keys that move the selection to option i and confirm it
+func dialogKeys(d *paneDialog, i int) []string {
+	var keys []string
+	for n := d.Selected; n < i; n++ {
+		keys = append(keys, "Down")
+	}
+	for n := d.Selected; n > i; n-- {
+		keys = append(keys, "Up")
+	}
+	return append(keys, "Enter")
+}
+
+// postedDialog is a dialog the listener has sent to Telegram
+type postedDialog struct {
+	Hash     string
+	Text     string
+	MsgID    int64
+	Answered bool // a button was pressed; the pane may take a moment to close it
+}
+
+var (
+	postedDialogs   = make(map[string]*postedDialog) // session -> dialog on its pane
+	postedDialogsMu sync.Mutex
+)
+
+// dialogTitles introduce each dialog kind in the topic
+var dialogTitles = map[string]string{
+	dialogPermission: "🔐 Claude is asking for permission",
+	dialogTrust:      "📁 Claude is asking whether to trust this folder",
+	dialogPlan:       "📝 Claude is asking to approve its plan",
+}
+
+// checkPaneDialogs scans session panes for dialogs and posts new ones to
+// their topics with a button per option. Called from deliveryLoop; the
+// Notification hook wakes it up for permission prompts.
+func checkPaneDialogs(config *Config) {
+	if config.GroupID == 0 {
+		return
+	}
+	for sessName, info := range config.Sessions {
+		if info == nil || info.TopicID == 0 {
+			continue
+		}
+		content, err := capturePane(tmuxTargetByID(info.WindowID, tmuxSafeName(sessName)))
+		var d *paneDialog
+		if err == nil {
+			d = detectPaneDialog(content)
+		}
+
+		postedDialogsMu.Lock()
+		prev := postedDialogs[sessName]
+		postedDialogsMu.Unlock()
+
+		if d != nil && prev != nil && prev.Hash == d.hash() {
+			continue // already posted
+		}
+		if prev != nil {
+			// Answered in the terminal (or replaced by another dialog)
+			if !prev.Answered {
+				editMessageRemoveKeyboard(config, config.GroupID, int(prev.MsgID), prev.Text+"\n\n✓ Dialog closed")
+			}
+			postedDialogsMu.Lock()
+			delete(postedDialogs, sessName)
+			postedDialogsMu.Unlock()
+		}
+		if d != nil {
+			postDialog(config, sessName, info.TopicID, d)
+		}
+	}
+}
+
+// postDialog sends a detected dialog to the session's topic
+func postDialog(config *Config, sessName string, topicID int64, d *paneDialog) {
+	text := fmt.Sprintf("%s\n\n%s", dialogTitles[d.Kind], d.Text)
+	var buttons [][]InlineKeyboardButton
+	for i, opt := range d.Options {
+		data := fmt.Sprintf("%s%s:%d:%s:%s", dialogCallbackPrefix, d.Kind, i, d.hash(), sessName)
+		if len(data) > 64 {
+			// Callback data is limited to 64 bytes; /keys still works
+			buttons = nil
+			text += "\n\n" + formatDialogOptions(d) + "\n\nSession name too long for buttons; answer with /keys"
+			break
+		}
+		buttons = append(buttons, []InlineKeyboardButton{{Text: fmt.Sprintf("%d. %s", i+1, truncateRunes(opt, 60)), CallbackData: data}})
+	}
+
+	var msgID int64
+	var err error
+	if len(buttons) > 0 {
+		msgID, err = sendMessageWithKeyboardGetID(config, config.GroupID, topicID, text, buttons)
+	} else {
+		msgID, err = sendMessageGetID(config, config.GroupID, topicID, text)
+	}
+	if err != nil {
+		listenLog("[dialog] %s: failed to post %s dialog: %v", sessName, d.Kind, err)
+		return
+	}
+	listenLog("[dialog] %s: posted %s dialog (%d options)", sessName, d.Kind, len(d.Options))
+	logEvent(sessName, "dialog_posted", "listener", d.hash(), d.Kind+": "+truncate(d.Text, 100))
+
+	postedDialogsMu.Lock()
+	postedDialogs[sessName] = &postedDialog{Hash: d.hash(), Text: text, MsgID: msgID}
+	postedDialogsMu.Unlock()
+}
+
+// formatDialogOptions lists options as "1. label" lines
+func formatDialogOptions(d *paneDialog) string {
+	lines := make([]string, len(d.Options))
+	for i, opt := range d.Options {
+		lines[i] = fmt.Sprintf("%d. %s", i+1, opt)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// handleDialogCallback presses the keys for the chosen option, if the
+// dialog is still the one on the pane
+func handleDialogCallback(config *Config, cb *CallbackQuery) {
+	parts := strings.SplitN(strings.TrimPrefix(cb.Data, dialogCallbackPrefix), ":", 4)
+	if len(parts) != 4 || cb.Message == nil {
+		return
+	}
+	option, _ := strconv.Atoi(parts[1])
+	hash, sessName := parts[2], parts[3]
+
+	target, err := sessionTarget(config, sessName)
+	var d *paneDialog
+	if err == nil {
+		if content, err := capturePane(target); err == nil {
+			d = detectPaneDialog(content)
+		}
+	}
+	if d == nil || d.hash() != hash || option < 0 || option >= len(d.Options) {
+		editMessageRemoveKeyboard(config, cb.Message.Chat.ID, cb.Message.MessageID, cb.Message.Text+"\n\n⌛ No longer showing")
+		return
+	}
+
+	if err := sendKeys(target, dialogKeys(d, option)...); err != nil {
+		sendMessage(config, cb.Message.Chat.ID, cb.Message.MessageThreadID, fmt.Sprintf("❌ Failed to send keys: %v", err))
+		return
+	}
+	by := userLabel(cb.From.ID, cb.From.Username, cb.From.FirstName)
+	listenLog("[dialog] %s: selected %d (%s) by %s", sessName, option+1, d.Options[option], by)
+	logEvent(sessName, "dialog_answered", "listener", hash, fmt.Sprintf("%s option=%d by=%s", d.Kind, option+1, by))
+
+	postedDialogsMu.Lock()
+	if prev := postedDialogs[sessName]; prev != nil && prev.Hash == hash {
+		prev.Answered = true
+	}
+	postedDialogsMu.Unlock()
+	editMessageRemoveKeyboard(config, cb.Message.Chat.ID, cb.Message.MessageID,
+		fmt.Sprintf("%s\n\n✓ %d. %s%s", cb.Message.Text, option+1, d.Options[option], byline(config, by)))
+}
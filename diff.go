@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// diffContext is how many unchanged lines surround each hunk
+const diffContext = 3
+
+// maxDiffCells bounds the line-matching table; beyond it the changed middle
+// of a file is shown as removed and re-added instead of matched line by line
+const maxDiffCells = 4_000_000
+
+// maxInlineDiff is the longest diff sent as a message; longer ones are sent
+// as a .diff document
+const maxInlineDiff = 3500
+
+// diffOp is a line of an edit script: ' ' kept, '-' removed, '+' added
+type diffOp struct {
+	Kind byte
+	Text string
+}
+
+// splitLines splits text into lines without their newlines
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines returns the edit script turning a into b. Common leading and
+// trailing lines are matched first, so an edit in a big file stays cheap.
+func diffLines(a, b []string) []diffOp {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+
+	var ops []diffOp
+	for _, l := range a[:pre] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	ops = append(ops, diffMiddle(a[pre:len(a)-suf], b[pre:len(b)-suf])...)
+	for _, l := range a[len(a)-suf:] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	return ops
+}
+
+// diffMiddle matches lines by longest common subsequence
+func diffMiddle(a, b []string) []diffOp {
+	var ops []diffOp
+	if len(a)*len(b) > maxDiffCells {
+		for _, l := range a {
+			ops = append(ops, diffOp{'-', l})
+		}
+		for _, l := range b {
+			ops = append(ops, diffOp{'+', l})
+		}
+		return ops
+	}
+
+	// lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int32, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
+
+// unifiedDiff renders the changes from before to after in unified diff
+// format, or "" if there are none
+func unifiedDiff(name, before, after string) string {
+	ops := diffLines(splitLines(before), splitLines(after))
+
+	// Lines of before and after preceding each op, for hunk headers
+	aLine := make([]int, len(ops)+1)
+	bLine := make([]int, len(ops)+1)
+	for k, op := range ops {
+		aLine[k+1], bLine[k+1] = aLine[k], bLine[k]
+		if op.Kind != '+' {
+			aLine[k+1]++
+		}
+		if op.Kind != '-' {
+			bLine[k+1]++
+		}
+	}
+	hunkRange := func(first, count int) string {
+		if count == 0 {
+			return fmt.Sprintf("%d,0", first)
+		}
+		if count == 1 {
+			return fmt.Sprint(first + 1)
+		}
+		return fmt.Sprintf("%d,%d", first+1, count)
+	}
+
+	var sb strings.Builder
+	for k := 0; k < len(ops); {
+		for k < len(ops) && ops[k].Kind == ' ' {
+			k++
+		}
+		if k == len(ops) {
+			break
+		}
+		// Changes closer than two contexts apart share a hunk
+		end := k
+		for {
+			for end < len(ops) && ops[end].Kind != ' ' {
+				end++
+			}
+			next := end
+			for next < len(ops) && ops[next].Kind == ' ' {
+				next++
+			}
+			if next == len(ops) || next-end > 2*diffContext {
+				break
+			}
+			end = next
+		}
+		start, stop := max(k-diffContext, 0), min(end+diffContext, len(ops))
+
+		if sb.Len() == 0 {
+			sb.WriteString(fmt.Sprintf("--- a/%s\n+++ b/%s\n", name, name))
+		}
+		sb.WriteString(fmt.Sprintf("@@ -%s +%s @@\n",
+			hunkRange(aLine[start], aLine[stop]-aLine[start]), hunkRange(bLine[start], bLine[stop]-bLine[start])))
+		for _, op := range ops[start:stop] {
+			sb.WriteByte(op.Kind)
+			sb.WriteString(op.Text + "\n")
+		}
+		k = stop
+	}
+	return sb.String()
+}
+
+// diffStat counts the added and removed lines of a unified diff
+func diffStat(diff string) (int, int) {
+	added, removed := 0, 0
+	for _, l := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(l, "+++ "), strings.HasPrefix(l, "--- "):
+		case strings.HasPrefix(l, "+"):
+			added++
+		case strings.HasPrefix(l, "-"):
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// toolDiff builds the unified diff of an Edit, MultiEdit or Write call from
+// the file as it is before the call. If the file can't be read or the edit
+// doesn't apply, the edited fragments are diffed instead. Returns "" for
+// other tools and calls that change nothing.
+func toolDiff(hookData HookData) string {
+	in := hookData.ToolInput
+	if in.FilePath == "" {
+		return ""
+	}
+	type edit struct {
+		old, new string
+		all      bool
+	}
+	var edits []edit
+	switch hookData.ToolName {
+	case "Write":
+	case "Edit":
+		edits = []edit{{in.OldString, in.NewString, in.ReplaceAll}}
+	case "MultiEdit":
+		for _, e := range in.Edits {
+			edits = append(edits, edit{e.OldString, e.NewString, e.ReplaceAll})
+		}
+	default:
+		return ""
+	}
+
+	name := in.FilePath
+	if rel, err := filepath.Rel(hookData.Cwd, in.FilePath); err == nil && hookData.Cwd != "" && !strings.HasPrefix(rel, "..") {
+		name = rel
+	}
+	data, err := os.ReadFile(in.FilePath)
+	before := string(data)
+	if hookData.ToolName == "Write" {
+		return unifiedDiff(name, before, in.Content)
+	}
+
+	after := before
+	for _, e := range edits {
+		if err != nil || e.old == "" || !strings.Contains(after, e.old) {
+			// Not applicable to the file as it is: show what was asked for
+			var olds, news []string
+			for _, e := range edits {
+				olds, news = append(olds, e.old), append(news, e.new)
+			}
+			return unifiedDiff(name, strings.Join(olds, "\n...\n")+"\n", strings.Join(news, "\n...\n")+"\n")
+		}
+		if e.all {
+			after = strings.ReplaceAll(after, e.old, e.new)
+		} else {
+			after = strings.Replace(after, e.old, e.new, 1)
+		}
+	}
+	return unifiedDiff(name, before, after)
+}
+
+// diffFileName returns the file a unified diff is about
+func diffFileName(diff string) string {
+	for _, l := range strings.SplitN(diff, "\n", 3) {
+		if name, ok := strings.CutPrefix(l, "+++ b/"); ok {
+			return name
+		}
+	}
+	return "changes"
+}
+
+// sendDiff sends a diff recorded by the PreToolUse hook: inline when it is
+// short, as a .diff document otherwise
+func sendDiff(config *Config, topicID int64, rec *MessageRecord) (int64, error) {
+	name := diffFileName(rec.Text)
+	added, removed := diffStat(rec.Text)
+	html := fmt.Sprintf("<pre><code class=\"language-diff\">%s</code></pre>", htmlEscape(strings.TrimSuffix(rec.Text, "\n")))
+	if len(html) <= maxInlineDiff {
+		return sendMessageHTMLGetID(config, config.GroupID, topicID, html)
+	}
+	caption := fmt.Sprintf("📝 %s (+%d −%d)", name, added, removed)
+	return 0, uploadFile(config, "sendDocument", "document", config.GroupID, topicID,
+		filepath.Base(name)+".diff", strings.NewReader(rec.Text), caption)
+}
+
+// handleDiffsCommand implements /diffs [on|off], which decides whether the
+// diffs of Claude's edits are sent to a session's topic
+func handleDiffsCommand(config *Config, sessName string, chatID int64, threadID int64, args []string) {
+	info := config.Sessions[sessName]
+	if len(args) == 0 {
+		state := "on"
+		if info != nil && info.HideDiffs {
+			state = "off"
+		}
+		sendMessage(config, chatID, threadID, fmt.Sprintf("📝 Diffs of Claude's edits are %s for '%s'. /diffs on|off", state, sessName))
+		return
+	}
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		sendMessage(config, chatID, threadID, "Usage: /diffs [on|off]")
+		return
+	}
+	hide := args[0] == "off"
+	if _, err := updateSession(sessName, func(info *SessionInfo) { info.HideDiffs = hide }); err != nil {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("❌ %v", err))
+		return
+	}
+	if hide {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("📝 Diffs off for '%s'", sessName))
+	} else {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("📝 Diffs on for '%s'", sessName))
+	}
+}
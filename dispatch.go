@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// globalWorker handles updates that don't belong to a topic: the private
+// chat, the General topic and buttons on their messages
+const globalWorker = "global"
+
+// updateDispatcher hands updates to one worker goroutine per topic, so a slow
+// handler (voice transcription, /c, a session auto-start) only holds up its
+// own topic. Updates of a topic are handled in the order they arrived.
+//
+// getUpdates is polled past every dispatched update, which makes Telegram
+// forget them; updates not handled yet are kept in the database instead
+// (pending_updates) and dispatched again when the listener restarts.
+type updateDispatcher struct {
+	config  *Config
+	mu      sync.Mutex
+	workers map[string]*updateWorker
+	next    int                   // offset past the newest dispatched update
+	handle  func(*Config, Update) // handleUpdate; replaced in tests
+}
+
+// updateWorker is a topic's queue of updates waiting to be handled. It is
+// unbounded, so a stuck topic never blocks dispatching to the others.
+type updateWorker struct {
+	queue []Update
+	wake  chan struct{}
+}
+
+func newUpdateDispatcher(config *Config, offset int) *updateDispatcher {
+	return &updateDispatcher{
+		config:  config,
+		workers: make(map[string]*updateWorker),
+		next:    offset,
+		handle:  handleUpdate,
+	}
+}
+
+// updateKey returns the worker an update is handled by
+func updateKey(update Update) string {
+	msg := &update.Message
+	if cb := update.CallbackQuery; cb != nil {
+		if cb.Message == nil {
+			return globalWorker
+		}
+		msg = cb.Message
+	}
+	if msg.MessageThreadID == 0 {
+		return globalWorker
+	}
+	return fmt.Sprintf("topic:%d:%d", msg.Chat.ID, msg.MessageThreadID)
+}
+
+// resume dispatches the updates a previous listener took on but didn't finish
+func (d *updateDispatcher) resume() {
+	for _, update := range loadPendingUpdates() {
+		d.enqueue(update)
+	}
+}
+
+// dispatch takes on a polled update. Returns false for an update dispatched
+// before.
+func (d *updateDispatcher) dispatch(update Update) bool {
+	d.mu.Lock()
+	if update.UpdateID < d.next {
+		d.mu.Unlock()
+		return false
+	}
+	d.next = update.UpdateID + 1
+	next := d.next
+	d.mu.Unlock()
+
+	d.accept(update)
+	saveUpdateOffset(next)
+	return true
+}
+
+// accept queues an update on its topic's worker without blocking. The update
+// is stored first, so it survives a crash once Telegram considers it
+// delivered. Webhook deliveries may arrive out of order and come here
+// directly; repeats are skipped by the handled-updates ledger.
+func (d *updateDispatcher) accept(update Update) {
+	savePendingUpdate(update)
+	d.enqueue(update)
+}
+
+// enqueue adds an update to its topic's queue, starting the worker if needed
+func (d *updateDispatcher) enqueue(update Update) {
+	key := updateKey(update)
+	d.mu.Lock()
+	w := d.workers[key]
+	if w == nil {
+		w = &updateWorker{wake: make(chan struct{}, 1)}
+		d.workers[key] = w
+		go d.work(w)
+	}
+	w.queue = append(w.queue, update)
+	d.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// work handles a topic's updates one at a time. An update handled before (a
+// redelivery after a restart, or a webhook retry) is skipped; one that was
+// still in progress when the listener stopped is handled again.
+func (d *updateDispatcher) work(w *updateWorker) {
+	for {
+		d.mu.Lock()
+		if len(w.queue) == 0 {
+			d.mu.Unlock()
+			<-w.wake
+			continue
+		}
+		update := w.queue[0]
+		w.queue = w.queue[1:]
+		d.mu.Unlock()
+
+		if updateHandled(update.UpdateID) {
+			listenLog("Skipping update %d: already handled", update.UpdateID)
+			removePendingUpdate(update.UpdateID)
+			continue
+		}
+		// Each update gets its own copy, so handlers can't race on a shared Config
+		config, err := loadConfig()
+		if err != nil {
+			config = d.config
+		}
+		d.handle(config, update)
+		markUpdateHandled(update.UpdateID)
+		removePendingUpdate(update.UpdateID)
+	}
+}
+
+// offset returns the getUpdates offset: past every dispatched update
+func (d *updateDispatcher) offset() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.next
+}
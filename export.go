@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export formats for ccc export and /export
+var exportFormats = []string{"md", "html", "json"}
+
+// exportTimeFormat is how timestamps appear in md and html exports
+const exportTimeFormat = "2006-01-02 15:04"
+
+// exportEntry is a turn of an exported conversation. Consecutive tool calls
+// are collapsed into one entry.
+type exportEntry struct {
+	Time  time.Time `json:"time,omitzero"`
+	Role  string    `json:"role"` // user / assistant / tools
+	Text  string    `json:"text,omitempty"`
+	Tools []string  `json:"tools,omitempty"` // "Bash: npm test", one per call
+}
+
+// exportDoc is a session's conversation, ready to render
+type exportDoc struct {
+	Session  string        `json:"session"`
+	Source   string        `json:"source"` // transcript path, or "messages" for ccc.db
+	Exported time.Time     `json:"exported"`
+	Since    time.Time     `json:"since,omitzero"`
+	Entries  []exportEntry `json:"entries"`
+}
+
+// add appends text said by role, merging it into the previous entry when
+// that one is from the same speaker
+func (d *exportDoc) add(t time.Time, role string, text string) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return
+	}
+	if n := len(d.Entries); n > 0 && d.Entries[n-1].Role == role && role == "assistant" {
+		d.Entries[n-1].Text += "\n\n" + text
+		return
+	}
+	d.Entries = append(d.Entries, exportEntry{Time: t, Role: role, Text: text})
+}
+
+// addTool appends a tool call to the current run of tool calls
+func (d *exportDoc) addTool(t time.Time, call string) {
+	if n := len(d.Entries); n > 0 && d.Entries[n-1].Role == "tools" {
+		d.Entries[n-1].Tools = append(d.Entries[n-1].Tools, call)
+		return
+	}
+	d.Entries = append(d.Entries, exportEntry{Time: t, Role: "tools", Tools: []string{call}})
+}
+
+// buildExport collects a session's conversation from its last transcript,
+// or from the messages table when the transcript is gone
+func buildExport(config *Config, sessName string, since time.Time) (*exportDoc, error) {
+	info := config.Sessions[sessName]
+	if info == nil {
+		return nil, fmt.Errorf("session '%s' not found", sessName)
+	}
+	doc := &exportDoc{Session: sessName, Exported: time.Now(), Since: since}
+	if info.TranscriptPath != "" {
+		if err := readTranscriptExport(doc, info.TranscriptPath); err == nil {
+			doc.Source = info.TranscriptPath
+		}
+	}
+	if doc.Source == "" {
+		doc.Source = "messages"
+		for _, rec := range sessionHistory(sessName, since.UnixMilli()) {
+			t := time.UnixMilli(rec.Timestamp)
+			switch rec.Type {
+			case "user_prompt":
+				doc.add(t, "user", rec.Text)
+			case "assistant_text", "tool_text":
+				doc.add(t, "assistant", rec.Text)
+			case "tool_call":
+				doc.addTool(t, rec.Text)
+			}
+		}
+	}
+	if len(doc.Entries) == 0 {
+		return nil, fmt.Errorf("nothing to export for '%s'", sessName)
+	}
+	return doc, nil
+}
+
+// readTranscriptExport adds the user prompts, replies and tool calls of a
+// Claude transcript to doc. Subagent (sidechain) and meta entries are skipped.
+func readTranscriptExport(doc *exportDoc, path string) error {
+	return readTranscript(path, func(e *TranscriptEntry) {
+		if e.IsSidechain || e.IsMeta || e.IsApiErrorMessage {
+			return
+		}
+		t := e.Time()
+		if !doc.Since.IsZero() && !t.IsZero() && t.Before(doc.Since) {
+			return
+		}
+		for _, b := range e.Blocks {
+			switch {
+			case e.Type == "user" && b.Type == "text":
+				doc.add(t.Local(), "user", b.Text)
+			case e.Type == "assistant" && b.Type == "text":
+				doc.add(t.Local(), "assistant", b.Text)
+			case e.Type == "assistant" && b.Type == "tool_use":
+				doc.addTool(t.Local(), b.ToolSummary())
+			}
+		}
+	})
+}
+
+// exportRoleLabels head each entry in md and html exports
+var exportRoleLabels = map[string]string{
+	"user":      "👤 User",
+	"assistant": "🤖 Claude",
+}
+
+// exportTime formats an entry's timestamp, or "" if it has none
+func exportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return " · " + t.Format(exportTimeFormat)
+}
+
+// exportMeta describes where and when an export comes from
+func exportMeta(doc *exportDoc) string {
+	meta := fmt.Sprintf("Exported %s from %s", doc.Exported.Format(exportTimeFormat), doc.Source)
+	if !doc.Since.IsZero() {
+		meta += ", since " + doc.Since.Format(exportTimeFormat)
+	}
+	return meta
+}
+
+// renderExport renders doc as md, html or json
+func renderExport(doc *exportDoc, format string) ([]byte, error) {
+	switch format {
+	case "md":
+		return []byte(renderExportMarkdown(doc)), nil
+	case "html":
+		return []byte(renderExportHTML(doc)), nil
+	case "json":
+		return json.MarshalIndent(doc, "", "  ")
+	}
+	return nil, fmt.Errorf("unknown format '%s' (use %s)", format, strings.Join(exportFormats, ", "))
+}
+
+// renderExportMarkdown keeps message text as written, so code blocks survive.
+// Tool calls go in <details>, which most Markdown viewers show collapsed.
+func renderExportMarkdown(doc *exportDoc) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("# %s\n\n_%s_\n", doc.Session, exportMeta(doc)))
+	for _, e := range doc.Entries {
+		if e.Role == "tools" {
+			sb.WriteString(fmt.Sprintf("\n<details><summary>🔧 %d tool call(s)%s</summary>\n\n", len(e.Tools), exportTime(e.Time)))
+			for _, call := range e.Tools {
+				sb.WriteString(fmt.Sprintf("- `` %s ``\n", strings.ReplaceAll(call, "\n", " ")))
+			}
+			sb.WriteString("\n</details>\n")
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("\n### %s%s\n\n%s\n", exportRoleLabels[e.Role], exportTime(e.Time), e.Text))
+	}
+	return sb.String()
+}
+
+// exportCSS styles the html export
+const exportCSS = `body{font-family:-apple-system,system-ui,sans-serif;max-width:860px;margin:2em auto;padding:0 1em;color:#222}
+.meta{color:#777}.entry{margin:1.2em 0}.head{font-weight:bold;margin-bottom:.3em}.head span{color:#777;font-weight:normal}
+.text{white-space:pre-wrap;line-height:1.45}.user .text{background:#f2f6fc;padding:.6em .8em;border-radius:6px}
+pre{background:#f6f8fa;padding:.8em;overflow-x:auto;white-space:pre}code{font-family:ui-monospace,monospace;font-size:.92em}
+details{color:#555;margin:.6em 0}summary{cursor:pointer}details ul{margin:.4em 0}`
+
+// renderExportHTML builds a standalone page. Message text goes through
+// markdownToHTML, the same conversion Telegram messages get.
+func renderExportHTML(doc *exportDoc) string {
+	var sb strings.Builder
+	title := html.EscapeString(doc.Session)
+	sb.WriteString(fmt.Sprintf("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>%s</title><style>%s</style></head><body>\n", title, exportCSS))
+	sb.WriteString(fmt.Sprintf("<h1>%s</h1>\n<p class=\"meta\">%s</p>\n", title, html.EscapeString(exportMeta(doc))))
+	for _, e := range doc.Entries {
+		when := html.EscapeString(exportTime(e.Time))
+		if e.Role == "tools" {
+			sb.WriteString(fmt.Sprintf("<details><summary>🔧 %d tool call(s)%s</summary><ul>\n", len(e.Tools), when))
+			for _, call := range e.Tools {
+				sb.WriteString(fmt.Sprintf("<li><code>%s</code></li>\n", html.EscapeString(call)))
+			}
+			sb.WriteString("</ul></details>\n")
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("<div class=\"entry %s\"><div class=\"head\">%s<span>%s</span></div><div class=\"text\">%s</div></div>\n",
+			e.Role, exportRoleLabels[e.Role], when, markdownToHTML(e.Text)))
+	}
+	sb.WriteString("</body></html>\n")
+	return sb.String()
+}
+
+// parseSince reads a --since value: a duration back from now ("90m", "24h",
+// "7d") or a local date or time ("2026-10-13", "2026-10-13T14:00")
+func parseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil {
+			return time.Now().AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02T15:04", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't read since '%s' (use e.g. 24h, 7d or 2026-01-31)", s)
+}
+
+// exportFileName names an export file after its session and date
+func exportFileName(sessName string, format string) string {
+	name := strings.ReplaceAll(tmuxSafeName(sessName), "/", "-")
+	return fmt.Sprintf("%s-%s.%s", name, time.Now().Format("2006-01-02"), format)
+}
+
+// handleExportCommand implements /export [session] [md|html|json] [since]:
+// the conversation is sent to the topic as a document. The session defaults
+// to the topic's.
+func handleExportCommand(config *Config, msg *TelegramMessage, args []string) {
+	chatID, threadID := msg.Chat.ID, msg.MessageThreadID
+	sessName := ""
+	if msg.Chat.Type == "supergroup" && threadID > 0 {
+		sessName = getSessionByTopic(config, threadID)
+	}
+	format, sinceArg := "md", ""
+	for _, arg := range args {
+		switch {
+		case containsString(exportFormats, arg):
+			format = arg
+		case config.Sessions[arg] != nil:
+			sessName = arg
+		default:
+			sinceArg = arg
+		}
+	}
+	if sessName == "" {
+		sendMessage(config, chatID, threadID, "Usage: /export [session] [md|html|json] [since, e.g. 24h or 2026-01-31]")
+		return
+	}
+	if !canAccessSession(config, msg.From.ID, sessName) {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("⛔ No access to session '%s'", sessName))
+		return
+	}
+	since, err := parseSince(sinceArg)
+	if err != nil {
+		sendMessage(config, chatID, threadID, "❌ "+err.Error())
+		return
+	}
+
+	doc, err := buildExport(config, sessName, since)
+	var data []byte
+	if err == nil {
+		data, err = renderExport(doc, format)
+	}
+	if err != nil {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Export failed: %v", err))
+		return
+	}
+	dir, err := os.MkdirTemp("", "ccc-export-*")
+	if err != nil {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Export failed: %v", err))
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, exportFileName(sessName, format))
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Export failed: %v", err))
+		return
+	}
+	caption := fmt.Sprintf("📄 %s: %d entries", sessName, len(doc.Entries))
+	if err := sendFile(config, chatID, threadID, path, caption); err != nil {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to send export: %v", err))
+	}
+}
+
+// exportCommand implements `ccc export <session> [--format md|html|json] [--since <when>]`,
+// writing the export to stdout
+func exportCommand(args []string) error {
+	usage := fmt.Errorf("usage: ccc export <session> [--format md|html|json] [--since 24h|7d|2026-01-31]")
+	if len(args) == 0 {
+		return usage
+	}
+	sessName, format, sinceArg := args[0], "md", ""
+	for i := 1; i < len(args); i++ {
+		if i+1 >= len(args) {
+			return usage
+		}
+		switch args[i] {
+		case "--format", "-f":
+			format = args[i+1]
+		case "--since":
+			sinceArg = args[i+1]
+		default:
+			return usage
+		}
+		i++
+	}
+	since, err := parseSince(sinceArg)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("not configured. Run: ccc setup <bot_token>")
+	}
+	doc, err := buildExport(config, sessName, since)
+	if err != nil {
+		return err
+	}
+	data, err := renderExport(doc, format)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
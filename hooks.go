@@ -1,12 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"syscall"
@@ -26,11 +24,34 @@ func thinkingFlag(sessionName string) string {
 }
 
 func setThinking(sessionName string) {
-	os.WriteFile(thinkingFlag(sessionName), []byte("1"), 0600)
+	setState(stateThinking, sessionName, true)
 }
 
 func clearThinking(sessionName string) {
-	os.Remove(thinkingFlag(sessionName))
+	setState(stateThinking, sessionName, false)
+}
+
+// isThinking reports whether the thinking flag is set and not stale
+// (the typing indicator loop expires flags after 10 minutes)
+func isThinking(sessionName string) bool {
+	since, ok := stateSince(stateThinking, sessionName)
+	return ok && time.Since(since) <= 10*time.Minute
+}
+
+// setTelegramActive marks a tmux window as processing a Telegram message
+func setTelegramActive(tmuxName string) {
+	setState(stateTelegramActive, tmuxName, true)
+}
+
+func clearTelegramActive(tmuxName string) {
+	setState(stateTelegramActive, tmuxName, false)
+}
+
+// isTelegramActive reports whether a Telegram message was sent to the window
+// within maxAge (the flag expires in case the Stop hook didn't fire)
+func isTelegramActive(tmuxName string, maxAge time.Duration) bool {
+	since, ok := stateSince(stateTelegramActive, tmuxName)
+	return ok && time.Since(since) <= maxAge
 }
 
 // promptAckPath returns the path of the ack file that confirms
@@ -40,19 +61,27 @@ func promptAckPath(sessionName string) string {
 }
 
 func writePromptAck(sessionName string) {
-	os.WriteFile(promptAckPath(sessionName), []byte("1"), 0600)
+	setState(statePromptAck, sessionName, true)
 }
 
 func clearPromptAck(sessionName string) {
-	os.Remove(promptAckPath(sessionName))
+	setState(statePromptAck, sessionName, false)
 }
 
-// waitPromptAck polls for the ack file, returning true if it appears within timeout
+// waitPromptAck waits for the prompt hook's ack, returning true if it arrives
+// within timeout. The listener is woken by the socket; elsewhere it polls.
 func waitPromptAck(sessionName string, timeout time.Duration) bool {
+	if ipcState != nil {
+		if ipcState.waitFlag(statePromptAck, sessionName, timeout) {
+			clearPromptAck(sessionName)
+			return true
+		}
+		return false
+	}
 	deadline := time.Now().Add(timeout)
 	for time.Now().Before(deadline) {
-		if _, err := os.Stat(promptAckPath(sessionName)); err == nil {
-			os.Remove(promptAckPath(sessionName))
+		if _, ok := stateSince(statePromptAck, sessionName); ok {
+			clearPromptAck(sessionName)
 			return true
 		}
 		time.Sleep(100 * time.Millisecond)
@@ -76,13 +105,28 @@ func formatToolLines(state *ToolState) string {
 	for _, t := range state.Tools {
 		if t.IsText {
 			lines = append(lines, fmt.Sprintf("💬 %s", htmlEscape(t.Input)))
-		} else if t.Name == "" {
-			lines = append(lines, fmt.Sprintf("⚙️ %s", htmlEscape(t.Input)))
+			continue
+		}
+		icon := "⚙️"
+		switch t.Status {
+		case "ok":
+			icon = "✅"
+		case "error":
+			icon = "❌"
+		}
+		line := icon + " " + htmlEscape(t.Name)
+		if t.Name == "" {
+			line = icon + " " + htmlEscape(t.Input)
 		} else if t.Input != "" {
-			lines = append(lines, fmt.Sprintf("⚙️ %s: %s", htmlEscape(t.Name), htmlEscape(t.Input)))
-		} else {
-			lines = append(lines, fmt.Sprintf("⚙️ %s", htmlEscape(t.Name)))
+			line += ": " + htmlEscape(t.Input)
 		}
+		if t.Status != "" && t.Duration > 0 {
+			line += " · " + formatToolDuration(t.Duration)
+		}
+		if t.Status == "error" && t.Excerpt != "" {
+			line += "\n   ↳ " + htmlEscape(t.Excerpt)
+		}
+		lines = append(lines, line)
 	}
 	return strings.Join(lines, "\n")
 }
@@ -97,10 +141,7 @@ func formatToolMessage(state *ToolState) string {
 func toolInputSummary(hookData HookData) string {
 	truncAt := 80
 	trunc := func(s string) string {
-		if len(s) > truncAt {
-			return s[:truncAt] + "..."
-		}
-		return s
+		return truncateRunes(s, truncAt)
 	}
 
 	switch hookData.ToolName {
@@ -111,10 +152,7 @@ func toolInputSummary(hookData HookData) string {
 	case "Edit":
 		s := hookData.ToolInput.FilePath
 		if hookData.ToolInput.OldString != "" {
-			preview := hookData.ToolInput.OldString
-			if len(preview) > 40 {
-				preview = preview[:40] + "..."
-			}
+			preview := truncateRunes(hookData.ToolInput.OldString, 40)
 			s += " `" + strings.ReplaceAll(preview, "\n", "↵") + "`"
 		}
 		return s
@@ -196,8 +234,10 @@ func findSession(config *Config, cwd string, claudeSessionID string) (string, in
 	return findSessionByCwd(config, cwd)
 }
 
-// persistClaudeSessionID saves the claude session ID to config if changed
-func persistClaudeSessionID(config *Config, sessName string, claudeSessionID string) {
+// persistClaudeSession saves the claude session ID and transcript path to
+// the session registry if changed
+func persistClaudeSession(config *Config, sessName string, hookData HookData) {
+	claudeSessionID, transcriptPath := hookData.SessionID, hookData.TranscriptPath
 	if claudeSessionID == "" || sessName == "" {
 		return
 	}
@@ -205,10 +245,15 @@ func persistClaudeSessionID(config *Config, sessName string, claudeSessionID str
 	if !exists || info == nil {
 		return
 	}
-	if info.ClaudeSessionID != claudeSessionID {
-		info.ClaudeSessionID = claudeSessionID
-		saveConfig(config)
-		hookLog("persisted claude_session_id=%s for session=%s", claudeSessionID, sessName)
+	if transcriptPath == "" {
+		transcriptPath = info.TranscriptPath
+	}
+	if info.ClaudeSessionID != claudeSessionID || info.TranscriptPath != transcriptPath {
+		info.ClaudeSessionID, info.TranscriptPath = claudeSessionID, transcriptPath
+		updateSession(sessName, func(i *SessionInfo) {
+			i.ClaudeSessionID, i.TranscriptPath = claudeSessionID, transcriptPath
+		})
+		hookLog("persisted claude_session_id=%s transcript=%s for session=%s", claudeSessionID, transcriptPath, sessName)
 	}
 }
 
@@ -236,201 +281,128 @@ func handleStopHook() error {
 	}
 
 	// Persist claude session ID to config for future lookups
-	persistClaudeSessionID(config, sessName, hookData.SessionID)
+	persistClaudeSession(config, sessName, hookData)
 
 	hookLog("stop-hook: session=%s claude_session_id=%s transcript=%s", sessName, hookData.SessionID, hookData.TranscriptPath)
 
 	// Clear flags when Claude stops
-	tmuxName := tmuxSafeName(sessName)
-	os.Remove(telegramActiveFlag(tmuxName))
+	clearTelegramActive(tmuxSafeName(sessName))
 	clearThinking(sessName)
 
-	// Deliver unsent texts as separate messages (these come after all tools)
+	// Deliver unsent texts as separate messages (these come after all tools;
+	// the listener closes the turn's tool blockquote before sending them)
 	hookLog("stop-hook: delivering unsent texts")
 	sent := deliverUnsentTexts(config, sessName, topicID, hookData.TranscriptPath, false)
 	hookLog("stop-hook: sent=%d", sent)
-	// Clear tool state when turn ends
-	clearToolState(sessName)
-	if sent > 0 {
-		notifyListener()
+	if sent > 0 || hasQueuedPrompts(sessName) {
+		notifyListener() // also sends the next queued prompt
 	}
 
-	// Background retry: transcript may not be flushed yet when stop hook fires.
-	// Spawn a detached subprocess that retries 3 times at 2-second intervals.
-	// (goroutines die when the hook process exits, so we need a separate process)
-	cmd := exec.Command(cccPath, "hook-stop-retry", sessName, fmt.Sprintf("%d", topicID), hookData.TranscriptPath)
-	cmd.Start()
+	// The transcript may not be flushed yet when the Stop hook fires; the
+	// listener picks up the rest (watchTranscripts)
 
 	return nil
 }
 
-// deliverUnsentTexts scans transcript tail and sends any assistant text
-// blocks not yet delivered to Telegram (using ledger dedup).
-// If insertIntoToolMsg is true and tool state has a message, texts are inserted
-// into the tool blockquote (for text before/between tools in PreToolUse).
-// If false, texts are sent as separate messages (for text after tools in Stop hook).
+// deliverUnsentTexts reads the assistant text blocks written to the
+// transcript since it was last read (by a hook or the listener) and records
+// them for deliveryLoop to send. Blocks are recorded by the entry they came
+// from and their position in it: the same entry seen again with other text
+// is a revision, which deliveryLoop edits into the message already sent.
+// If duringTools is true they are recorded as tool_text, which the listener
+// inserts into the tool blockquote (for text before/between tools in PreToolUse).
+// If false, they are sent as separate messages (for text after tools in Stop hook).
 func deliverUnsentTexts(config *Config, sessName string, topicID int64, transcriptPath string, duringTools bool) int {
-	blocks := extractRecentAssistantTexts(transcriptPath, 80)
+	if transcriptPath == "" {
+		return 0
+	}
+	entries, err := readNewTranscript(transcriptPath)
+	if err != nil {
+		hookLog("deliver-unsent: %v", err)
+		return 0
+	}
+	// Tool calls that failed since the last read come first, they precede the text
+	sent := recordTranscriptResults(sessName, entries)
+	blocks := assistantTexts(entries)
 	lastPreview := ""
 	if len(blocks) > 0 {
 		lastPreview = truncate(blocks[len(blocks)-1].text, 60)
 	}
 	hookLog("deliver-unsent: found %d blocks, last=%s", len(blocks), lastPreview)
 
-	sent := 0
+	msgType := "assistant_text"
+	if duringTools {
+		msgType = "tool_text"
+	}
 	for _, block := range blocks {
-		blockID := fmt.Sprintf("reply:%s:%s", block.requestID, contentHash(block.text))
-		if isDelivered(blockID) {
+		blockID := fmt.Sprintf("reply:%s:%d", block.entryKey, block.index)
+		if hasMessage(blockID) {
+			// The entry may have been rewritten with other text
+			if reviseMessage(blockID, block.text) {
+				hookLog("revise-text: entry=%s block=%d len=%d preview=%s", block.entryKey, block.index, len(block.text), truncate(block.text, 80))
+				sent++
+			}
 			continue
 		}
-		hookLog("deliver-text: rid=%s len=%d duringTools=%v preview=%s", block.requestID, len(block.text), duringTools, truncate(block.text, 80))
-
-		if duringTools {
-			// Text during tool calls — insert into blockquote with 💬 icon
-			unlock := lockToolState(sessName)
-			state := loadToolState(sessName)
-			if state.MsgID != 0 {
-				state.Tools = append(state.Tools, ToolCall{IsText: true, Input: block.text, Time: time.Now().UnixMilli()})
-				saveToolState(sessName, state)
-				unlock()
-				text := formatToolMessage(state)
-				editMessageHTML(config, config.GroupID, state.MsgID, topicID, text)
-				appendMessage(&MessageRecord{
-					ID: blockID, Session: sessName, Type: "assistant_text",
-					Text: block.text, Origin: "claude",
-					TgDelivered: true, TgMsgID: state.MsgID,
-				})
-			} else {
-				unlock()
-				// No active blockquote — send directly to maintain ordering
-				html := fmt.Sprintf("<b>%s:</b>\n%s", sessName, markdownToHTML(block.text))
-				tgMsgID, err := sendMessageHTMLGetID(config, config.GroupID, topicID, html)
-				if err != nil {
-					hookLog("deliver-text: direct send failed: %v", err)
-				}
-				appendMessage(&MessageRecord{
-					ID: blockID, Session: sessName, Type: "assistant_text",
-					Text: block.text, Origin: "claude",
-					TgDelivered: err == nil, TgMsgID: tgMsgID,
-				})
-			}
-		} else {
-			// After tools (Stop hook) — clear tool state, then queue text
-			clearToolState(sessName)
-			appendMessage(&MessageRecord{
-				ID: blockID, Session: sessName, Type: "assistant_text",
-				Text: block.text, Origin: "claude",
-			})
+		// Recorded before blocks were tracked by index
+		if hasMessage(fmt.Sprintf("reply:%s:%s", block.requestID, contentHash(block.text))) {
+			continue
 		}
+		hookLog("deliver-text: rid=%s len=%d duringTools=%v preview=%s", block.requestID, len(block.text), duringTools, truncate(block.text, 80))
+		appendMessage(&MessageRecord{
+			ID: blockID, Session: sessName, Type: msgType,
+			Text: block.text, Origin: "claude",
+		})
 		sent++
 	}
 	return sent
 }
 
-// assistantTextBlock pairs extracted text with its requestId for dedup
+// assistantTextBlock pairs extracted text with its requestId, the entry it
+// came from and its position among the entry's text blocks; entry and
+// position identify it across revisions
 type assistantTextBlock struct {
 	requestID string
+	entryKey  string
+	index     int
 	text      string
 }
 
-// extractRecentAssistantTexts reads the last N assistant entries from the
-// transcript and returns their text blocks. The caller uses ledger dedup
-// to avoid resending previously delivered messages.
-func extractRecentAssistantTexts(transcriptPath string, tailCount int) []assistantTextBlock {
-	if transcriptPath == "" {
-		return nil
-	}
-
-	f, err := os.Open(transcriptPath)
-	if err != nil {
-		return nil
-	}
-	defer f.Close()
-
-	type transcriptLine struct {
-		Type             string `json:"type"`
-		RequestID        string `json:"requestId,omitempty"`
-		IsApiErrorMessage bool  `json:"isApiErrorMessage,omitempty"`
-		Message          struct {
-			Role    string          `json:"role"`
-			Content json.RawMessage `json:"content"`
-		} `json:"message"`
-	}
-
-	type contentBlock struct {
-		Type string `json:"type"`
-		Text string `json:"text"`
-	}
-
-	// Read only the tail of the file (last 512KB) to avoid scanning the entire transcript
-	const tailBytes = 512 * 1024
-	fi, err := f.Stat()
-	if err != nil {
-		return nil
-	}
-	offset := int64(0)
-	if fi.Size() > tailBytes {
-		offset = fi.Size() - tailBytes
-		f.Seek(offset, 0)
-	}
-	tailData, err := io.ReadAll(f)
-	if err != nil {
-		return nil
-	}
-	// If we seeked into the middle of a line, skip the first partial line
-	if offset > 0 {
-		if idx := bytes.IndexByte(tailData, '\n'); idx >= 0 {
-			tailData = tailData[idx+1:]
-		}
-	}
-
-	type entry struct {
-		requestID string
-		content   json.RawMessage
-	}
-
-	var entries []entry
-	for _, line := range bytes.Split(tailData, []byte("\n")) {
-		if len(line) == 0 {
-			continue
-		}
-		var tl transcriptLine
-		if json.Unmarshal(line, &tl) != nil {
-			continue
-		}
-		if tl.Type != "assistant" || tl.Message.Role != "assistant" {
-			continue
-		}
-		if tl.IsApiErrorMessage || tl.RequestID == "" {
-			continue
-		}
-		entries = append(entries, entry{
-			requestID: tl.RequestID,
-			content:   tl.Message.Content,
-		})
+// replyEntryKey identifies a transcript entry: its uuid. Claude Code writes
+// each content block of a response as its own line with the same requestId,
+// so lines of one request are separate entries. Transcripts without uuids
+// rewrite the whole request instead, so there the requestId identifies it.
+func replyEntryKey(e *TranscriptEntry) string {
+	if e.UUID != "" {
+		return e.UUID
 	}
+	return e.RequestID
+}
 
-	// Take only the tail
-	if len(entries) > tailCount {
-		entries = entries[len(entries)-tailCount:]
-	}
+// isReplyEntry reports whether a transcript entry is part of Claude's reply
+// (not an API error)
+func isReplyEntry(e *TranscriptEntry) bool {
+	return e.Type == "assistant" && e.Role() == "assistant" && !e.IsApiErrorMessage && e.RequestID != ""
+}
 
-	// For each requestId, keep only the last entry's text (later entries
-	// supersede earlier ones for the same request, e.g. streaming updates)
-	type ridText struct {
+// assistantTexts returns the text blocks of the reply entries among entries
+func assistantTexts(entries []*TranscriptEntry) []assistantTextBlock {
+	// For each entry, keep only its last version's text (an entry written
+	// again supersedes the earlier one, e.g. streaming updates)
+	type entryText struct {
 		requestID string
+		key       string
 		texts     []string
 	}
-	seen := make(map[string]int) // requestID -> index in result
-	var ordered []ridText
+	seen := make(map[string]int) // entry key -> index in ordered
+	var ordered []entryText
 
 	for _, e := range entries {
-		var blocks []contentBlock
-		if json.Unmarshal(e.content, &blocks) != nil {
+		if !isReplyEntry(e) {
 			continue
 		}
 		var texts []string
-		for _, b := range blocks {
+		for _, b := range e.Blocks {
 			if b.Type != "text" {
 				continue
 			}
@@ -442,43 +414,24 @@ func extractRecentAssistantTexts(transcriptPath string, tailCount int) []assista
 		if len(texts) == 0 {
 			continue
 		}
-		if idx, ok := seen[e.requestID]; ok {
-			ordered[idx].texts = texts // overwrite with later entry
+		key := replyEntryKey(e)
+		if idx, ok := seen[key]; ok {
+			ordered[idx].texts = texts // overwrite with later version
 		} else {
-			seen[e.requestID] = len(ordered)
-			ordered = append(ordered, ridText{requestID: e.requestID, texts: texts})
+			seen[key] = len(ordered)
+			ordered = append(ordered, entryText{requestID: e.RequestID, key: key, texts: texts})
 		}
 	}
 
 	var result []assistantTextBlock
-	for _, rt := range ordered {
-		for _, t := range rt.texts {
-			result = append(result, assistantTextBlock{requestID: rt.requestID, text: t})
+	for _, et := range ordered {
+		for i, t := range et.texts {
+			result = append(result, assistantTextBlock{requestID: et.requestID, entryKey: et.key, index: i, text: t})
 		}
 	}
 	return result
 }
 
-
-// handleStopRetry is a background process spawned by stop hook.
-// It retries transcript reading 3 times at 2-second intervals to catch
-// messages that weren't flushed when the stop hook first fired.
-func handleStopRetry(sessName string, topicID int64, transcriptPath string) error {
-	config, err := loadConfig()
-	if err != nil || config == nil {
-		return nil
-	}
-	for i := 0; i < 3; i++ {
-		time.Sleep(2 * time.Second)
-		n := deliverUnsentTexts(config, sessName, topicID, transcriptPath, false)
-		hookLog("stop-retry: %d/3 sent=%d session=%s", i+1, n, sessName)
-		if n > 0 {
-			notifyListener()
-		}
-	}
-	return nil
-}
-
 func handlePermissionHook() error {
 	defer func() { recover() }()
 
@@ -503,58 +456,58 @@ func handlePermissionHook() error {
 	}
 
 	// Persist claude session ID to config for future lookups
-	persistClaudeSessionID(config, sessName, hookData.SessionID)
+	persistClaudeSession(config, sessName, hookData)
 
 	hookLog("pre-tool: session=%s tool=%s", sessName, hookData.ToolName)
 
-	// Deliver any unsent assistant text before showing tool calls
+	// Record any unsent assistant text before the tool call; the listener
+	// shows both in the turn's tool blockquote
+	queued := 0
 	if topicID != 0 && hookData.TranscriptPath != "" {
-		deliverUnsentTexts(config, sessName, topicID, hookData.TranscriptPath, true)
+		queued = deliverUnsentTexts(config, sessName, topicID, hookData.TranscriptPath, true)
 	}
-
-	// Update tool call display (file-locked to prevent parallel hooks from
-	// creating multiple blockquotes when they all see MsgID=0)
 	if hookData.ToolName != "" && hookData.ToolName != "AskUserQuestion" && topicID != 0 {
-		unlock := lockToolState(sessName)
-		state := loadToolState(sessName)
-		state.Tools = append(state.Tools, ToolCall{
-			Name: hookData.ToolName,
-			Input: toolInputSummary(hookData),
-			Time: time.Now().UnixMilli(),
-		})
-		text := formatToolMessage(state)
-		if state.MsgID == 0 {
-			msgID, err := sendMessageHTMLGetID(config, config.GroupID, topicID, text)
-			if err == nil && msgID > 0 {
-				state.MsgID = msgID
-			}
-		} else {
-			editMessageHTML(config, config.GroupID, state.MsgID, topicID, text)
-		}
-		saveToolState(sessName, state)
-		unlock()
-
-		// Record tool call in DB (tool display is handled via tool_state, not delivery queue)
+		callID := toolCallID(hookData)
 		appendMessage(&MessageRecord{
-			ID:      fmt.Sprintf("tool:%s:%s:%d", hookData.SessionID, contentHash(hookData.ToolName+toolInputSummary(hookData)), time.Now().UnixNano()),
+			ID:      callID,
 			Session: sessName,
 			Type:    "tool_call",
 			Text:    hookData.ToolName + ": " + toolInputSummary(hookData),
 			Origin:  "claude",
-			TgDelivered: state.MsgID != 0,
-			TgMsgID:     state.MsgID,
 		})
+		queued++
+		if info := config.Sessions[sessName]; info != nil && !info.HideDiffs {
+			if diff := toolDiff(hookData); diff != "" {
+				appendMessage(&MessageRecord{
+					ID:      "diff:" + strings.TrimPrefix(callID, "tool:"),
+					Session: sessName,
+					Type:    "diff",
+					Text:    diff,
+					Origin:  "claude",
+				})
+				queued++
+			}
+		}
+		if hookData.ToolName == "TodoWrite" {
+			todos, _ := json.Marshal(hookData.ToolInput.Todos)
+			appendMessage(&MessageRecord{
+				ID:      "todos:" + strings.TrimPrefix(callID, "tool:"),
+				Session: sessName,
+				Type:    "todos",
+				Text:    string(todos),
+				Origin:  "claude",
+			})
+			queued++
+		}
 	}
 
-	// Handle AskUserQuestion - forward to Telegram with buttons
+	// Handle AskUserQuestion - the listener forwards it to Telegram with buttons
 	if hookData.ToolName == "AskUserQuestion" && len(hookData.ToolInput.Questions) > 0 {
 		for qIdx, q := range hookData.ToolInput.Questions {
 			if q.Question == "" {
 				continue
 			}
-			msg := fmt.Sprintf("❓ %s\n\n%s", q.Header, q.Question)
-
-			var buttons [][]InlineKeyboardButton
+			question := questionPrompt{Text: fmt.Sprintf("❓ %s\n\n%s", q.Header, q.Question)}
 			for i, opt := range q.Options {
 				if opt.Label == "" {
 					continue
@@ -564,38 +517,28 @@ func handlePermissionHook() error {
 				if len(callbackData) > 64 {
 					callbackData = callbackData[:64]
 				}
-				buttons = append(buttons, []InlineKeyboardButton{
+				question.Buttons = append(question.Buttons, []InlineKeyboardButton{
 					{Text: opt.Label, CallbackData: callbackData},
 				})
 			}
 
-			if len(buttons) > 0 {
-				sendMessageWithKeyboard(config, config.GroupID, topicID, msg, buttons)
+			if len(question.Buttons) > 0 {
+				data, _ := json.Marshal(question)
+				appendMessage(&MessageRecord{
+					ID:      fmt.Sprintf("question:%s:%d:%d", hookData.SessionID, qIdx, time.Now().UnixNano()),
+					Session: sessName,
+					Type:    "question",
+					Text:    string(data),
+					Origin:  "claude",
+				})
+				queued++
 			}
 		}
+		notifyListener()
 		return nil
 	}
-
-	// OTP permission check for all other tools
-	if !isOTPEnabled(config) {
-		// No OTP configured, auto-allow everything
-		outputPermissionDecision("allow", "OTP not configured")
-		return nil
-	}
-
-	// OTP only applies when input came from Telegram (flag file exists and is recent).
-	// The listener sets this flag before forwarding Telegram messages to tmux.
-	// Flag auto-expires after 5 minutes to handle cases where stop hook didn't fire.
-	tmuxName := tmuxSafeName(sessName)
-	flagInfo, err := os.Stat(telegramActiveFlag(tmuxName))
-	if err != nil || time.Since(flagInfo.ModTime()) > otpGrantDuration {
-		return nil // no flag or expired, let Claude handle permissions normally
-	}
-
-	// Check for a valid OTP grant (approved within the last 5 minutes)
-	if hasValidOTPGrant(tmuxName) {
-		outputPermissionDecision("allow", "OTP grant still valid")
-		return nil
+	if queued > 0 {
+		notifyListener()
 	}
 
 	// Build a human-readable description of what Claude wants to do
@@ -622,50 +565,44 @@ func handlePermissionHook() error {
 		inputStr = inputStr[:500] + "..."
 	}
 
-	// Use session_id from hook data as unique identifier
-	sessionID := hookData.SessionID
-	if sessionID == "" {
-		sessionID = sessName
+	// Policy rules decide first; unmatched calls fall through to the permission mode
+	if applyPolicy(config, hookData, sessName, topicID, toolDesc, inputStr) {
+		return nil
 	}
 
-	// Only the first parallel hook sends the Telegram message.
-	// If a request file already exists (from another parallel hook), just wait.
-	alreadyRequested := false
-	if info, err := os.Stat(otpRequestPrefix + sessionID); err == nil {
-		alreadyRequested = time.Since(info.ModTime()) < 30*time.Second
+	// Remote approval for all other tools
+	if permissionMode(config) == permModeAuto {
+		outputPermissionDecision("allow", "Remote approval not enabled")
+		return nil
 	}
 
-	req := &OTPPermissionRequest{
-		SessionName: sessName,
-		ToolName:    hookData.ToolName,
-		ToolInput:   inputStr,
-		Timestamp:   time.Now().Unix(),
+	// Approval only applies when input came from Telegram (flag file exists and is recent).
+	// The listener sets this flag before forwarding Telegram messages to tmux.
+	// Flag auto-expires after 5 minutes to handle cases where stop hook didn't fire.
+	tmuxName := tmuxSafeName(sessName)
+	if !isTelegramActive(tmuxName, otpGrantDuration) {
+		return nil // no flag or expired, let Claude handle permissions normally
 	}
-	writeOTPRequest(sessionID, req)
 
-	if !alreadyRequested {
-		msg := fmt.Sprintf("🔐 Permission request:\n\n🔧 %s\n📋 %s\n\nSend your OTP code to approve:", toolDesc, inputStr)
-		sendMessage(config, config.GroupID, topicID, msg)
+	// Check for a valid grant ("Approve for 5 min" pressed recently)
+	if hasValidOTPGrant(tmuxName) {
+		outputPermissionDecision("allow", "Approval grant still valid")
+		return nil
 	}
 
-	hookLog("otp-request: waiting for OTP response for session=%s tool=%s already=%v", sessName, hookData.ToolName, alreadyRequested)
-
-	// Wait for OTP response from listener
-	approved, err := waitForOTPResponse(sessionID, tmuxName, otpPermissionTimeout)
+	resp, err := requestRemotePermission(config, sessName, topicID, hookData.ToolName, toolDesc, inputStr)
 	if err != nil {
-		hookLog("otp-request: timeout or error: %v", err)
-		sendMessage(config, config.GroupID, topicID, "⏰ OTP timeout - permission denied")
-		outputPermissionDecision("deny", "OTP approval timed out")
+		hookLog("permission: timeout or error: %v", err)
+		outputPermissionDecision("deny", "Approval timed out")
 		return nil
 	}
 
-	if approved {
-		hookLog("otp-request: approved for session=%s tool=%s", sessName, hookData.ToolName)
-		writeOTPGrant(tmuxName)
-		outputPermissionDecision("allow", "Approved via OTP")
+	if resp.Approved {
+		hookLog("permission: approved for session=%s tool=%s via=%s by=%s", sessName, hookData.ToolName, resp.Via, resp.By)
+		outputPermissionDecision("allow", "Approved via Telegram ("+resp.Via+")")
 	} else {
-		hookLog("otp-request: denied for session=%s tool=%s", sessName, hookData.ToolName)
-		outputPermissionDecision("deny", "Denied via OTP")
+		hookLog("permission: denied for session=%s tool=%s by=%s", sessName, hookData.ToolName, resp.By)
+		outputPermissionDecision("deny", "Denied via Telegram")
 	}
 
 	return nil
@@ -707,19 +644,26 @@ func handleUserPromptHook() error {
 		return nil
 	}
 
-	persistClaudeSessionID(config, sessName, hookData.SessionID)
+	persistClaudeSession(config, sessName, hookData)
 
 	hookLog("user-prompt: session=%s prompt=%q", sessName, truncate(hookData.Prompt, 100))
 
-	// Clear tool state from previous turn
-	clearToolState(sessName)
+	// A new prompt gets a new plan; the listener unpins the old one
+	if loadPlanMessage(sessName) != 0 {
+		enqueueMessage(&MessageRecord{
+			ID:      fmt.Sprintf("plan_reset:%s:%d", hookData.SessionID, time.Now().UnixNano()),
+			Session: sessName,
+			Type:    "plan_reset",
+			Origin:  "claude",
+		})
+	}
 
 	// Check if this prompt came from Telegram by matching content in DB.
 	// If found, skip sending to Telegram (already visible there).
 	tmuxName := tmuxSafeName(sessName)
 	if isFromTelegram(sessName, hookData.Prompt) {
 		hookLog("user-prompt: matched telegram origin, skipping echo")
-		os.Remove(telegramActiveFlag(tmuxName))
+		clearTelegramActive(tmuxName)
 		writePromptAck(sessName)
 		setThinking(sessName)
 		logEvent(sessName, "prompt_confirmed", "hook-user-prompt", "", hookData.Prompt)
@@ -727,12 +671,12 @@ func handleUserPromptHook() error {
 	}
 	// Not from Telegram — clean up stale flag if any
 	hookLog("user-prompt: NOT from telegram, will echo to telegram")
-	os.Remove(telegramActiveFlag(tmuxName))
+	clearTelegramActive(tmuxName)
 
 	setThinking(sessName)
 
 	// Record: came from terminal — deliveryLoop will send to Telegram
-	appendMessage(&MessageRecord{
+	enqueueMessage(&MessageRecord{
 		ID:      fmt.Sprintf("prompt:%s:%d", hookData.SessionID, time.Now().UnixNano()),
 		Session: sessName,
 		Type:    "user_prompt",
@@ -740,12 +684,47 @@ func handleUserPromptHook() error {
 		Origin:  "terminal",
 	})
 	logEvent(sessName, "prompt_terminal", "hook-user-prompt", "", hookData.Prompt)
-	notifyListener()
 	return nil
 }
 
+// handlePostToolHook records how a tool call went, for the blockquote's
+// ✅/❌ and the "show output" button. Failed calls don't get this hook; their
+// results are read from the transcript (recordTranscriptResults).
 func handlePostToolHook() error {
-	// No-op: tool completion is implied by the next tool starting
+	defer func() { recover() }()
+
+	rawData, _ := readHookStdin()
+	if len(rawData) == 0 {
+		return nil
+	}
+
+	hookData, err := parseHookData(rawData)
+	if err != nil || hookData.ToolName == "" || hookData.ToolName == "AskUserQuestion" {
+		return nil
+	}
+
+	config, err := loadConfig()
+	if err != nil || config == nil {
+		return nil
+	}
+
+	sessName, topicID := findSession(config, hookData.Cwd, hookData.SessionID)
+	if sessName == "" || config.GroupID == 0 || topicID == 0 {
+		return nil
+	}
+
+	output, failed := toolResponseOutput(hookData.ToolResponse)
+	res := &toolResult{
+		Name: hookData.ToolName, Input: toolInputSummary(hookData),
+		Failed: failed, Output: output, ToolID: hookData.ToolUseID,
+		Finished: time.Now().UnixMilli(),
+	}
+	if hookData.ToolUseID != "" {
+		res.Call = toolCallID(hookData)
+	}
+	hookLog("post-tool: session=%s tool=%s failed=%v len=%d", sessName, hookData.ToolName, failed, len(output))
+	recordToolResult(sessName, res)
+	notifyListener()
 	return nil
 }
 
@@ -772,7 +751,7 @@ func handleCompactHook() error {
 		return nil
 	}
 
-	persistClaudeSessionID(config, sessName, hookData.SessionID)
+	persistClaudeSession(config, sessName, hookData)
 
 	// Determine if this is pre-compact or post-compact
 	// PreCompact hook: hook_event_name = "PreCompact"
@@ -789,7 +768,7 @@ func handleCompactHook() error {
 		msg = "☕️ Context compacted"
 	}
 
-	appendMessage(&MessageRecord{
+	enqueueMessage(&MessageRecord{
 		ID:      fmt.Sprintf("compact:%s:%d", hookData.SessionID, time.Now().UnixNano()),
 		Session: sessName,
 		Type:    "notification",
@@ -797,7 +776,6 @@ func handleCompactHook() error {
 		Origin:  "claude",
 	})
 	logEvent(sessName, "compact", "hook-compact", "", msg)
-	notifyListener()
 	return nil
 }
 
@@ -824,14 +802,22 @@ func handleNotificationHook() error {
 		return nil
 	}
 
-	persistClaudeSessionID(config, sessName, hookData.SessionID)
+	persistClaudeSession(config, sessName, hookData)
 
 	// idle_prompt means Claude is waiting for user input — clear typing indicator
 	if hookData.NotificationType == "idle_prompt" {
 		clearThinking(sessName)
+		if hasQueuedPrompts(sessName) {
+			notifyListener() // listener sends the next queued prompt
+		}
 		return nil
 	}
 
+	// The listener posts the dialog itself with buttons to answer it
+	if hookData.NotificationType == "permission_prompt" {
+		notifyListener()
+	}
+
 	// Build notification message
 	var msg string
 	if hookData.Message != "" {
@@ -843,15 +829,14 @@ func handleNotificationHook() error {
 	}
 
 	if msg != "" {
-		// Write to DB only — deliveryLoop will send to Telegram
-		appendMessage(&MessageRecord{
+		// Queue for the listener only — deliveryLoop will send to Telegram
+		enqueueMessage(&MessageRecord{
 			ID:      fmt.Sprintf("notif:%s:%d", hookData.SessionID, time.Now().UnixNano()),
 			Session: sessName,
 			Type:    "notification",
 			Text:    msg,
 			Origin:  "claude",
 		})
-		notifyListener()
 	}
 
 	return nil
@@ -1139,6 +1124,19 @@ func truncate(s string, n int) string {
 	return s[:n] + "..."
 }
 
+// truncateRunes shortens s to n characters without splitting a multibyte
+// one, for text sent to Telegram, which rejects invalid UTF-8
+func truncateRunes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "..."
+}
+
 // hookLog writes debug log entries
 func hookLog(format string, args ...interface{}) {
 	f, err := os.OpenFile(filepath.Join(cacheDir(), "hook-debug.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -1149,9 +1147,12 @@ func hookLog(format string, args ...interface{}) {
 	fmt.Fprintf(f, "[%s] %s\n", time.Now().Format("15:04:05"), fmt.Sprintf(format, args...))
 }
 
-// notifyListener sends SIGUSR1 to the listener process to trigger immediate delivery.
-// Reads the listener PID from the lock file. No-op if listener is not running.
+// notifyListener wakes the listener to deliver immediately: over the socket,
+// or with SIGUSR1 to the PID in the lock file. No-op if listener is not running.
 func notifyListener() {
+	if err := ipcCall("notify", nil, nil, ipcCallTimeout); err == nil {
+		return
+	}
 	lockPath := filepath.Join(cacheDir(), "ccc.lock")
 	data, err := os.ReadFile(lockPath)
 	if err != nil {
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ipcSocketPath is the Unix socket the listener serves hook requests on.
+// Hooks fall back to the DB and flag files when nothing is listening. It
+// lives in a directory only the user can enter, so other local users can't
+// connect to it (and approve permissions) in the moment before it is chmodded.
+var ipcSocketPath = filepath.Join(cacheDir(), "ipc", "ccc.sock")
+
+// ipcCallTimeout bounds a single non-blocking IPC call
+const ipcCallTimeout = 3 * time.Second
+
+// ipcErrTimeout is returned by wait_decision when nobody decided in time
+const ipcErrTimeout = "timeout"
+
+// ipcRequest is one call on the socket: a JSON line per connection
+type ipcRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// ipcResponse answers an ipcRequest
+type ipcResponse struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// ipcError is an error reported by the listener, as opposed to a
+// connection problem that makes the caller fall back to files
+type ipcError struct {
+	Msg string
+}
+
+func (e *ipcError) Error() string { return e.Msg }
+
+// ipcStateParams sets or reads a session flag (see setState)
+type ipcStateParams struct {
+	State string `json:"state"`
+	Name  string `json:"name"`
+	On    bool   `json:"on,omitempty"`
+}
+
+// ipcStateResult is the answer to get_state
+type ipcStateResult struct {
+	On    bool      `json:"on"`
+	Since time.Time `json:"since"`
+}
+
+// ipcWaitParams blocks until a permission request is decided
+type ipcWaitParams struct {
+	ID        string `json:"id"`
+	TmuxName  string `json:"tmux_name"` // an approval grant for this window also answers
+	TimeoutMS int64  `json:"timeout_ms"`
+}
+
+// Session flags kept by the listener. Each maps to the flag file hooks used
+// before the socket existed, which is still the fallback.
+const (
+	stateThinking       = "thinking"        // Claude is working (typing indicator, prompt queue)
+	stateTelegramActive = "telegram_active" // input came from Telegram (remote approval)
+	statePromptAck      = "prompt_ack"      // prompt hook confirmed a Telegram prompt
+	stateGrant          = "grant"           // "Approve for 5 min" was pressed
+)
+
+// stateFile returns the fallback flag file of a session flag
+func stateFile(state, name string) string {
+	switch state {
+	case stateThinking:
+		return thinkingFlag(name)
+	case stateTelegramActive:
+		return telegramActiveFlag(name)
+	case statePromptAck:
+		return promptAckPath(name)
+	case stateGrant:
+		return otpGrantPrefix + name
+	}
+	return filepath.Join(cacheDir(), state+"-"+name)
+}
+
+// listenerState is what hooks share through the listener: session flags and
+// permission requests waiting for a decision
+type listenerState struct {
+	mu        sync.Mutex
+	flags     map[string]time.Time // state + "/" + name -> when it was set
+	changed   chan struct{}        // closed and replaced whenever a flag is set
+	requests  map[string]*OTPPermissionRequest
+	decisions map[string]chan *OTPPermissionResponse // request ID -> waiting hook
+}
+
+// ipcState is set in the listener once the socket is up; nil in hook processes
+var ipcState *listenerState
+
+func newListenerState() *listenerState {
+	return &listenerState{
+		flags:     make(map[string]time.Time),
+		changed:   make(chan struct{}),
+		requests:  make(map[string]*OTPPermissionRequest),
+		decisions: make(map[string]chan *OTPPermissionResponse),
+	}
+}
+
+func (s *listenerState) setFlag(state, name string, on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := state + "/" + name
+	if !on {
+		delete(s.flags, key)
+		return
+	}
+	s.flags[key] = time.Now()
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *listenerState) flag(state, name string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	since, ok := s.flags[state+"/"+name]
+	return since, ok
+}
+
+// waitFlag blocks until a flag is set or timeout passes
+func (s *listenerState) waitFlag(state, name string, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		_, ok := s.flags[state+"/"+name]
+		changed := s.changed
+		s.mu.Unlock()
+		if ok {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// putRequest adds or updates a pending permission request
+func (s *listenerState) putRequest(req *OTPPermissionRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := *req
+	s.requests[req.ID] = &r
+	if s.decisions[req.ID] == nil {
+		s.decisions[req.ID] = make(chan *OTPPermissionResponse, 1)
+	}
+}
+
+// setRequestMsg records the Telegram message of a still pending request
+func (s *listenerState) setRequestMsg(id string, msgID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if req := s.requests[id]; req != nil {
+		req.MsgID = msgID
+	}
+}
+
+func (s *listenerState) request(id string) *OTPPermissionRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if req := s.requests[id]; req != nil {
+		r := *req
+		return &r
+	}
+	return nil
+}
+
+func (s *listenerState) requestList() []*OTPPermissionRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reqs := make([]*OTPPermissionRequest, 0, len(s.requests))
+	for _, req := range s.requests {
+		r := *req
+		reqs = append(reqs, &r)
+	}
+	return reqs
+}
+
+// decide hands a decision to the hook waiting on a request. Returns false
+// if the request isn't known here (it came in through files).
+func (s *listenerState) decide(id string, resp *OTPPermissionResponse) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := s.decisions[id]
+	if ch == nil {
+		return false
+	}
+	delete(s.requests, id)
+	select {
+	case ch <- resp:
+	default: // already decided
+	}
+	return true
+}
+
+// waitDecision blocks until a request is decided, a grant covers its
+// window, or timeout passes. Also returns the request as it was last
+// updated, unless a decision already removed it.
+func (s *listenerState) waitDecision(p ipcWaitParams) (req *OTPPermissionRequest, resp *OTPPermissionResponse, err error) {
+	s.mu.Lock()
+	ch := s.decisions[p.ID]
+	s.mu.Unlock()
+	if ch == nil {
+		return nil, nil, fmt.Errorf("unknown request %s", p.ID)
+	}
+	defer func() {
+		s.mu.Lock()
+		req = s.requests[p.ID]
+		delete(s.requests, p.ID)
+		delete(s.decisions, p.ID)
+		s.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(time.Duration(p.TimeoutMS) * time.Millisecond)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		s.mu.Unlock()
+		// Another request of this window may have been approved for 5 min
+		if p.TmuxName != "" && hasValidOTPGrant(p.TmuxName) {
+			return nil, &OTPPermissionResponse{Approved: true, Via: "grant", Timestamp: time.Now().Unix()}, nil
+		}
+		select {
+		case resp := <-ch:
+			return nil, resp, nil
+		case <-changed:
+		case <-timer.C:
+			return nil, nil, errors.New(ipcErrTimeout)
+		}
+	}
+}
+
+// startIPCServer listens on ipcSocketPath and serves hook requests. Only
+// called by the listener, which holds ccc.lock, so an existing socket file
+// is left over from a previous run.
+func startIPCServer() error {
+	dir := filepath.Dir(ipcSocketPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return fmt.Errorf("failed to restrict %s: %w", dir, err)
+	}
+	os.Remove(ipcSocketPath)
+	ln, err := net.Listen("unix", ipcSocketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", ipcSocketPath, err)
+	}
+	if err := os.Chmod(ipcSocketPath, 0600); err != nil {
+		ln.Close()
+		return fmt.Errorf("failed to restrict %s: %w", ipcSocketPath, err)
+	}
+	ipcState = newListenerState()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				listenLog("[ipc] accept failed, hooks fall back to files: %v", err)
+				return
+			}
+			go serveIPCConn(conn)
+		}
+	}()
+	return nil
+}
+
+// serveIPCConn answers the single request on a connection
+func serveIPCConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(ipcCallTimeout))
+	var req ipcRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var resp ipcResponse
+	result, err := handleIPCRequest(&req)
+	if err != nil {
+		resp.Error = err.Error()
+	} else if result != nil {
+		resp.Result, _ = json.Marshal(result)
+	}
+	conn.SetWriteDeadline(time.Now().Add(ipcCallTimeout))
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// handleIPCRequest runs one method:
+//
+//	notify             wake the delivery loop
+//	enqueue            MessageRecord -> append to the DB, then deliver
+//	set_state          ipcStateParams -> set or clear a session flag
+//	get_state          ipcStateParams -> ipcStateResult
+//	request_permission OTPPermissionRequest -> post it to its topic and register it
+//	wait_decision      ipcWaitParams -> OTPPermissionResponse once decided
+func handleIPCRequest(req *ipcRequest) (interface{}, error) {
+	switch req.Method {
+	case "notify":
+		wakeDelivery()
+		return nil, nil
+
+	case "enqueue":
+		var rec MessageRecord
+		if err := json.Unmarshal(req.Params, &rec); err != nil {
+			return nil, err
+		}
+		if err := appendMessage(&rec); err != nil {
+			return nil, err
+		}
+		wakeDelivery()
+		return nil, nil
+
+	case "set_state":
+		var p ipcStateParams
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, err
+		}
+		setState(p.State, p.Name, p.On)
+		return nil, nil
+
+	case "get_state":
+		var p ipcStateParams
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, err
+		}
+		since, on := stateSince(p.State, p.Name)
+		return ipcStateResult{On: on, Since: since}, nil
+
+	case "request_permission":
+		var r OTPPermissionRequest
+		if err := json.Unmarshal(req.Params, &r); err != nil || r.ID == "" {
+			return nil, fmt.Errorf("invalid permission request")
+		}
+		// Registered before it is posted so an immediate tap finds it
+		ipcState.putRequest(&r)
+		go func() {
+			postPermissionRequest(&r)
+			if r.MsgID != 0 {
+				ipcState.setRequestMsg(r.ID, r.MsgID)
+			}
+		}()
+		return nil, nil
+
+	case "wait_decision":
+		var p ipcWaitParams
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, err
+		}
+		r, resp, err := ipcState.waitDecision(p)
+		if r != nil && r.MsgID != 0 {
+			if config, cerr := loadConfig(); cerr == nil {
+				finishPermissionMessage(config, r, resp, err)
+			}
+		}
+		return resp, err
+	}
+	return nil, fmt.Errorf("unknown method %q", req.Method)
+}
+
+// ipcCall sends one request to the listener and decodes its result.
+// A connection error means no listener is serving the socket.
+func ipcCall(method string, params interface{}, result interface{}, timeout time.Duration) error {
+	conn, err := net.DialTimeout("unix", ipcSocketPath, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	req := ipcRequest{Method: method}
+	if params != nil {
+		if req.Params, err = json.Marshal(params); err != nil {
+			return err
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+	var resp ipcResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return &ipcError{Msg: resp.Error}
+	}
+	if result != nil && len(resp.Result) > 0 {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
+
+// setState sets or clears a session flag: in memory in the listener,
+// through the socket from hooks, or as a flag file without a listener
+func setState(state, name string, on bool) {
+	if ipcState != nil {
+		ipcState.setFlag(state, name, on)
+		if !on {
+			os.Remove(stateFile(state, name)) // may have been set without the socket
+		}
+		return
+	}
+	if ipcCall("set_state", ipcStateParams{State: state, Name: name, On: on}, nil, ipcCallTimeout) == nil {
+		return
+	}
+	if on {
+		os.WriteFile(stateFile(state, name), []byte("1"), 0600)
+	} else {
+		os.Remove(stateFile(state, name))
+	}
+}
+
+// stateSince reports whether a session flag is set and when
+func stateSince(state, name string) (time.Time, bool) {
+	if ipcState != nil {
+		if since, ok := ipcState.flag(state, name); ok {
+			return since, true
+		}
+	} else {
+		var r ipcStateResult
+		if ipcCall("get_state", ipcStateParams{State: state, Name: name}, &r, ipcCallTimeout) == nil {
+			return r.Since, r.On
+		}
+	}
+	info, err := os.Stat(stateFile(state, name))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return info.ModTime(), true
+}
+
+// enqueueMessage records a message for the listener to deliver, waking it up
+func enqueueMessage(rec *MessageRecord) error {
+	err := ipcCall("enqueue", rec, nil, ipcCallTimeout)
+	if _, ok := err.(*ipcError); err == nil || ok {
+		return err
+	}
+	if err := appendMessage(rec); err != nil {
+		return err
+	}
+	notifyListener()
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// keyCommands maps Telegram commands to the keys they send to Claude's pane
+var keyCommands = map[string][]string{
+	"/stop":      {"Escape"}, // cancel the current turn
+	"/interrupt": {"C-c"},
+	"/mode":      {"BTab"}, // Shift-Tab cycles Claude's permission modes
+}
+
+// maxRelayKeys caps how many keys one /keys command may send
+const maxRelayKeys = 32
+
+// paneTailLines is how much of the pane is shown after sending keys
+const paneTailLines = 15
+
+// parseKeySpec validates the arguments of /keys. Each argument is one tmux
+// key name (Enter, Escape, C-c, BTab, Up, F5...) or literal text. Arguments
+// starting with "-" are refused so they can't become send-keys flags.
+func parseKeySpec(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no keys given")
+	}
+	if len(args) > maxRelayKeys {
+		return nil, fmt.Errorf("at most %d keys per command", maxRelayKeys)
+	}
+	for _, k := range args {
+		if strings.HasPrefix(k, "-") {
+			return nil, fmt.Errorf("invalid key %q", k)
+		}
+	}
+	return args, nil
+}
+
+// paneTail returns the last n non-empty lines of pane content
+func paneTail(content string, n int) string {
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, strings.TrimRight(line, " "))
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// handleKeyCommand implements /stop, /interrupt, /mode and /keys for the
+// topic's session, then shows the pane so the result can be checked
+func handleKeyCommand(config *Config, sessName string, chatID int64, threadID int64, text string) {
+	cmd, rest, _ := strings.Cut(text, " ")
+	keys, ok := keyCommands[cmd]
+	if cmd == "/keys" {
+		var err error
+		if keys, err = parseKeySpec(strings.Fields(rest)); err != nil {
+			sendMessage(config, chatID, threadID, fmt.Sprintf("❌ %v\n\nUsage: /keys <key...>, e.g. /keys Down Down Enter or /keys C-r", err))
+			return
+		}
+	} else if !ok {
+		return
+	}
+
+	target, err := sessionTarget(config, sessName)
+	if err != nil {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("❌ %v", err))
+		return
+	}
+	if err := sendKeys(target, keys...); err != nil {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to send keys: %v", err))
+		return
+	}
+	listenLog("[keys] %s: %s", sessName, strings.Join(keys, " "))
+	logEvent(sessName, "keys_sent", "listener", "", strings.Join(keys, " "))
+
+	// The turn is over once it's cancelled; the Stop hook doesn't fire for that
+	if cmd == "/stop" || cmd == "/interrupt" {
+		clearThinking(sessName)
+	}
+
+	// Give the TUI a moment to redraw before showing what it did
+	time.Sleep(700 * time.Millisecond)
+	content, err := capturePane(target)
+	if err != nil {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("⌨️ Sent %s (pane capture failed: %v)", strings.Join(keys, " "), err))
+		return
+	}
+	tail := paneTail(content, paneTailLines)
+	if tail == "" {
+		tail = "(empty pane)"
+	}
+	html := fmt.Sprintf("⌨️ Sent <code>%s</code>\n<pre>%s</pre>", htmlEscape(strings.Join(keys, " ")), htmlEscape(tail))
+	sendMessageHTMLGetID(config, chatID, threadID, html)
+}
@@ -14,7 +14,9 @@ type SessionInfo struct {
 	TopicID         int64  `json:"topic_id"`
 	Path            string `json:"path"`
 	ClaudeSessionID string `json:"claude_session_id,omitempty"`
-	WindowID        string `json:"window_id,omitempty"` // tmux window ID (@N)
+	WindowID        string `json:"window_id,omitempty"`       // tmux window ID (@N)
+	TranscriptPath  string `json:"transcript_path,omitempty"` // Claude's transcript, as of the last hook
+	HideDiffs       bool   `json:"hide_diffs,omitempty"`      // don't send diffs of Claude's edits (/diffs off)
 }
 
 // Config stores bot configuration and session mappings
@@ -22,13 +24,17 @@ type Config struct {
 	BotToken         string                  `json:"bot_token"`
 	ChatID           int64                   `json:"chat_id"`                     // Private chat for simple commands
 	GroupID          int64                   `json:"group_id,omitempty"`          // Group with topics for sessions
-	Sessions         map[string]*SessionInfo `json:"sessions,omitempty"`          // session name -> session info
+	Sessions         map[string]*SessionInfo `json:"-"`                           // session name -> session info (sessions table in ccc.db)
 	ProjectsDir      string                  `json:"projects_dir,omitempty"`      // Base directory for new projects (default: ~)
 	TranscriptionLang string                  `json:"transcription_lang,omitempty"` // Language code for whisper (e.g. "es", "en")
 	RelayURL         string                  `json:"relay_url,omitempty"`         // Relay server URL for large file transfers
+	APIBaseURL       string                  `json:"api_base_url,omitempty"`      // Bot API server URL (default: https://api.telegram.org)
+	APILocal         bool                    `json:"api_local,omitempty"`         // Self-hosted Bot API server runs with --local
 	Away             bool                    `json:"away"`
 	OAuthToken       string                  `json:"oauth_token,omitempty"`
 	OTPSecret        string                  `json:"otp_secret,omitempty"`        // TOTP secret for safe mode
+	PermissionMode   string                  `json:"permission_mode,omitempty"`   // auto / buttons / otp (default: otp if otp_secret set)
+	Users            map[int64]*UserInfo     `json:"users,omitempty"`             // Telegram user ID -> role (chat_id is always owner)
 }
 
 // TelegramMessage represents a Telegram message
@@ -40,8 +46,9 @@ type TelegramMessage struct {
 		Type string `json:"type"` // "private", "group", "supergroup"
 	} `json:"chat"`
 	From struct {
-		ID       int64  `json:"id"`
-		Username string `json:"username"`
+		ID        int64  `json:"id"`
+		Username  string `json:"username"`
+		FirstName string `json:"first_name"`
 	} `json:"from"`
 	Text           string           `json:"text"`
 	ReplyToMessage *TelegramMessage `json:"reply_to_message,omitempty"`
@@ -73,21 +80,26 @@ type TelegramDocument struct {
 type CallbackQuery struct {
 	ID   string `json:"id"`
 	From struct {
-		ID int64 `json:"id"`
+		ID        int64  `json:"id"`
+		Username  string `json:"username"`
+		FirstName string `json:"first_name"`
 	} `json:"from"`
 	Message *TelegramMessage `json:"message"`
 	Data    string           `json:"data"`
 }
 
-// TelegramUpdate represents an update from Telegram
+// Update represents a single Telegram update (message or button press)
+type Update struct {
+	UpdateID      int             `json:"update_id"`
+	Message       TelegramMessage `json:"message"`
+	CallbackQuery *CallbackQuery  `json:"callback_query"`
+}
+
+// TelegramUpdate represents a getUpdates response from Telegram
 type TelegramUpdate struct {
-	OK          bool   `json:"ok"`
-	Description string `json:"description"`
-	Result      []struct {
-		UpdateID      int             `json:"update_id"`
-		Message       TelegramMessage `json:"message"`
-		CallbackQuery *CallbackQuery  `json:"callback_query"`
-	} `json:"result"`
+	OK          bool     `json:"ok"`
+	Description string   `json:"description"`
+	Result      []Update `json:"result"`
 }
 
 // TelegramResponse represents a response from Telegram API
@@ -95,6 +107,13 @@ type TelegramResponse struct {
 	OK          bool            `json:"ok"`
 	Description string          `json:"description,omitempty"`
 	Result      json.RawMessage `json:"result,omitempty"`
+	ErrorCode   int             `json:"error_code,omitempty"`
+	Parameters  *ResponseParams `json:"parameters,omitempty"`
+}
+
+// ResponseParams carries extra error details, e.g. retry_after on 429 flood control
+type ResponseParams struct {
+	RetryAfter int `json:"retry_after,omitempty"`
 }
 
 // TopicResult represents the result of creating a forum topic
@@ -118,6 +137,8 @@ type HookData struct {
 	Trigger          string          `json:"trigger"`           // For PreCompact hook: "auto" or "manual"
 	ToolInputRaw     json.RawMessage `json:"tool_input"`        // Raw tool input JSON
 	ToolInput        HookToolInput   `json:"-"`                 // Parsed from ToolInputRaw
+	ToolUseID        string          `json:"tool_use_id"`       // For PreToolUse/PostToolUse hooks
+	ToolResponse     json.RawMessage `json:"tool_response"`     // For PostToolUse hook
 }
 
 // HookToolInput holds parsed tool input for known tool types
@@ -136,9 +157,19 @@ type HookToolInput struct {
 	FilePath    string `json:"file_path,omitempty"`   // For Read/Write/Edit
 	Query       string `json:"query,omitempty"`       // For WebSearch
 	Pattern     string `json:"pattern,omitempty"`     // For Grep/Glob
+	Path        string `json:"path,omitempty"`        // For Grep/Glob
 	URL         string `json:"url,omitempty"`         // For WebFetch
 	Prompt      string `json:"prompt,omitempty"`      // For Task/WebFetch
 	OldString   string `json:"old_string,omitempty"`  // For Edit
+	NewString   string `json:"new_string,omitempty"`  // For Edit
+	ReplaceAll  bool   `json:"replace_all,omitempty"` // For Edit
+	Content     string `json:"content,omitempty"`     // For Write
+	Edits       []struct {
+		OldString  string `json:"old_string"`
+		NewString  string `json:"new_string"`
+		ReplaceAll bool   `json:"replace_all,omitempty"`
+	} `json:"edits,omitempty"` // For MultiEdit
+	Todos []TodoItem `json:"todos,omitempty"` // For TodoWrite
 }
 
 // parseHookData unmarshals raw JSON and populates ToolInput
@@ -156,7 +187,8 @@ func parseHookData(data []byte) (HookData, error) {
 // InlineKeyboardButton represents a Telegram inline keyboard button
 type InlineKeyboardButton struct {
 	Text         string `json:"text"`
-	CallbackData string `json:"callback_data"`
+	CallbackData string `json:"callback_data,omitempty"`
+	URL          string `json:"url,omitempty"` // Opens a link instead of sending a callback
 }
 
 func init() {
@@ -237,10 +269,17 @@ func main() {
 			} else {
 				fmt.Println("otp: disabled (enable with: ccc setup <bot_token>)")
 			}
+			fmt.Printf("permission_mode: %s\n", permissionMode(config))
+			fmt.Printf("api_base_url: %s\n", apiBaseURL(config))
+			if config.APILocal {
+				fmt.Println("api_local: true")
+			}
 			fmt.Println("\nUsage: ccc config <key> <value>")
 			fmt.Println("  ccc config projects-dir ~/Projects")
 			fmt.Println("  ccc config oauth-token <token>")
 			fmt.Println("  ccc config transcription-lang es")
+			fmt.Println("  ccc config api-url http://localhost:8081  (use 'default' to reset)")
+			fmt.Println("  ccc config api-local true")
 			os.Exit(0)
 		}
 		key := os.Args[2]
@@ -273,6 +312,10 @@ func main() {
 				} else {
 					fmt.Println("disabled")
 				}
+			case "api-url":
+				fmt.Println(apiBaseURL(config))
+			case "api-local":
+				fmt.Println(config.APILocal)
 			default:
 				fmt.Fprintf(os.Stderr, "Unknown config key: %s\n", key)
 				os.Exit(1)
@@ -312,6 +355,35 @@ func main() {
 		case "otp":
 			fmt.Fprintf(os.Stderr, "Permission mode can only be changed via: ccc setup <bot_token>\n")
 			os.Exit(1)
+		case "api-url":
+			if value == "default" {
+				value = ""
+			}
+			if value != "" && !strings.HasPrefix(value, "http://") && !strings.HasPrefix(value, "https://") {
+				fmt.Fprintf(os.Stderr, "api-url must start with http:// or https://\n")
+				os.Exit(1)
+			}
+			config.APIBaseURL = value
+			if value == "" {
+				config.APILocal = false
+			}
+			if err := saveConfig(config); err != nil {
+				fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("✅ api_base_url set to: %s\n", apiBaseURL(config))
+			fmt.Println("   Restart the listener to apply: ccc listen")
+		case "api-local":
+			config.APILocal = value == "true" || value == "1" || value == "on"
+			if config.APILocal && !isSelfHostedAPI(config) {
+				fmt.Fprintf(os.Stderr, "api-local requires a self-hosted server: ccc config api-url <url>\n")
+				os.Exit(1)
+			}
+			if err := saveConfig(config); err != nil {
+				fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("✅ api_local set to: %v\n", config.APILocal)
 		default:
 			fmt.Fprintf(os.Stderr, "Unknown config key: %s\n", key)
 			os.Exit(1)
@@ -329,8 +401,28 @@ func main() {
 		}
 
 	case "listen":
+		// listen [--webhook <public-url>] [--addr <host:port>]
+		var webhookURL string
+		webhookAddr := defaultWebhookAddr
+		for i := 2; i < len(os.Args); i++ {
+			switch os.Args[i] {
+			case "--webhook":
+				if i+1 < len(os.Args) {
+					i++
+					webhookURL = os.Args[i]
+				}
+			case "--addr":
+				if i+1 < len(os.Args) {
+					i++
+					webhookAddr = os.Args[i]
+				}
+			default:
+				fmt.Fprintf(os.Stderr, "Usage: ccc listen [--webhook <public-url>] [--addr :8443]\n")
+				os.Exit(1)
+			}
+		}
 		defer closeDB()
-		if err := listen(); err != nil {
+		if err := listen(webhookURL, webhookAddr); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
@@ -354,16 +446,6 @@ func main() {
 			os.Exit(1)
 		}
 
-	case "hook-stop-retry":
-		// Background process: retry transcript read 3x at 2s intervals
-		// Args: sessName topicID transcriptPath
-		if len(os.Args) < 5 {
-			os.Exit(1)
-		}
-		var tid int64
-		fmt.Sscan(os.Args[3], &tid)
-		handleStopRetry(os.Args[2], tid, os.Args[4])
-
 	case "hook-post-tool":
 		if err := handlePostToolHook(); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -431,6 +513,53 @@ func main() {
 			os.Exit(1)
 		}
 
+	case "policy":
+		if len(os.Args) >= 4 && os.Args[2] == "test" {
+			if err := policyTest(os.Args[3]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+		if len(os.Args) >= 3 {
+			fmt.Fprintf(os.Stderr, "Usage: ccc policy [test '<hook json>']\n")
+			os.Exit(1)
+		}
+		fmt.Printf("Global policy:  %s\n", globalPolicyPath())
+		fmt.Printf("Session policy: %s\n", sessionPolicyPath("<session>"))
+		for _, path := range append([]string{globalPolicyPath()}, policyFiles()...) {
+			policy, err := loadPolicyFile(path)
+			if err != nil {
+				fmt.Printf("  ❌ %v\n", err)
+			} else if len(policy.Rules) > 0 {
+				fmt.Printf("  %s: %d rules\n", path, len(policy.Rules))
+			}
+		}
+
+	case "export":
+		if err := exportCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "search":
+		if err := searchCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "transcript":
+		if err := transcriptCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "queue":
+		if err := queueCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
 	case "relay":
 		port := "8080"
 		if len(os.Args) >= 3 {
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 // TestTmuxSafeName tests the tmuxSafeName function
@@ -88,6 +96,7 @@ func TestConfigSaveLoad(t *testing.T) {
 	originalHome := os.Getenv("HOME")
 	os.Setenv("HOME", tmpDir)
 	defer os.Setenv("HOME", originalHome)
+	useTestDB(t)
 
 	// Test config
 	config := &Config{
@@ -101,10 +110,15 @@ func TestConfigSaveLoad(t *testing.T) {
 		Away: true,
 	}
 
-	// Save config
+	// Save config; sessions go to the registry in ccc.db
 	if err := saveConfig(config); err != nil {
 		t.Fatalf("saveConfig failed: %v", err)
 	}
+	for name, info := range config.Sessions {
+		if err := saveSession(name, info); err != nil {
+			t.Fatalf("saveSession failed: %v", err)
+		}
+	}
 
 	// Verify file exists
 	configPath := filepath.Join(tmpDir, ".config", "ccc", "config.json")
@@ -172,6 +186,8 @@ func TestConfigSessionsInitialized(t *testing.T) {
 	os.Setenv("HOME", tmpDir)
 	defer os.Setenv("HOME", originalHome)
 
+	useTestDB(t)
+
 	// Write config without sessions field
 	configPath := filepath.Join(tmpDir, ".ccc.json")
 	data := []byte(`{"bot_token": "test", "chat_id": 123}`)
@@ -189,8 +205,867 @@ func TestConfigSessionsInitialized(t *testing.T) {
 	}
 }
 
-// TestExtractRecentAssistantTexts tests parsing transcript JSONL files
-func TestExtractRecentAssistantTexts(t *testing.T) {
+// TestConfigSessionsMigration tests moving sessions from config.json into ccc.db
+func TestConfigSessionsMigration(t *testing.T) {
+	tmpDir := t.TempDir()
+	originalHome := os.Getenv("HOME")
+	os.Setenv("HOME", tmpDir)
+	defer os.Setenv("HOME", originalHome)
+	useTestDB(t)
+
+	// A session already in the registry keeps its info
+	saveSession("api", &SessionInfo{TopicID: 7, Path: "/srv/api", WindowID: "@3"})
+	data := []byte(`{"bot_token": "test", "chat_id": 123, "sessions": {
+		"api": {"topic_id": 99, "path": "/old/api"},
+		"web": {"topic_id": 42, "path": "/srv/web", "claude_session_id": "abc"}}}`)
+	if err := os.WriteFile(getConfigPath(), data, 0600); err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
+	}
+
+	loaded, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if api := loaded.Sessions["api"]; api == nil || api.TopicID != 7 || api.WindowID != "@3" {
+		t.Errorf("api = %+v, want the registry's info", api)
+	}
+	if web := loaded.Sessions["web"]; web == nil || web.TopicID != 42 || web.ClaudeSessionID != "abc" {
+		t.Errorf("web = %+v, want imported from config.json", web)
+	}
+	if raw, _ := os.ReadFile(getConfigPath()); strings.Contains(string(raw), "sessions") {
+		t.Errorf("config.json still has sessions after migration:\n%s", raw)
+	}
+
+	// Updates of different fields don't overwrite each other
+	updateSession("web", func(i *SessionInfo) { i.WindowID = "@5" })
+	updateSession("web", func(i *SessionInfo) { i.ClaudeSessionID = "def" })
+	if web := loadSessions()["web"]; web.WindowID != "@5" || web.ClaudeSessionID != "def" || web.Path != "/srv/web" {
+		t.Errorf("web after updates = %+v", web)
+	}
+	if _, err := updateSession("missing", func(*SessionInfo) {}); err == nil {
+		t.Error("updateSession of an unknown session: want error")
+	}
+	deleteSession("api")
+	if _, ok := loadSessions()["api"]; ok {
+		t.Error("api still registered after deleteSession")
+	}
+}
+
+// TestUpdateLedger tests the durable getUpdates offset and update dedup
+func TestUpdateLedger(t *testing.T) {
+	useTestDB(t)
+
+	if got := loadUpdateOffset(); got != 0 {
+		t.Errorf("initial offset = %d, want 0", got)
+	}
+	saveUpdateOffset(1042)
+	saveUpdateOffset(1043)
+	if got := loadUpdateOffset(); got != 1043 {
+		t.Errorf("offset = %d, want 1043", got)
+	}
+
+	// An update is only done once its handler returned
+	if updateHandled(1042) {
+		t.Error("1042 handled before its handler ran")
+	}
+	markUpdateHandled(1042)
+	if !updateHandled(1042) {
+		t.Error("redelivered update 1042 should be skipped")
+	}
+
+	// An update cut short by a crash runs again, but not its side effects
+	if !claimEffect(1043, "shell") {
+		t.Error("first claim of 1043's shell command should succeed")
+	}
+	if updateHandled(1043) {
+		t.Error("1043 was cut short and should be handled again")
+	}
+	if claimEffect(1043, "shell") {
+		t.Error("1043's shell command should not run twice")
+	}
+	if !claimEffect(1043, "prompt") || !claimEffect(1044, "shell") {
+		t.Error("effects are claimed per update and kind")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for retry, want := range map[int]time.Duration{1: 2 * time.Second, 3: 8 * time.Second, 12: maxRetryDelay, 100: maxRetryDelay} {
+		for i := 0; i < 20; i++ {
+			if got := retryBackoff(retry); got < want/2 || got > want {
+				t.Errorf("retryBackoff(%d) = %v, want between %v and %v", retry, got, want/2, want)
+			}
+		}
+	}
+}
+
+func TestFailedMessages(t *testing.T) {
+	useTestDB(t)
+
+	appendMessage(&MessageRecord{ID: "m1", Session: "s", Type: "assistant_text", Text: "one", Timestamp: 1})
+	appendMessage(&MessageRecord{ID: "m2", Session: "s", Type: "assistant_text", Text: "two", Timestamp: 2})
+
+	scheduleRetry("m1", time.Now().Add(time.Minute), "timeout")
+	pending := findPending("s")
+	if len(pending) != 2 || pending[0].ID != "m1" || pending[0].NextAttempt <= time.Now().UnixMilli() {
+		t.Fatalf("backing-off message should stay first in line with its next attempt, got %+v", pending)
+	}
+
+	markFailed("m1", "timeout")
+	if pending := findPending("s"); len(pending) != 1 || pending[0].ID != "m2" {
+		t.Fatalf("failed message should leave the pending list, got %d pending", len(pending))
+	}
+	failed := failedMessages("")
+	if len(failed) != 1 || failed[0].ID != "m1" || failed[0].RetryCount != 2 || failed[0].LastError != "timeout" {
+		t.Fatalf("failedMessages = %+v", failed)
+	}
+
+	if !retryFailed("m1") || retryFailed("m1") {
+		t.Error("retryFailed should succeed exactly once")
+	}
+	if pending := findPending("s"); len(pending) != 2 || pending[0].RetryCount != 0 || pending[0].NextAttempt != 0 {
+		t.Error("retried message should be pending again with a fresh retry budget")
+	}
+
+	markFailed("m2", "chat not found")
+	if !dropFailed("m2") || len(failedMessages("s")) != 0 {
+		t.Error("dropped message should leave the failed list")
+	}
+	if pending := findPending("s"); len(pending) != 1 {
+		t.Errorf("dropped message should not be pending, got %d pending", len(pending))
+	}
+
+	// `ccc queue drop` gives up on failed messages; discard is the same
+	for _, verb := range []string{"drop", "discard"} {
+		markFailed("m1", "timeout")
+		if err := queueCommand([]string{verb, "m1"}); err != nil || len(failedMessages("")) != 0 {
+			t.Errorf("ccc queue %s: %v", verb, err)
+		}
+	}
+}
+
+func TestSearchMessages(t *testing.T) {
+	useTestDB(t)
+
+	appendMessage(&MessageRecord{ID: "a1", Session: "api", Type: "user_prompt", Text: "plan the DB migration", Timestamp: 1})
+	appendMessage(&MessageRecord{ID: "a2", Session: "api", Type: "assistant_text", Text: "The migration adds a sessions table.", TgMsgID: 42, Timestamp: 2})
+	appendMessage(&MessageRecord{ID: "a3", Session: "api", Type: "tool_call", Text: "Bash: run migration", Timestamp: 3})
+	appendMessage(&MessageRecord{ID: "w1", Session: "web", Type: "assistant_text", Text: "Migrations aren't needed here (yet).", Timestamp: 4})
+
+	ids := func(hits []*SearchHit) string {
+		var s []string
+		for _, h := range hits {
+			s = append(s, h.ID)
+		}
+		return strings.Join(s, ",")
+	}
+
+	tests := []struct {
+		query, session, want string
+	}{
+		{"migration", "", "a2,a1"},       // newest first, tool calls not indexed
+		{"migrat*", "", "w1,a2,a1"},      // prefix
+		{"migration", "api", "a2,a1"},    // one session
+		{"sessions table", "", "a2"},     // all words
+		{"aren't (yet)", "", "w1"},       // punctuation taken literally
+		{"migration OR nothing", "", ""}, // operators too
+	}
+	for _, tt := range tests {
+		hits, err := searchMessages(tt.query, tt.session, 10)
+		if err != nil {
+			t.Errorf("searchMessages(%q): %v", tt.query, err)
+			continue
+		}
+		if got := ids(hits); got != tt.want {
+			t.Errorf("searchMessages(%q, %q) = %q, want %q", tt.query, tt.session, got, tt.want)
+		}
+	}
+
+	// Prompts still queued or dropped from the queue were never said
+	queuePrompt(&MessageRecord{ID: "q1", Session: "api", Type: "user_prompt", Text: "redo the migration", Timestamp: 5})
+	queuePrompt(&MessageRecord{ID: "q2", Session: "api", Type: "user_prompt", Text: "skip the migration", Timestamp: 6})
+	setQueuedState("q2", msgStateDropped)
+	if hits, _ := searchMessages("migration", "api", 10); ids(hits) != "a2,a1" {
+		t.Errorf("search with queued/dropped prompts = %q, want a2,a1", ids(hits))
+	}
+
+	hits, _ := searchMessages("sessions", "", 10)
+	if len(hits) != 1 || hits[0].TgMsgID != 42 || !strings.Contains(hits[0].Snippet, matchStart+"sessions"+matchEnd) {
+		t.Errorf("hit = %+v, want tg_msg_id 42 and a marked snippet", hits)
+	}
+
+	config := &Config{GroupID: -1001234, Sessions: map[string]*SessionInfo{"api": {TopicID: 7}}}
+	if got := messageLink(config, hits[0]); got != "https://t.me/c/1234/7/42" {
+		t.Errorf("messageLink = %q", got)
+	}
+	if q, s := parseSearchArgs(config, []string{"db", "migration", "api"}); q != "db migration" || s != "api" {
+		t.Errorf("parseSearchArgs = %q, %q", q, s)
+	}
+	if q, s := parseSearchArgs(config, []string{"api"}); q != "api" || s != "" {
+		t.Errorf("parseSearchArgs single word = %q, %q", q, s)
+	}
+}
+
+func TestExport(t *testing.T) {
+	useTestDB(t)
+
+	transcript := filepath.Join(t.TempDir(), "t.jsonl")
+	lines := []string{
+		`{"type":"user","timestamp":"2026-10-13T10:00:00Z","message":{"role":"user","content":"fix the build"}}`,
+		`{"type":"assistant","timestamp":"2026-10-13T10:00:05Z","message":{"role":"assistant","content":[{"type":"thinking","thinking":"hmm"},{"type":"text","text":"Running:\n` + "```sh\\nmake\\n```" + `"}]}}`,
+		`{"type":"assistant","timestamp":"2026-10-13T10:00:06Z","message":{"role":"assistant","content":[{"type":"tool_use","name":"Bash","input":{"command":"make"}}]}}`,
+		`{"type":"user","timestamp":"2026-10-13T10:00:07Z","message":{"role":"user","content":[{"type":"tool_result","content":"ok"}]}}`,
+		`{"type":"assistant","timestamp":"2026-10-13T10:00:08Z","message":{"role":"assistant","content":[{"type":"tool_use","name":"Read","input":{"file_path":"/src/main.go"}}]}}`,
+		`{"type":"assistant","isSidechain":true,"timestamp":"2026-10-13T10:00:09Z","message":{"role":"assistant","content":[{"type":"text","text":"subagent"}]}}`,
+		`{"type":"user","isMeta":true,"timestamp":"2026-10-13T10:00:09Z","message":{"role":"user","content":"caveat"}}`,
+		`{"type":"assistant","timestamp":"2026-10-13T10:00:10Z","message":{"role":"assistant","content":[{"type":"text","text":"Fixed."}]}}`,
+	}
+	os.WriteFile(transcript, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+
+	config := &Config{Sessions: map[string]*SessionInfo{"api": {TranscriptPath: transcript}}}
+	doc, err := buildExport(config, "api", time.Time{})
+	if err != nil {
+		t.Fatalf("buildExport: %v", err)
+	}
+	var got []string
+	for _, e := range doc.Entries {
+		got = append(got, e.Role+":"+e.Text+strings.Join(e.Tools, "|"))
+	}
+	want := []string{"user:fix the build", "assistant:Running:\n```sh\nmake\n```", "tools:Bash: make|Read: /src/main.go", "assistant:Fixed."}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("entries =\n%q\nwant\n%q", got, want)
+	}
+
+	md, _ := renderExport(doc, "md")
+	if !strings.Contains(string(md), "```sh\nmake\n```") || !strings.Contains(string(md), "<details><summary>🔧 2 tool call(s)") {
+		t.Errorf("markdown export lost code or tool calls:\n%s", md)
+	}
+	page, _ := renderExport(doc, "html")
+	if !strings.Contains(string(page), "<pre>") || !strings.Contains(string(page), "<code>Bash: make</code>") {
+		t.Errorf("html export lost code or tool calls:\n%s", page)
+	}
+	if _, err := renderExport(doc, "pdf"); err == nil {
+		t.Error("unknown format: want error")
+	}
+
+	since, _ := time.Parse(time.RFC3339, "2026-10-13T10:00:09Z")
+	if doc, _ := buildExport(config, "api", since); len(doc.Entries) != 1 || doc.Entries[0].Text != "Fixed." {
+		t.Errorf("since: entries = %+v", doc.Entries)
+	}
+
+	// Without a transcript the messages table is used
+	config.Sessions["api"].TranscriptPath = ""
+	appendMessage(&MessageRecord{ID: "p", Session: "api", Type: "user_prompt", Text: "hi", Timestamp: 1})
+	appendMessage(&MessageRecord{ID: "c", Session: "api", Type: "tool_call", Text: "Bash: ls", Timestamp: 2})
+	appendMessage(&MessageRecord{ID: "r", Session: "api", Type: "assistant_text", Text: "hello", Timestamp: 3})
+	doc, err = buildExport(config, "api", time.Time{})
+	if err != nil || doc.Source != "messages" || len(doc.Entries) != 3 || doc.Entries[1].Tools[0] != "Bash: ls" {
+		t.Errorf("messages export = %+v, %v", doc, err)
+	}
+	var decoded exportDoc
+	if data, _ := renderExport(doc, "json"); json.Unmarshal(data, &decoded) != nil || len(decoded.Entries) != 3 {
+		t.Errorf("json export doesn't round-trip: %s", data)
+	}
+
+	for _, s := range []string{"24h", "7d", "2026-10-13", "2026-10-13T14:00"} {
+		if ts, err := parseSince(s); err != nil || ts.IsZero() || ts.After(time.Now()) {
+			t.Errorf("parseSince(%q) = %v, %v", s, ts, err)
+		}
+	}
+	if _, err := parseSince("last tuesday"); err == nil {
+		t.Error("parseSince: want error for free text")
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	const fixture = "testdata/transcript.jsonl"
+	var entries []*TranscriptEntry
+	if err := readTranscript(fixture, func(e *TranscriptEntry) { entries = append(entries, e) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 11 {
+		t.Fatalf("got %d entries, want 11", len(entries))
+	}
+
+	// String content becomes a single text block
+	if b := entries[1].Blocks; len(b) != 1 || b[0].Type != "text" || b[0].Text != "run the tests" {
+		t.Errorf("user string content = %+v", b)
+	}
+	a := entries[2]
+	if a.RequestID != "req_1" || a.Role() != "assistant" || len(a.Blocks) != 3 {
+		t.Fatalf("assistant entry = %+v", a)
+	}
+	if a.Blocks[0].Thinking == "" || a.Blocks[2].ToolSummary() != "Bash: go test ./..." {
+		t.Errorf("assistant blocks = %+v", a.Blocks)
+	}
+	if want := time.Date(2026, 10, 13, 10, 0, 2, 0, time.UTC); !a.Time().Equal(want) {
+		t.Errorf("Time() = %v", a.Time())
+	}
+	if r := entries[4].Blocks[0]; r.Type != "tool_result" || !r.IsError || r.ToolUseID != "toolu_1" || !strings.Contains(r.ResultText(), "FAIL") {
+		t.Errorf("tool_result = %+v", r)
+	}
+	if got := entries[7].Blocks[0].ResultText(); got != "file contents\n[image]" {
+		t.Errorf("list tool_result text = %q", got)
+	}
+	if !entries[5].IsApiErrorMessage || !entries[6].IsSidechain || !entries[9].IsMeta {
+		t.Error("entry flags not parsed")
+	}
+	if s := entries[8]; s.Type != "system" || s.Subtype != "compact_boundary" || s.text() != "Conversation compacted" {
+		t.Errorf("system entry = %+v", s)
+	}
+
+	// Rows: one per block, one for entries without blocks
+	var rows []transcriptRow
+	for _, e := range entries {
+		rows = append(rows, transcriptRows(e)...)
+	}
+	if len(rows) != 13 {
+		t.Fatalf("got %d rows, want 13", len(rows))
+	}
+	if r := rows[5]; r.Entry.Type != "progress" || r.ToolUseID != "toolu_1" || !strings.Contains(r.Content, "bash_progress") {
+		t.Errorf("progress row = %+v", r)
+	}
+	rec := rows[4].csvRecord()
+	if len(rec) != len(transcriptCSVHeader) || rec[len(rec)-4] != "Bash" || rec[len(rec)-2] != "" {
+		t.Errorf("tool_use csv record = %q", rec)
+	}
+	if line := rows[2].tableLine(); strings.Contains(line, "\nthe") || !strings.Contains(line, "The user wants | the test suite run.") {
+		t.Errorf("table line = %q", line)
+	}
+
+	// A line still being written is left for the follower
+	data, _ := os.ReadFile(fixture)
+	path := filepath.Join(t.TempDir(), "t.jsonl")
+	os.WriteFile(path, append(data, []byte(`{"type":"assistant","uuid":"a4"`)...), 0644)
+	f, _ := os.Open(path)
+	defer f.Close()
+	n, err := readTranscriptFrom(f, func(*TranscriptEntry) {})
+	if err != nil || n != int64(len(data)) {
+		t.Errorf("readTranscriptFrom consumed %d of %d bytes, err %v", n, len(data), err)
+	}
+}
+
+func TestTranscriptCursor(t *testing.T) {
+	useTestDB(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "t.jsonl")
+	reply := func(rid, text string) string {
+		return fmt.Sprintf(`{"type":"assistant","requestId":"%s","message":{"role":"assistant","content":[{"type":"text","text":"%s"}]}}`+"\n", rid, text)
+	}
+	texts := func() []string {
+		entries, err := readNewTranscript(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, b := range assistantTexts(entries) {
+			out = append(out, b.text)
+		}
+		return out
+	}
+	appendLine := func(line string) {
+		f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+		f.WriteString(line)
+		f.Close()
+	}
+
+	appendLine(reply("req_1", "one") + reply("req_2", "two"))
+	if got := texts(); len(got) != 2 || got[1] != "two" {
+		t.Fatalf("first read = %q", got)
+	}
+	if got := texts(); len(got) != 0 {
+		t.Errorf("nothing new, got %q", got)
+	}
+
+	// Only lines appended since are parsed; a line being written waits
+	line := reply("req_3", "three")
+	appendLine(line[:20])
+	if got := texts(); len(got) != 0 {
+		t.Errorf("partial line read: %q", got)
+	}
+	appendLine(line[20:])
+	if got := texts(); len(got) != 1 || got[0] != "three" {
+		t.Errorf("after append = %q", got)
+	}
+
+	// Rewritten shorter (compaction): read again from the start
+	os.WriteFile(path, []byte(reply("req_4", "four")), 0644)
+	if got := texts(); len(got) != 1 || got[0] != "four" {
+		t.Errorf("after rewrite = %q", got)
+	}
+
+	// Replaced by another file (rotation): read again, even if it's longer
+	rotated := filepath.Join(dir, "new.jsonl")
+	os.WriteFile(rotated, []byte(reply("req_4", "four")+reply("req_5", "five")), 0644)
+	os.Rename(rotated, path)
+	if got := texts(); len(got) != 2 || got[1] != "five" {
+		t.Errorf("after rotation = %q", got)
+	}
+
+	cur := loadTranscriptCursor(path)
+	fi, _ := os.Stat(path)
+	if cur == nil || cur.Offset != fi.Size() || cur.Size != fi.Size() || cur.Inode != fileInode(fi) {
+		t.Errorf("cursor = %+v, file size %d", cur, fi.Size())
+	}
+}
+
+func TestRevisedTexts(t *testing.T) {
+	useTestDB(t)
+
+	path := filepath.Join(t.TempDir(), "t.jsonl")
+	write := func(text string) {
+		f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+		fmt.Fprintf(f, `{"type":"assistant","requestId":"req_1","message":{"role":"assistant","content":[{"type":"text","text":"%s"}]}}`+"\n", text)
+		f.Close()
+	}
+	config := &Config{}
+
+	write("Looking at the")
+	if n := deliverUnsentTexts(config, "s", 1, path, false); n != 1 {
+		t.Fatalf("first read recorded %d", n)
+	}
+	markDelivered("reply:req_1:0", 42)
+
+	// A revision of a delivered block goes back to pending with its message ID
+	write("Looking at the logs, the test is flaky.")
+	if n := deliverUnsentTexts(config, "s", 1, path, false); n != 1 {
+		t.Fatalf("revision recorded %d", n)
+	}
+	pending := findPending("s")
+	if len(pending) != 1 || pending[0].ID != "reply:req_1:0" || pending[0].TgMsgID != 42 || pending[0].Text != "Looking at the logs, the test is flaky." {
+		t.Fatalf("pending after revision = %+v", pending)
+	}
+	markDelivered("reply:req_1:0", 42)
+
+	// The same text again is not a revision
+	write("Looking at the logs, the test is flaky.")
+	if n := deliverUnsentTexts(config, "s", 1, path, false); n != 0 || len(findPending("s")) != 0 {
+		t.Errorf("unchanged text recorded %d", n)
+	}
+
+	// A reply sent as its own message is edited; one in a blockquote isn't
+	if sharesTgMessage("s", 42, "reply:req_1:0") {
+		t.Error("standalone reply reported as shared")
+	}
+	appendMessage(&MessageRecord{ID: "tool:1", Session: "s", Type: "tool_call", Text: "Bash: ls"})
+	markDelivered("tool:1", 42)
+	if !sharesTgMessage("s", 42, "reply:req_1:0") {
+		t.Error("blockquote not reported as shared")
+	}
+
+	// Texts recorded under their content hash aren't sent again
+	appendMessage(&MessageRecord{ID: "reply:req_2:" + contentHash("Done."), Session: "s", Type: "assistant_text", Text: "Done."})
+	markDelivered("reply:req_2:"+contentHash("Done."), 43)
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"type":"assistant","requestId":"req_2","message":{"role":"assistant","content":[{"type":"text","text":"Done."}]}}` + "\n")
+	f.Close()
+	if n := deliverUnsentTexts(config, "s", 1, path, false); n != 0 {
+		t.Errorf("legacy reply recorded again: %d", n)
+	}
+}
+
+func TestReplyEntriesOfOneRequest(t *testing.T) {
+	useTestDB(t)
+
+	path := filepath.Join(t.TempDir(), "t.jsonl")
+	write := func(uuid, text string) {
+		f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+		fmt.Fprintf(f, `{"type":"assistant","uuid":"%s","requestId":"req_1","message":{"role":"assistant","content":[{"type":"text","text":"%s"}]}}`+"\n", uuid, text)
+		f.Close()
+	}
+	config := &Config{}
+
+	// Each text line of a request is its own entry, even read in separate passes
+	write("u1", "Let me check the logs.")
+	if n := deliverUnsentTexts(config, "s", 1, path, false); n != 1 {
+		t.Fatalf("first entry recorded %d", n)
+	}
+	markDelivered("reply:u1:0", 42)
+	write("u2", "The test is flaky.")
+	if n := deliverUnsentTexts(config, "s", 1, path, false); n != 1 {
+		t.Fatalf("second entry recorded %d", n)
+	}
+	pending := findPending("s")
+	if len(pending) != 1 || pending[0].ID != "reply:u2:0" || pending[0].TgMsgID != 0 || pending[0].Text != "The test is flaky." {
+		t.Fatalf("pending after second entry = %+v", pending)
+	}
+	if text := messageText("reply:u1:0"); text != "Let me check the logs." {
+		t.Errorf("first entry revised to %q", text)
+	}
+	markDelivered("reply:u2:0", 43)
+
+	// Only the same entry written again is a revision
+	write("u2", "The test is flaky; retrying fixes it.")
+	if n := deliverUnsentTexts(config, "s", 1, path, false); n != 1 {
+		t.Fatalf("revision recorded %d", n)
+	}
+	pending = findPending("s")
+	if len(pending) != 1 || pending[0].ID != "reply:u2:0" || pending[0].TgMsgID != 43 {
+		t.Errorf("pending after revision = %+v", pending)
+	}
+}
+
+func TestToolResults(t *testing.T) {
+	useTestDB(t)
+
+	for _, tt := range []struct {
+		raw    string
+		output string
+		failed bool
+	}{
+		{`{"stdout":"ok\n","stderr":"","interrupted":false}`, "ok", false},
+		{`{"stdout":"","stderr":"killed","interrupted":true}`, "killed", true},
+		{`"plain text"`, "plain text", false},
+		{`[{"type":"text","text":"from mcp"}]`, "from mcp", false},
+		{`{"filePath":"a.go"}`, "{\n  \"filePath\": \"a.go\"\n}", false},
+	} {
+		output, failed := toolResponseOutput(json.RawMessage(tt.raw))
+		if output != tt.output || failed != tt.failed {
+			t.Errorf("toolResponseOutput(%s) = %q, %v", tt.raw, output, failed)
+		}
+	}
+
+	start := time.Now().UnixMilli()
+	appendMessage(&MessageRecord{ID: "tool:toolu_1", Session: "s", Type: "tool_call", Text: "Bash: go test ./...", Timestamp: start})
+	appendMessage(&MessageRecord{ID: "tool:toolu_2", Session: "s", Type: "tool_call", Text: "Read: main.go", Timestamp: start})
+	saveToolState("s", &ToolState{MsgID: 7, Tools: []ToolCall{
+		{Name: "Bash", Input: "go test ./...", Time: start, Ref: "tool:toolu_1"},
+		{Name: "Read", Input: "main.go", Time: start, Ref: "tool:toolu_2"},
+	}})
+
+	// Success from PostToolUse, matched by tool_use_id
+	recordToolResult("s", &toolResult{Call: "tool:toolu_2", Name: "Read", Input: "main.go", Output: "package main", ToolID: "toolu_2", Finished: start + 400})
+	// Failure from the transcript
+	entries := []*TranscriptEntry{}
+	readTranscript("testdata/transcript.jsonl", func(e *TranscriptEntry) { entries = append(entries, e) })
+	if n := recordTranscriptResults("s", entries); n != 1 {
+		t.Fatalf("recorded %d failed results, want 1", n)
+	}
+	if n := recordTranscriptResults("s", entries); n != 0 {
+		t.Errorf("failed result recorded twice")
+	}
+
+	for _, rec := range findPending("s") {
+		if rec.Type == "tool_result" {
+			if id := applyToolResult("s", rec); id != 7 {
+				t.Errorf("applyToolResult(%s) = %d", rec.ID, id)
+			}
+			markDelivered(rec.ID, 7)
+		}
+	}
+	lines := formatToolLines(loadToolState("s"))
+	if !strings.Contains(lines, "❌ Bash: go test ./...") || !strings.Contains(lines, "↳ FAIL") {
+		t.Errorf("failed call not shown: %q", lines)
+	}
+	if !strings.Contains(lines, "✅ Read: main.go · 0.4s") {
+		t.Errorf("finished call not shown: %q", lines)
+	}
+
+	results := toolResults("s", 7)
+	if len(results) != 2 {
+		t.Fatalf("toolResults = %d, want 2", len(results))
+	}
+	var res toolResult
+	json.Unmarshal([]byte(results[1].Text), &res)
+	if !res.Failed || res.Name != "Bash" || res.Input != "go test ./..." || !strings.Contains(res.Output, "FAIL: TestX") {
+		t.Errorf("transcript result = %+v", res)
+	}
+
+	kb := toolOutputKeyboard("s", loadToolState("s"))
+	if len(kb) != 1 || kb[0][0].CallbackData != "out:7:s" {
+		t.Errorf("keyboard = %+v", kb)
+	}
+	if role, sess := callbackAccess(&CallbackQuery{Data: "out:7:s"}); role != roleViewer || sess != "s" {
+		t.Errorf("callbackAccess = %s, %s", role, sess)
+	}
+
+	// Cuts never split a multibyte character
+	if ex := outputExcerpt("ошибка: " + strings.Repeat("я", 100)); !utf8.ValidString(ex) {
+		t.Errorf("outputExcerpt = %q", ex)
+	}
+	recordToolResult("s", &toolResult{Name: "Bash", Output: "x" + strings.Repeat("я", maxToolOutput), ToolID: "toolu_big"})
+	json.Unmarshal([]byte(messageText("result:toolu_big")), &res)
+	if !utf8.ValidString(res.Output) || !strings.HasSuffix(res.Output, "(truncated)") {
+		t.Errorf("truncated output is not valid UTF-8")
+	}
+}
+
+// fakeTelegram serves the Bot API methods deliveryLoop uses, recording each
+// call's method and text. Edits fail with editError when it is set.
+type fakeTelegram struct {
+	mu        sync.Mutex
+	calls     []string
+	next      int64
+	editError string
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	f.calls = append(f.calls, method+" "+r.Form.Get("text"))
+	if method == "editMessageText" && f.editError != "" {
+		fmt.Fprintf(w, `{"ok":false,"error_code":400,"description":%q}`, f.editError)
+		return
+	}
+	f.next++
+	fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%d}}`, f.next)
+}
+
+func TestDeliverDiffKeepsBlockquote(t *testing.T) {
+	useTestDB(t)
+	tg := &fakeTelegram{}
+	srv := httptest.NewServer(tg)
+	defer srv.Close()
+	config := &Config{BotToken: "TOKEN", APIBaseURL: srv.URL, GroupID: 5}
+
+	// The PreToolUse hook records an edit's call and its diff, PostToolUse its result
+	appendMessage(&MessageRecord{ID: "tool:toolu_1", Session: "s", Type: "tool_call", Text: "Edit: main.go"})
+	appendMessage(&MessageRecord{ID: "diff:toolu_1", Session: "s", Type: "diff", Text: "--- a/main.go\n+++ b/main.go\n@@ -1 +1 @@\n-a\n+b\n"})
+	recordToolResult("s", &toolResult{Call: "tool:toolu_1", Name: "Edit", Input: "main.go", ToolID: "toolu_1", Finished: time.Now().UnixMilli()})
+	if !deliverSession(config, "s", 9) {
+		t.Fatal("delivery stopped")
+	}
+	if pending := findPending("s"); len(pending) != 0 {
+		t.Fatalf("still pending: %+v", pending)
+	}
+
+	state := loadToolState("s")
+	if state.MsgID != 1 || len(state.Tools) != 1 || state.Tools[0].Status != "ok" {
+		t.Fatalf("tool state after result = %+v", state)
+	}
+	// The blockquote is sent, then the diff below it, then edited with the result
+	flushToolEdit(config, "s", 9, true)
+	tg.mu.Lock()
+	calls := append([]string(nil), tg.calls...)
+	tg.mu.Unlock()
+	if len(calls) < 3 || !strings.HasPrefix(calls[0], "sendMessage") || !strings.Contains(calls[0], "main.go") ||
+		!strings.HasPrefix(calls[1], "sendMessage") || !strings.Contains(calls[1], "language-diff") ||
+		!strings.HasPrefix(calls[len(calls)-1], "editMessageText") || !strings.Contains(calls[len(calls)-1], "✅") {
+		t.Errorf("calls = %q", calls)
+	}
+
+	// The next call of the turn goes into the same blockquote
+	appendMessage(&MessageRecord{ID: "tool:toolu_2", Session: "s", Type: "tool_call", Text: "Bash: go test"})
+	deliverSession(config, "s", 9)
+	if state := loadToolState("s"); state.MsgID != 1 || len(state.Tools) != 2 {
+		t.Errorf("tool state after next call = %+v", state)
+	}
+}
+
+func TestDiffs(t *testing.T) {
+	useTestDB(t)
+
+	before := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"
+	after := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\n"
+	want := "--- a/x.txt\n+++ b/x.txt\n@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n@@ -10,3 +10,4 @@\n j\n k\n l\n+m\n"
+	if got := unifiedDiff("x.txt", before, after); got != want {
+		t.Errorf("unifiedDiff =\n%s\nwant\n%s", got, want)
+	}
+	if got := unifiedDiff("x.txt", before, before); got != "" {
+		t.Errorf("unifiedDiff of equal texts = %q", got)
+	}
+	if added, removed := diffStat(want); added != 2 || removed != 1 {
+		t.Errorf("diffStat = +%d -%d", added, removed)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "src", "x.go")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	os.WriteFile(path, []byte("package x\n\nvar a = 1\nvar b = 1\n"), 0644)
+	for _, tt := range []struct {
+		tool, input string
+		want        []string
+	}{
+		{"Edit", `{"old_string":"a = 1","new_string":"a = 2"}`, []string{"+++ b/src/x.go", "@@ -1,4 +1,4 @@", "-var a = 1", "+var a = 2", " var b = 1"}},
+		{"Edit", `{"old_string":" = 1","new_string":" = 3","replace_all":true}`, []string{"+var a = 3", "+var b = 3"}},
+		{"MultiEdit", `{"edits":[{"old_string":"a = 1","new_string":"a = 2"},{"old_string":"b = 1","new_string":"b = 2"}]}`, []string{"-var a = 1", "-var b = 1", "+var b = 2"}},
+		{"Edit", `{"old_string":"missing","new_string":"found"}`, []string{"-missing", "+found"}},
+		{"Write", `{"content":"package x\n"}`, []string{"@@ -1,4 +1 @@", "-var a = 1"}},
+	} {
+		var hookData HookData
+		json.Unmarshal([]byte(tt.input), &hookData.ToolInput)
+		hookData.ToolName, hookData.Cwd, hookData.ToolInput.FilePath = tt.tool, dir, path
+		diff := toolDiff(hookData)
+		for _, w := range tt.want {
+			if !strings.Contains(diff, w+"\n") {
+				t.Errorf("%s %s: diff lacks %q:\n%s", tt.tool, tt.input, w, diff)
+			}
+		}
+	}
+	if diff := toolDiff(HookData{ToolName: "Read", ToolInput: HookToolInput{FilePath: path}}); diff != "" {
+		t.Errorf("Read produced a diff: %q", diff)
+	}
+
+	saveSession("s", &SessionInfo{TopicID: 1, Path: dir})
+	updateSession("s", func(info *SessionInfo) { info.HideDiffs = true })
+	if info := loadSessions()["s"]; info == nil || !info.HideDiffs {
+		t.Errorf("HideDiffs not persisted: %+v", info)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	useTestDB(t)
+
+	hookData, err := parseHookData([]byte(`{"tool_name":"TodoWrite","tool_input":{"todos":[
+		{"content":"Write tests","status":"completed","activeForm":"Writing tests"},
+		{"content":"Fix <bug>","status":"in_progress","activeForm":"Fixing <bug>"},
+		{"content":"Update docs","status":"pending","activeForm":"Updating docs"}]}}`))
+	if err != nil || len(hookData.ToolInput.Todos) != 3 {
+		t.Fatalf("todos = %+v, %v", hookData.ToolInput.Todos, err)
+	}
+	want := "📋 <b>Plan</b> (1/3)\n✅ <s>Write tests</s>\n⏳ <b>Fixing &lt;bug&gt;</b>\n☐ Update docs"
+	if got := formatPlanHTML(hookData.ToolInput.Todos); got != want {
+		t.Errorf("formatPlanHTML =\n%s\nwant\n%s", got, want)
+	}
+
+	if id := loadPlanMessage("s"); id != 0 {
+		t.Errorf("plan before any TodoWrite = %d", id)
+	}
+	savePlanMessage("s", 42)
+	if id := loadPlanMessage("s"); id != 42 {
+		t.Errorf("loadPlanMessage = %d, want 42", id)
+	}
+	savePlanMessage("s", 0)
+	if id := loadPlanMessage("s"); id != 0 {
+		t.Errorf("plan after reset = %d", id)
+	}
+
+	tg := &fakeTelegram{}
+	srv := httptest.NewServer(tg)
+	defer srv.Close()
+	config := &Config{BotToken: "TOKEN", APIBaseURL: srv.URL, GroupID: 5}
+	rec := &MessageRecord{Text: `[{"content":"Write tests","status":"pending"}]`}
+	if id, err := updatePlan(config, "s", 9, rec); id != 1 || err != nil {
+		t.Fatalf("first plan = %d, %v", id, err)
+	}
+	// An edit showing the same text is fine
+	tg.editError = "Bad Request: message is not modified"
+	if id, err := updatePlan(config, "s", 9, rec); id != 1 || err != nil {
+		t.Errorf("unmodified plan = %d, %v", id, err)
+	}
+	// Other edit failures are reported
+	tg.editError = "Bad Request: can't parse entities"
+	if _, err := updatePlan(config, "s", 9, rec); err == nil || !strings.Contains(err.Error(), "can't parse entities") {
+		t.Errorf("failed edit err = %v", err)
+	}
+	// A deleted plan is sent again
+	tg.editError = "Bad Request: message to edit not found"
+	if id, err := updatePlan(config, "s", 9, rec); id == 1 || id == 0 || err != nil || loadPlanMessage("s") != id {
+		t.Errorf("deleted plan = %d, %v", id, err)
+	}
+}
+
+func TestUpdateDispatcher(t *testing.T) {
+	useTestDB(t)
+
+	topicMsg := TelegramMessage{MessageThreadID: 7}
+	topicMsg.Chat.ID = -100
+	tests := []struct {
+		name   string
+		update Update
+		want   string
+	}{
+		{"private chat", Update{}, globalWorker},
+		{"topic message", Update{Message: topicMsg}, "topic:-100:7"},
+		{"button in topic", Update{CallbackQuery: &CallbackQuery{Message: &topicMsg}}, "topic:-100:7"},
+		{"button without message", Update{CallbackQuery: &CallbackQuery{}}, globalWorker},
+	}
+	for _, tt := range tests {
+		if got := updateKey(tt.update); got != tt.want {
+			t.Errorf("%s: updateKey = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	t.Setenv("HOME", t.TempDir())
+	// waitIdle waits for workers to finish the bookkeeping of handled updates
+	waitIdle := func() {
+		for deadline := time.Now().Add(5 * time.Second); len(loadPendingUpdates()) > 0; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d updates still pending", len(loadPendingUpdates()))
+			}
+		}
+	}
+	topic := func(id int, thread int64) Update {
+		u := Update{UpdateID: id}
+		u.Message.Chat.ID, u.Message.MessageThreadID = -100, thread
+		return u
+	}
+
+	// A stuck topic holds up neither dispatching nor the other topics
+	block := make(chan struct{})
+	handled := make(chan int, 300)
+	d := newUpdateDispatcher(&Config{}, 10)
+	d.handle = func(_ *Config, u Update) {
+		if u.Message.MessageThreadID == 7 {
+			<-block
+		}
+		handled <- u.UpdateID
+	}
+	for id := 10; id < 210; id++ {
+		d.dispatch(topic(id, 7))
+	}
+	d.dispatch(topic(210, 8))
+	select {
+	case id := <-handled:
+		if id != 210 {
+			t.Errorf("handled %d first, want 210", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("topic 8 waited for stuck topic 7")
+	}
+
+	// getUpdates moves past dispatched updates; unhandled ones are kept
+	if got := d.offset(); got != 211 {
+		t.Errorf("offset = %d, want 211", got)
+	}
+	if got := loadUpdateOffset(); got != 211 {
+		t.Errorf("saved offset = %d, want 211", got)
+	}
+	if d.dispatch(topic(12, 7)) {
+		t.Error("update 12 was dispatched again")
+	}
+	pending := loadPendingUpdates()
+	if len(pending) < 200 || pending[0].UpdateID != 10 || pending[0].Message.MessageThreadID != 7 {
+		t.Fatalf("pending = %d updates, want 10..209", len(pending))
+	}
+
+	// After a restart the unfinished updates are handled, in order
+	close(block)
+	for i := 0; i < 200; i++ {
+		<-handled
+	}
+	waitIdle()
+	savePendingUpdate(topic(10, 7)) // handled already: skipped
+	savePendingUpdate(topic(300, 7))
+	d2 := newUpdateDispatcher(&Config{}, loadUpdateOffset())
+	d2.handle = func(_ *Config, u Update) { handled <- u.UpdateID }
+	d2.resume()
+	select {
+	case id := <-handled:
+		if id != 300 {
+			t.Errorf("resumed update %d, want 300", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending update not resumed")
+	}
+	waitIdle()
+}
+
+// useTestDB points the database at a fresh file for the rest of the test
+func useTestDB(t *testing.T) {
+	closeDB()
+	dbOnce = sync.Once{}
+	origPath := dbPath
+	path := filepath.Join(t.TempDir(), "test.db")
+	dbPath = func() string { return path }
+	t.Cleanup(func() { dbPath = origPath; closeDB(); dbOnce = sync.Once{} })
+}
+
+// TestAssistantTexts tests parsing replies out of transcript JSONL files
+func TestAssistantTexts(t *testing.T) {
+	useTestDB(t)
 	tmpDir, err := os.MkdirTemp("", "ccc-test-*")
 	if err != nil {
 		t.Fatalf("Failed to create temp dir: %v", err)
@@ -258,12 +1133,6 @@ func TestExtractRecentAssistantTexts(t *testing.T) {
 {"type":"assistant","requestId":"req_4","message":{"role":"assistant","content":[{"type":"text","text":"tool completed"}]}}`,
 			expected: []string{"running tool", "tool completed"},
 		},
-		{
-			name: "tail count limits results",
-			content: `{"type":"assistant","requestId":"req_1","message":{"role":"assistant","content":[{"type":"text","text":"old message"}]}}
-{"type":"assistant","requestId":"req_2","message":{"role":"assistant","content":[{"type":"text","text":"recent message"}]}}`,
-			expected: []string{"recent message"},
-		},
 	}
 
 	for _, tt := range tests {
@@ -273,13 +1142,12 @@ func TestExtractRecentAssistantTexts(t *testing.T) {
 				t.Fatalf("Failed to write test file: %v", err)
 			}
 
-			tailCount := 80
-			if tt.name == "tail count limits results" {
-				tailCount = 1 // only keep last entry
+			entries, err := readNewTranscript(filePath)
+			if err != nil {
+				t.Fatal(err)
 			}
-			blocks := extractRecentAssistantTexts(filePath, tailCount)
 			var result []string
-			for _, b := range blocks {
+			for _, b := range assistantTexts(entries) {
 				result = append(result, b.text)
 			}
 			if tt.expected == nil {
@@ -301,19 +1169,19 @@ func TestExtractRecentAssistantTexts(t *testing.T) {
 	}
 }
 
-// TestExtractRecentNonExistent tests with non-existent file
-func TestExtractRecentNonExistent(t *testing.T) {
-	result := extractRecentAssistantTexts("/nonexistent/path/file.jsonl", 80)
-	if result != nil {
-		t.Errorf("non-existent file = %v, want nil", result)
+// TestReadNewTranscriptNonExistent tests with non-existent file
+func TestReadNewTranscriptNonExistent(t *testing.T) {
+	useTestDB(t)
+	entries, err := readNewTranscript("/nonexistent/path/file.jsonl")
+	if err == nil || entries != nil {
+		t.Errorf("non-existent file = %v, %v, want error", entries, err)
 	}
 }
 
-// TestExtractRecentEmptyPath tests with empty path
-func TestExtractRecentEmptyPath(t *testing.T) {
-	result := extractRecentAssistantTexts("", 80)
-	if result != nil {
-		t.Errorf("empty path = %v, want nil", result)
+// TestDeliverUnsentTextsEmptyPath tests with empty path
+func TestDeliverUnsentTextsEmptyPath(t *testing.T) {
+	if n := deliverUnsentTexts(&Config{}, "s", 1, "", false); n != 0 {
+		t.Errorf("empty path recorded %d", n)
 	}
 }
 
@@ -782,6 +1650,667 @@ func TestMarkdownToHTML(t *testing.T) {
 	}
 }
 
+func TestTopicLink(t *testing.T) {
+	tests := []struct {
+		name     string
+		groupID  int64
+		topicID  int64
+		expected string
+	}{
+		{"supergroup", -1001234567890, 42, "https://t.me/c/1234567890/42"},
+		{"no group", 0, 42, ""},
+		{"no topic", -1001234567890, 0, ""},
+		{"basic group", -4567, 42, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := topicLink(&Config{GroupID: tt.groupID}, tt.topicID)
+			if result != tt.expected {
+				t.Errorf("topicLink(%d, %d) = %q, want %q", tt.groupID, tt.topicID, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFormatAge(t *testing.T) {
+	tests := []struct {
+		input    time.Duration
+		expected string
+	}{
+		{5 * time.Second, "5s"},
+		{3 * time.Minute, "3m"},
+		{2*time.Hour + 10*time.Minute, "2h"},
+		{50 * time.Hour, "2d"},
+	}
+
+	for _, tt := range tests {
+		if result := formatAge(tt.input); result != tt.expected {
+			t.Errorf("formatAge(%v) = %q, want %q", tt.input, result, tt.expected)
+		}
+	}
+}
+
+func TestRateBucket(t *testing.T) {
+	now := time.Now()
+	b := &rateBucket{interval: time.Second, burst: 3}
+
+	// Burst is allowed immediately
+	for i := 0; i < 3; i++ {
+		if d := b.delay(now); d != 0 {
+			t.Fatalf("send %d: delay = %v, want 0", i, d)
+		}
+		b.take(now)
+	}
+	// Then one per interval
+	if d := b.delay(now); d != time.Second {
+		t.Errorf("delay after burst = %v, want 1s", d)
+	}
+	if d := b.delay(now.Add(time.Second)); d != 0 {
+		t.Errorf("delay after one interval = %v, want 0", d)
+	}
+
+	// A group allows ~20 messages/min across all its topics
+	if g := newChatBucket("-1001234"); g.interval < 3*time.Second {
+		t.Errorf("group interval = %v, want >= 3s", g.interval)
+	}
+	if p := newChatBucket("1234"); p.interval != chatSendInterval {
+		t.Errorf("private chat interval = %v", p.interval)
+	}
+}
+
+func TestFloodDeadline(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	l := &telegramRateLimiter{blocked: make(map[string]time.Time)}
+
+	l.block("-100", 50*time.Millisecond)
+	if !l.flooded("-100") {
+		t.Fatal("chat not flooded after a 429")
+	}
+	if _, err := os.Stat(floodFlag("-100")); err != nil {
+		t.Fatalf("deadline not shared with other processes: %v", err)
+	}
+	// Once the deadline passes its file is removed
+	time.Sleep(60 * time.Millisecond)
+	if l.flooded("-100") {
+		t.Error("chat still flooded after the deadline")
+	}
+	if _, err := os.Stat(floodFlag("-100")); !os.IsNotExist(err) || len(l.blocked) != 0 {
+		t.Errorf("stale deadline kept: %v, %v", err, l.blocked)
+	}
+}
+
+func TestEditCoalescer(t *testing.T) {
+	c := &editCoalescer{pending: make(map[string]*string)}
+
+	if !c.begin("1:2", "a") {
+		t.Fatal("first edit should proceed")
+	}
+	if c.begin("1:2", "b") || c.begin("1:2", "c") {
+		t.Fatal("edits while one is in flight should be coalesced")
+	}
+	if text, ok := c.next("1:2"); !ok || text != "c" {
+		t.Errorf("next = %q, %v, want \"c\", true", text, ok)
+	}
+	if _, ok := c.next("1:2"); ok {
+		t.Error("next should report nothing pending")
+	}
+	if !c.begin("1:2", "d") {
+		t.Error("edit after release should proceed")
+	}
+}
+
+func TestBotURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		baseURL  string
+		expected string
+	}{
+		{"default", "", "https://api.telegram.org/botTOKEN/getMe"},
+		{"self-hosted", "http://localhost:8081", "http://localhost:8081/botTOKEN/getMe"},
+		{"trailing slash", "http://localhost:8081/", "http://localhost:8081/botTOKEN/getMe"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{BotToken: "TOKEN", APIBaseURL: tt.baseURL}
+			if result := botURL(config, "getMe"); result != tt.expected {
+				t.Errorf("botURL() = %q, want %q", result, tt.expected)
+			}
+			if selfHosted := isSelfHostedAPI(config); selfHosted != (tt.baseURL != "") {
+				t.Errorf("isSelfHostedAPI() = %v", selfHosted)
+			}
+		})
+	}
+}
+
+func TestPermissionMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		expected string
+	}{
+		{"default", Config{}, permModeAuto},
+		{"legacy otp secret", Config{OTPSecret: "SECRET"}, permModeOTP},
+		{"buttons", Config{PermissionMode: "buttons"}, permModeButtons},
+		{"auto overrides secret", Config{PermissionMode: "auto", OTPSecret: "SECRET"}, permModeAuto},
+		{"otp without secret", Config{PermissionMode: "otp"}, permModeButtons},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := permissionMode(&tt.config); result != tt.expected {
+				t.Errorf("permissionMode() = %q, want %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFindPendingOTPRequest(t *testing.T) {
+	origPrefix := otpRequestPrefix
+	otpRequestPrefix = filepath.Join(t.TempDir(), "otp-request-")
+	defer func() { otpRequestPrefix = origPrefix }()
+
+	now := time.Now().Unix()
+	writeOTPRequestFile(&OTPPermissionRequest{ID: "r1", SessionName: "alpha", Timestamp: now - 2})
+	writeOTPRequestFile(&OTPPermissionRequest{ID: "r2", SessionName: "beta", Timestamp: now - 1})
+	writeOTPRequestFile(&OTPPermissionRequest{ID: "r3", SessionName: "alpha", Timestamp: now})
+	writeOTPRequestFile(&OTPPermissionRequest{ID: "old", SessionName: "beta", Timestamp: now - 3600})
+
+	if req := findPendingOTPRequest("alpha"); req == nil || req.ID != "r3" {
+		t.Errorf("alpha: got %+v, want newest request r3", req)
+	}
+	if req := findPendingOTPRequest("beta"); req == nil || req.ID != "r2" {
+		t.Errorf("beta: got %+v, want r2 (expired requests ignored)", req)
+	}
+	if req := findPendingOTPRequest(""); req != nil {
+		t.Errorf("no session with several pending: got %+v, want nil", req)
+	}
+	if req := findPendingOTPRequest("gamma"); req != nil {
+		t.Errorf("gamma: got %+v, want nil", req)
+	}
+}
+
+func TestPolicyRuleMatches(t *testing.T) {
+	project := "/home/me/proj"
+	tests := []struct {
+		name     string
+		rule     PolicyRule
+		call     policyCall
+		expected bool
+	}{
+		{"tool list", PolicyRule{Action: "allow", Tools: []string{"Read", "Grep"}}, policyCall{Tool: "Grep"}, true},
+		{"tool glob", PolicyRule{Action: "allow", Tools: []string{"mcp__*"}}, policyCall{Tool: "mcp__github__search"}, true},
+		{"other tool", PolicyRule{Action: "allow", Tools: []string{"Read"}}, policyCall{Tool: "Bash"}, false},
+		{"command regex", PolicyRule{Action: "ask", Command: `git\s+push`}, policyCall{Tool: "Bash", Command: "git push origin main"}, true},
+		{"command regex no match", PolicyRule{Action: "ask", Command: `git\s+push`}, policyCall{Tool: "Bash", Command: "git status"}, false},
+		{"path glob", PolicyRule{Action: "deny", Paths: []string{"$PROJECT/**/*.pem"}}, policyCall{Tool: "Read", Path: project + "/certs/a/key.pem", ProjectDir: project}, true},
+		{"single star stays in dir", PolicyRule{Action: "deny", Paths: []string{"$PROJECT/*.pem"}}, policyCall{Tool: "Read", Path: project + "/certs/key.pem", ProjectDir: project}, false},
+		{"session filter", PolicyRule{Action: "allow", Sessions: []string{"a"}}, policyCall{Tool: "Bash", Session: "b"}, false},
+		{"rm outside project", PolicyRule{Action: "deny", Command: `rm\s+-\w*r`, OutsideProject: true}, policyCall{Tool: "Bash", Command: "rm -rf /etc/foo", ProjectDir: project}, true},
+		{"rm parent dir", PolicyRule{Action: "deny", Command: `rm\s+-\w*r`, OutsideProject: true}, policyCall{Tool: "Bash", Command: "rm -rf ../other", ProjectDir: project}, true},
+		{"rm inside project", PolicyRule{Action: "deny", Command: `rm\s+-\w*r`, OutsideProject: true}, policyCall{Tool: "Bash", Command: "rm -rf build " + project + "/dist", ProjectDir: project}, false},
+		{"path prefix is not inside", PolicyRule{Action: "deny", OutsideProject: true}, policyCall{Tool: "Write", Path: project + "2/x", ProjectDir: project}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.compile(); err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+			if result := tt.rule.matches(tt.call); result != tt.expected {
+				t.Errorf("matches() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPolicyRuleCompileErrors(t *testing.T) {
+	if err := (&PolicyRule{Action: "maybe"}).compile(); err == nil {
+		t.Error("expected error for invalid action")
+	}
+	if err := (&PolicyRule{Action: "deny", Command: "("}).compile(); err == nil {
+		t.Error("expected error for invalid regex")
+	}
+}
+
+func TestPolicyFailsClosed(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	os.MkdirAll(filepath.Join(configDir(), "policies"), 0755)
+	os.WriteFile(globalPolicyPath(), []byte(`{"rules":[{"action":"deny","tools":["Bash"],"command":"rm"}]}`), 0600)
+	os.WriteFile(sessionPolicyPath("s"), []byte(`{"rules":[{"action":"allow",`), 0600)
+
+	// A broken session file doesn't stop the global rules
+	match, err := evaluatePolicy(policyCall{Tool: "Bash", Command: "rm -rf x", Session: "s"})
+	if err == nil || match == nil || match.Action != policyDeny {
+		t.Fatalf("evaluatePolicy = %+v, %v; want global deny and an error", match, err)
+	}
+	if m := failClosed(match, err); m.Action != policyDeny {
+		t.Errorf("failClosed kept %s, want deny", m.Action)
+	}
+
+	// Unmatched calls need approval instead of falling through to auto-allow
+	match, err = evaluatePolicy(policyCall{Tool: "Bash", Command: "ls", Session: "s"})
+	if m := failClosed(match, err); m == nil || m.Action != policyAsk || m.Rule != policyErrorRule {
+		t.Errorf("failClosed = %+v, want ask", m)
+	}
+	match, err = evaluatePolicy(policyCall{Tool: "Bash", Command: "ls", Session: "other"})
+	if m := failClosed(match, err); err != nil || m != nil {
+		t.Errorf("valid policy: %+v, %v; want no match", m, err)
+	}
+}
+
+func TestTruncateRunes(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"Привет, мир", 6, "Привет..."},
+		{"日本語のテキスト", 3, "日本語..."},
+		{"🙂🙂🙂", 3, "🙂🙂🙂"},
+		{"ab🙂cd", 3, "ab🙂..."},
+	} {
+		got := truncateRunes(tt.in, tt.n)
+		if got != tt.want || !utf8.ValidString(got) {
+			t.Errorf("truncateRunes(%q, %d) = %q, want %q", tt.in, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestPromptQueue(t *testing.T) {
+	tmpDir := t.TempDir()
+	origPath := dbPath
+	dbPath = func() string { return filepath.Join(tmpDir, "test.db") }
+	defer func() { dbPath = origPath; closeDB(); dbOnce = sync.Once{} }()
+
+	session := "test-session"
+	for i, text := range []string{"first", "second", "third"} {
+		pos, err := queuePrompt(&MessageRecord{
+			ID: fmt.Sprintf("tg:%d", i), Session: session, Type: "user_prompt", Text: text, Origin: "telegram", TgMsgID: int64(100 + i),
+		})
+		if err != nil {
+			t.Fatalf("queuePrompt failed: %v", err)
+		}
+		if pos != i+1 {
+			t.Errorf("queuePrompt(%q) position = %d, want %d", text, pos, i+1)
+		}
+	}
+
+	// Queued prompts are not yet typed into the pane, so the prompt hook must not match them
+	if isFromTelegram(session, "first") {
+		t.Error("isFromTelegram matched a queued prompt")
+	}
+	if len(findPending(session)) != 0 {
+		t.Error("queued prompts should not be pending delivery")
+	}
+
+	// The "queued" notice is kept apart from the user's own message
+	setQueueNotice("tg:0", 900)
+	if queue := queuedPrompts(session); queue[0].TgMsgID != 100 || queue[0].NoticeMsgID != 900 {
+		t.Errorf("queued prompt message IDs = %d, notice %d", queue[0].TgMsgID, queue[0].NoticeMsgID)
+	}
+
+	queue := queuedPrompts(session)
+	reorderQueue([]string{queue[2].ID, queue[0].ID, queue[1].ID})
+	queue = queuedPrompts(session)
+	if queue[0].Text != "third" || queue[1].Text != "first" {
+		t.Errorf("queue order after reorder = %q, %q", queue[0].Text, queue[1].Text)
+	}
+
+	if !setQueuedState(queue[0].ID, "") {
+		t.Fatal("setQueuedState should take a queued prompt")
+	}
+	if setQueuedState(queue[0].ID, "") {
+		t.Error("setQueuedState should not take a prompt twice")
+	}
+	if !isFromTelegram(session, "third") {
+		t.Error("isFromTelegram should match a sent prompt")
+	}
+
+	setQueuedState(queue[1].ID, msgStateDropped)
+	if queue = queuedPrompts(session); len(queue) != 1 || queue[0].Text != "second" {
+		t.Errorf("queue after send and drop = %v", queueIDs(queue))
+	}
+	if !hasQueuedPrompts(session) || len(queuedSessions()) != 1 {
+		t.Error("session should still have a queued prompt")
+	}
+}
+
+func TestParseKeySpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{"keys", []string{"Down", "Down", "Enter"}, false},
+		{"ctrl", []string{"C-c"}, false},
+		{"empty", nil, true},
+		{"flag", []string{"-t", "other"}, true},
+		{"too many", make([]string, maxRelayKeys+1), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseKeySpec(tt.args); (err != nil) != tt.wantErr {
+				t.Errorf("parseKeySpec(%v) error = %v, wantErr %v", tt.args, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPaneTail(t *testing.T) {
+	content := "one\n\ntwo   \nthree\n\n"
+	if got := paneTail(content, 2); got != "two\nthree" {
+		t.Errorf("paneTail() = %q, want %q", got, "two\nthree")
+	}
+	if got := paneTail(content, 10); got != "one\ntwo\nthree" {
+		t.Errorf("paneTail() = %q", got)
+	}
+}
+
+func TestParseANSI(t *testing.T) {
+	raw := "\x1b[1;31mred\x1b[0m plain\x1b]8;;http://x\x07link\x1b]8;;\x07\n\x1b[38;5;21mblue\x1b[7mrev\x1b[27m\n\n"
+	lines := parseANSI(raw)
+	if len(lines) != 2 {
+		t.Fatalf("parseANSI returned %d lines, want 2", len(lines))
+	}
+	if got := cellText(lines[0]); got != "red plainlink" {
+		t.Errorf("line 0 = %q, want %q", got, "red plainlink")
+	}
+	if c := lines[0][0]; c.FG != ansiPalette[1] || !c.Bold {
+		t.Errorf("first cell = %+v, want bold red", c)
+	}
+	if c := lines[0][3]; c.FG != screenDefaultFG || c.Bold {
+		t.Errorf("cell after reset = %+v, want default style", c)
+	}
+	if c := lines[1][0]; c.FG != xterm256(21) {
+		t.Errorf("256-color cell FG = %v, want %v", c.FG, xterm256(21))
+	}
+	if c := lines[1][4]; c.BG != xterm256(21) {
+		t.Errorf("reverse cell BG = %v, want %v", c.BG, xterm256(21))
+	}
+	if got := stripANSI(raw); got != "red plainlink\nbluerev" {
+		t.Errorf("stripANSI() = %q", got)
+	}
+}
+
+func TestRenderScreenPNG(t *testing.T) {
+	data, err := renderScreenPNG(parseANSI("╭──╮\n│❯ hi\n"))
+	if err != nil {
+		t.Fatalf("renderScreenPNG failed: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("invalid PNG: %v", err)
+	}
+	b := img.Bounds()
+	if b.Dx() != 5*screenFontWidth*screenPNGScale || b.Dy() != 2*screenFontHeight*screenPNGScale {
+		t.Errorf("image size = %dx%d", b.Dx(), b.Dy())
+	}
+}
+
+// Pane fixtures for the dialogs Claude shows in its TUI
+const (
+	permissionDialogPane = `⏺ Bash(rm -rf build)
+
+╭──────────────────────────────────────────────────────────╮
+│ Bash command                                             │
+│                                                          │
+│   rm -rf build                                           │
+│   Remove build directory                                 │
+│                                                          │
+│ Do you want to proceed?                                  │
+│ ❯ 1. Yes                                                 │
+│   2. Yes, and don't ask again for rm commands in /proj   │
+│   3. No, and tell Claude what to do differently (esc)    │
+╰──────────────────────────────────────────────────────────╯
+`
+	trustDialogPane = `────────────────────────────────────────────────────────────
+ Do you trust the files in this folder?
+
+ /home/me/proj
+
+ Claude Code may read, write, or execute files contained in
+ this directory.
+
+ ❯ 1. Yes, proceed
+   2. No, exit
+
+ Enter to confirm · Esc to exit
+`
+	planDialogPane = `╭──────────────────────────────────────────────╮
+│ Ready to code?                               │
+│                                              │
+│ Here is Claude's plan:                       │
+│   1. Add the endpoint                        │
+│   2. Write tests                             │
+│                                              │
+│ Would you like to proceed?                   │
+│                                              │
+│ ❯ 1. Yes, and auto-accept edits              │
+│   2. Yes, and manually approve edits         │
+│   3. No, keep planning                       │
+╰──────────────────────────────────────────────╯
+`
+	outputQuestionPane = `⏺ Here is what I found.
+  Would you like to proceed? The options are:
+  1. Refactor first
+  2. Ship as is
+
+╭──────────────────────────────────────────────╮
+│ >                                            │
+╰──────────────────────────────────────────────╯
+  ? for shortcuts
+`
+	idlePane = `⏺ Done. The tests pass.
+
+╭──────────────────────────────────────────────╮
+│ > Do you want to proceed?                     │
+╰──────────────────────────────────────────────╯
+  ? for shortcuts
+`
+)
+
+func TestDetectPaneDialog(t *testing.T) {
+	tests := []struct {
+		name     string
+		pane     string
+		kind     string
+		options  []string
+		textHas  string
+		selected int
+	}{
+		{"permission", permissionDialogPane, dialogPermission,
+			[]string{"Yes", "Yes, and don't ask again for rm commands in /proj", "No, and tell Claude what to do differently (esc)"},
+			"rm -rf build", 0},
+		{"trust", trustDialogPane, dialogTrust, []string{"Yes, proceed", "No, exit"}, "/home/me/proj", 0},
+		{"plan", planDialogPane, dialogPlan,
+			[]string{"Yes, and auto-accept edits", "Yes, and manually approve edits", "No, keep planning"},
+			"Here is Claude's plan:", 0},
+		{"typed prompt is not a dialog", idlePane, "", nil, "", 0},
+		{"question in Claude's output", outputQuestionPane, "", nil, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := detectPaneDialog(tt.pane)
+			if tt.kind == "" {
+				if d != nil {
+					t.Fatalf("detectPaneDialog() = %+v, want nil", d)
+				}
+				return
+			}
+			if d == nil {
+				t.Fatal("detectPaneDialog() = nil")
+			}
+			if d.Kind != tt.kind {
+				t.Errorf("Kind = %q, want %q", d.Kind, tt.kind)
+			}
+			if strings.Join(d.Options, "|") != strings.Join(tt.options, "|") {
+				t.Errorf("Options = %q, want %q", d.Options, tt.options)
+			}
+			if !strings.Contains(d.Text, tt.textHas) {
+				t.Errorf("Text = %q, want it to contain %q", d.Text, tt.textHas)
+			}
+			if d.Selected != tt.selected {
+				t.Errorf("Selected = %d, want %d", d.Selected, tt.selected)
+			}
+		})
+	}
+}
+
+func TestDialogKeys(t *testing.T) {
+	d := &paneDialog{Options: []string{"a", "b", "c"}, Selected: 1}
+	if got := strings.Join(dialogKeys(d, 2), " "); got != "Down Enter" {
+		t.Errorf("dialogKeys(2) = %q", got)
+	}
+	if got := strings.Join(dialogKeys(d, 0), " "); got != "Up Enter" {
+		t.Errorf("dialogKeys(0) = %q", got)
+	}
+	if got := strings.Join(dialogKeys(d, 1), " "); got != "Enter" {
+		t.Errorf("dialogKeys(1) = %q", got)
+	}
+}
+
+func TestIPC(t *testing.T) {
+	origSocket, origGrant := ipcSocketPath, otpGrantPrefix
+	dir := t.TempDir()
+	ipcSocketPath = filepath.Join(dir, "ipc", "ccc.sock")
+	otpGrantPrefix = filepath.Join(dir, "otp-grant-")
+	defer func() { ipcSocketPath, otpGrantPrefix, ipcState = origSocket, origGrant, nil }()
+
+	if err := startIPCServer(); err != nil {
+		t.Fatalf("startIPCServer: %v", err)
+	}
+	// Only the user can reach the socket
+	if fi, err := os.Stat(filepath.Dir(ipcSocketPath)); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("socket directory = %v, %v", fi, err)
+	}
+
+	// Flags set by a hook are seen by the listener
+	if err := ipcCall("set_state", ipcStateParams{State: stateGrant, Name: "ipc-test", On: true}, nil, time.Second); err != nil {
+		t.Fatalf("set_state: %v", err)
+	}
+	var st ipcStateResult
+	if err := ipcCall("get_state", ipcStateParams{State: stateGrant, Name: "ipc-test"}, &st, time.Second); err != nil || !st.On {
+		t.Errorf("get_state = %+v, %v; want on", st, err)
+	}
+	if !hasValidOTPGrant("ipc-test") {
+		t.Error("listener doesn't see the grant set over the socket")
+	}
+	if err := ipcCall("bogus", nil, nil, time.Second); err == nil {
+		t.Error("unknown method: want error")
+	}
+
+	// A decision reaches the hook blocked on wait_decision
+	req := &OTPPermissionRequest{ID: "ipc1", SessionName: "alpha", Timestamp: time.Now().Unix()}
+	if err := ipcCall("request_permission", req, nil, time.Second); err != nil {
+		t.Fatalf("request_permission: %v", err)
+	}
+	if got := findPendingOTPRequest("alpha"); got == nil || got.ID != "ipc1" {
+		t.Fatalf("pending request = %+v, want ipc1", got)
+	}
+	done := make(chan *OTPPermissionResponse)
+	go func() {
+		resp, _ := waitForOTPResponse(req, "other-window", 5*time.Second)
+		done <- resp
+	}()
+	writeOTPResponse("ipc1", true, "button", "alice")
+	select {
+	case resp := <-done:
+		if resp == nil || !resp.Approved || resp.By != "alice" {
+			t.Errorf("decision = %+v, want approved by alice", resp)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("hook not woken by the decision")
+	}
+	if got := findPendingOTPRequest("alpha"); got != nil {
+		t.Errorf("decided request still pending: %+v", got)
+	}
+
+	// Undecided requests time out; a grant for the window answers them
+	ipcCall("request_permission", &OTPPermissionRequest{ID: "ipc2", Timestamp: time.Now().Unix()}, nil, time.Second)
+	if _, err := waitForOTPResponse(&OTPPermissionRequest{ID: "ipc2"}, "other-window", 50*time.Millisecond); err == nil {
+		t.Error("want timeout")
+	}
+	ipcCall("request_permission", &OTPPermissionRequest{ID: "ipc3", Timestamp: time.Now().Unix()}, nil, time.Second)
+	if resp, err := waitForOTPResponse(&OTPPermissionRequest{ID: "ipc3"}, "ipc-test", time.Second); err != nil || resp.Via != "grant" {
+		t.Errorf("grant: got %+v, %v; want approved via grant", resp, err)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	config := &Config{
+		ChatID: 1,
+		Users: map[int64]*UserInfo{
+			2: {Role: roleOperator, Sessions: []string{"api"}},
+			3: {Role: roleViewer},
+			4: {Role: "bogus"},
+			6: {Role: roleApprover},
+		},
+	}
+	tests := []struct {
+		name     string
+		userID   int64
+		minRole  string
+		sessName string
+		expected bool
+	}{
+		{"owner anything", 1, roleOwner, "web", true},
+		{"operator own session", 2, roleOperator, "api", true},
+		{"operator other session", 2, roleOperator, "web", false},
+		{"operator no session", 2, roleViewer, "", true},
+		{"operator cannot approve", 2, roleApprover, "api", false},
+		{"approver cannot prompt", 6, roleOperator, "api", false},
+		{"approver can approve", 6, roleApprover, "api", true},
+		{"operator not owner", 2, roleOwner, "", false},
+		{"viewer can view", 3, roleViewer, "web", true},
+		{"viewer cannot approve", 3, roleApprover, "web", false},
+		{"invalid role", 4, roleViewer, "", false},
+		{"stranger", 5, roleViewer, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := authorize(config, tt.userID, tt.minRole, tt.sessName); result != tt.expected {
+				t.Errorf("authorize(%d, %s, %q) = %v, want %v", tt.userID, tt.minRole, tt.sessName, result, tt.expected)
+			}
+		})
+	}
+
+	// /list only shows the sessions a user may act on
+	config.Sessions = map[string]*SessionInfo{"api": {}, "web": {}}
+	if text, buttons := buildSessionList(config, 2); !strings.Contains(text, "api") || strings.Contains(text, "web") || len(buttons) != 1 {
+		t.Errorf("operator's list = %q, %d rows", text, len(buttons))
+	}
+	if text, _ := buildSessionList(config, 1); !strings.Contains(text, "api") || !strings.Contains(text, "web") {
+		t.Errorf("owner's list = %q", text)
+	}
+}
+
+func TestCommandRole(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"/c ls", roleOwner},
+		{"/new", roleOperator},
+		{"/new myproject", roleOwner},
+		{"/list", roleViewer},
+		{"/stop", roleOperator},
+		{"/queue drop 2", roleOperator},
+		{"/unknown", roleOperator},
+	}
+
+	for _, tt := range tests {
+		if result := commandRole(tt.text); result != tt.expected {
+			t.Errorf("commandRole(%q) = %q, want %q", tt.text, result, tt.expected)
+		}
+	}
+}
+
 // Helper function
 func contains(s, substr string) bool {
 	return len(s) >= len(substr) && (s == substr || len(substr) == 0 ||
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -20,18 +21,25 @@ var otpGrantPrefix = filepath.Join(cacheDir(), "otp-grant-")
 const otpGrantDuration = 5 * time.Minute
 const otpPermissionTimeout = 5 * time.Minute
 
-// OTPPermissionRequest is written by the hook to request OTP approval
+// OTPPermissionRequest is written by the hook to request approval.
+// Files are keyed by ID, so parallel requests from any session never collide.
 type OTPPermissionRequest struct {
+	ID          string `json:"id"`
 	SessionName string `json:"session_name"`
 	ToolName    string `json:"tool_name"`
 	ToolInput   string `json:"tool_input"`
+	Message     string `json:"message"`          // text of the Telegram request message
+	MsgID       int64  `json:"msg_id,omitempty"`   // Telegram message carrying the buttons
+	TopicID     int64  `json:"topic_id,omitempty"` // topic the listener posts the request to
 	Timestamp   int64  `json:"timestamp"`
 }
 
-// OTPPermissionResponse is written by the listener after OTP validation
+// OTPPermissionResponse is written by the listener once a request is decided
 type OTPPermissionResponse struct {
-	Approved bool  `json:"approved"`
-	Timestamp int64 `json:"timestamp"`
+	Approved  bool   `json:"approved"`
+	Via       string `json:"via,omitempty"` // button / otp / grant
+	By        string `json:"by,omitempty"`  // Telegram user who decided
+	Timestamp int64  `json:"timestamp"`
 }
 
 // generateOTPSecret creates a new TOTP secret and returns the provisioning URI
@@ -81,64 +89,88 @@ func setupOTP(config *Config) (string, error) {
 	return msg, nil
 }
 
-// writeOTPRequest writes a permission request file for the listener to pick up
-func writeOTPRequest(sessionID string, req *OTPPermissionRequest) error {
+// writeOTPRequestFile writes a permission request file for the listener to pick up
+func writeOTPRequestFile(req *OTPPermissionRequest) error {
 	data, err := json.Marshal(req)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(otpRequestPrefix+sessionID, data, 0600)
+	return os.WriteFile(otpRequestPrefix+req.ID, data, 0600)
 }
 
-// writeOTPResponse writes a permission response file for the hook to read
-func writeOTPResponse(sessionID string, approved bool) error {
+// writeOTPResponse answers a permission request: directly to the hook waiting
+// on the socket, or as a response file for a hook polling for it
+func writeOTPResponse(reqID string, approved bool, via string, by string) error {
 	resp := OTPPermissionResponse{
 		Approved:  approved,
+		Via:       via,
+		By:        by,
 		Timestamp: time.Now().Unix(),
 	}
+	if ipcState != nil && ipcState.decide(reqID, &resp) {
+		return nil
+	}
 	data, err := json.Marshal(resp)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(otpResponsePrefix+sessionID, data, 0600)
+	return os.WriteFile(otpResponsePrefix+reqID, data, 0600)
 }
 
-// waitForOTPResponse waits for the listener to write a response file.
-// It also checks for a valid grant (written by another parallel hook that was approved first).
-func waitForOTPResponse(sessionID, tmuxName string, timeout time.Duration) (bool, error) {
-	responsePath := otpResponsePrefix + sessionID
+// waitForOTPResponse blocks until the listener decides a request or a valid
+// grant (another request approved for 5 min) covers the window. Without the
+// socket it polls for a response file instead.
+func waitForOTPResponse(req *OTPPermissionRequest, tmuxName string, timeout time.Duration) (*OTPPermissionResponse, error) {
 	deadline := time.Now().Add(timeout)
 
+	var resp OTPPermissionResponse
+	params := ipcWaitParams{ID: req.ID, TmuxName: tmuxName, TimeoutMS: timeout.Milliseconds()}
+	err := ipcCall("wait_decision", params, &resp, timeout+ipcCallTimeout)
+	if err == nil {
+		return &resp, nil
+	}
+	if ierr, ok := err.(*ipcError); ok && ierr.Msg == ipcErrTimeout {
+		return nil, fmt.Errorf("OTP timeout")
+	}
+	// The listener is gone or never saw the request: hand it over as a file,
+	// which a restarted listener also picks up
+	writeOTPRequestFile(req)
+
+	responsePath := otpResponsePrefix + req.ID
 	for time.Now().Before(deadline) {
-		// Check if another parallel hook already got approved and wrote a grant
 		if hasValidOTPGrant(tmuxName) {
-			os.Remove(otpRequestPrefix + sessionID)
-			return true, nil
+			os.Remove(otpRequestPrefix + req.ID)
+			return &OTPPermissionResponse{Approved: true, Via: "grant", Timestamp: time.Now().Unix()}, nil
 		}
 
 		data, err := os.ReadFile(responsePath)
 		if err == nil {
 			// Clean up files
 			os.Remove(responsePath)
-			os.Remove(otpRequestPrefix + sessionID)
+			os.Remove(otpRequestPrefix + req.ID)
 
 			var resp OTPPermissionResponse
 			if err := json.Unmarshal(data, &resp); err != nil {
-				return false, err
+				return nil, err
 			}
-			return resp.Approved, nil
+			return &resp, nil
 		}
 		time.Sleep(500 * time.Millisecond)
 	}
 
 	// Clean up on timeout
-	os.Remove(otpRequestPrefix + sessionID)
-	return false, fmt.Errorf("OTP timeout")
+	os.Remove(otpRequestPrefix + req.ID)
+	return nil, fmt.Errorf("OTP timeout")
 }
 
-// getPendingOTPRequest reads a pending OTP request for a session
-func getPendingOTPRequest(sessionID string) (*OTPPermissionRequest, error) {
-	data, err := os.ReadFile(otpRequestPrefix + sessionID)
+// getPendingOTPRequest returns a pending permission request by ID
+func getPendingOTPRequest(reqID string) (*OTPPermissionRequest, error) {
+	if ipcState != nil {
+		if req := ipcState.request(reqID); req != nil {
+			return req, nil
+		}
+	}
+	data, err := os.ReadFile(otpRequestPrefix + reqID)
 	if err != nil {
 		return nil, err
 	}
@@ -146,32 +178,73 @@ func getPendingOTPRequest(sessionID string) (*OTPPermissionRequest, error) {
 	if err := json.Unmarshal(data, &req); err != nil {
 		return nil, err
 	}
+	if req.ID == "" {
+		req.ID = reqID
+	}
 	return &req, nil
 }
 
-// findPendingOTPSession finds which session has a pending OTP request
-func findPendingOTPSession() string {
+// pendingOTPRequests returns all unexpired permission requests, oldest first
+func pendingOTPRequests() []*OTPPermissionRequest {
 	matches, err := filepath.Glob(otpRequestPrefix + "*")
-	if err != nil || len(matches) == 0 {
-		return ""
+	if err != nil {
+		return nil
+	}
+	var reqs []*OTPPermissionRequest
+	if ipcState != nil {
+		for _, req := range ipcState.requestList() {
+			if time.Since(time.Unix(req.Timestamp, 0)) <= otpPermissionTimeout {
+				reqs = append(reqs, req)
+			}
+		}
 	}
 	for _, match := range matches {
-		sessionID := strings.TrimPrefix(match, otpRequestPrefix)
-		return sessionID
+		req, err := getPendingOTPRequest(strings.TrimPrefix(match, otpRequestPrefix))
+		if err != nil || time.Since(time.Unix(req.Timestamp, 0)) > otpPermissionTimeout {
+			continue
+		}
+		reqs = append(reqs, req)
 	}
-	return ""
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].Timestamp < reqs[j].Timestamp })
+	return reqs
+}
+
+// findPendingOTPRequest returns the newest pending request for a session.
+// With no session (e.g. a code sent in the private chat) it only matches when
+// exactly one request is pending, so a code can never approve the wrong session.
+func findPendingOTPRequest(sessName string) *OTPPermissionRequest {
+	reqs := pendingOTPRequests()
+	if sessName == "" {
+		if len(reqs) == 1 {
+			return reqs[0]
+		}
+		return nil
+	}
+	for i := len(reqs) - 1; i >= 0; i-- {
+		if reqs[i].SessionName == sessName {
+			return reqs[i]
+		}
+	}
+	return nil
+}
+
+// hasPendingOTPRequestFor reports whether a session is waiting for a permission decision
+func hasPendingOTPRequestFor(sessName string) bool {
+	for _, req := range pendingOTPRequests() {
+		if req.SessionName == sessName {
+			return true
+		}
+	}
+	return false
 }
 
 // hasValidOTPGrant checks if there's a valid (non-expired) OTP grant for a tmux session
 func hasValidOTPGrant(tmuxName string) bool {
-	info, err := os.Stat(otpGrantPrefix + tmuxName)
-	if err != nil {
-		return false
-	}
-	return time.Since(info.ModTime()) < otpGrantDuration
+	since, ok := stateSince(stateGrant, tmuxName)
+	return ok && time.Since(since) < otpGrantDuration
 }
 
-// writeOTPGrant creates/refreshes a grant file for a tmux session
+// writeOTPGrant creates/refreshes the grant for a tmux session
 func writeOTPGrant(tmuxName string) {
-	os.WriteFile(otpGrantPrefix+tmuxName, []byte("1"), 0600)
+	setState(stateGrant, tmuxName, true)
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// TodoItem is one task of Claude's TodoWrite list
+type TodoItem struct {
+	Content    string `json:"content"`
+	Status     string `json:"status"` // pending / in_progress / completed
+	ActiveForm string `json:"activeForm,omitempty"`
+}
+
+// formatPlanHTML renders a todo list as the topic's plan message
+func formatPlanHTML(todos []TodoItem) string {
+	done := 0
+	for _, t := range todos {
+		if t.Status == "completed" {
+			done++
+		}
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("📋 <b>Plan</b> (%d/%d)", done, len(todos)))
+	for _, t := range todos {
+		switch t.Status {
+		case "completed":
+			sb.WriteString("\n✅ <s>" + htmlEscape(t.Content) + "</s>")
+		case "in_progress":
+			text := t.ActiveForm
+			if text == "" {
+				text = t.Content
+			}
+			sb.WriteString("\n⏳ <b>" + htmlEscape(text) + "</b>")
+		default:
+			sb.WriteString("\n☐ " + htmlEscape(t.Content))
+		}
+	}
+	return sb.String()
+}
+
+// updatePlan shows a todo list recorded by the PreToolUse hook: the topic's
+// plan message is edited, or sent and pinned if the prompt has none yet
+func updatePlan(config *Config, sessName string, topicID int64, rec *MessageRecord) (int64, error) {
+	var todos []TodoItem
+	if json.Unmarshal([]byte(rec.Text), &todos) != nil {
+		return 0, nil
+	}
+	html := formatPlanHTML(todos)
+
+	if msgID := loadPlanMessage(sessName); msgID != 0 {
+		err := editMessageHTML(config, config.GroupID, msgID, topicID, html)
+		if err == nil {
+			return msgID, nil
+		}
+		if !strings.Contains(err.Error(), "message to edit not found") {
+			return 0, err
+		}
+		// The plan was deleted in Telegram: start a new one
+	}
+
+	msgID, err := sendMessageHTMLGetID(config, config.GroupID, topicID, html)
+	if err != nil {
+		return 0, err
+	}
+	if err := pinChatMessage(config, msgID); err != nil {
+		listenLog("updatePlan: %v", err) // the bot may lack the pin permission
+	}
+	savePlanMessage(sessName, msgID)
+	return msgID, nil
+}
+
+// resetPlan unpins a session's plan when a new prompt starts, so the prompt's
+// first TodoWrite gets a fresh one
+func resetPlan(config *Config, sessName string) {
+	msgID := loadPlanMessage(sessName)
+	if msgID == 0 {
+		return
+	}
+	unpinChatMessage(config, msgID)
+	savePlanMessage(sessName, 0)
+}
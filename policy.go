@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Policy actions
+const (
+	policyAllow = "allow"
+	policyDeny  = "deny"
+	policyAsk   = "ask"
+)
+
+// PolicyRule matches a tool call; all set fields must match. The first
+// matching rule decides, session rules before global ones.
+type PolicyRule struct {
+	Name           string   `json:"name,omitempty"`
+	Action         string   `json:"action"`                    // allow / deny / ask
+	Tools          []string `json:"tools,omitempty"`           // tool name globs, e.g. "Read", "mcp__*"
+	Command        string   `json:"command,omitempty"`         // regex matched against the Bash command
+	Paths          []string `json:"paths,omitempty"`           // globs for file_path/path; ** spans dirs, ~ and $PROJECT expand
+	Sessions       []string `json:"sessions,omitempty"`        // session names (global file only)
+	OutsideProject bool     `json:"outside_project,omitempty"` // path (or a Bash path argument) lies outside the project
+
+	commandRe *regexp.Regexp
+}
+
+// Policy is the content of a policy file
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyMatch is the rule that decided a tool call
+type PolicyMatch struct {
+	Action string
+	Rule   string
+	Source string // policy file the rule came from
+}
+
+// policyCall is the part of a tool call that rules are matched against
+type policyCall struct {
+	Tool       string
+	Command    string
+	Path       string
+	Session    string
+	ProjectDir string
+}
+
+// globalPolicyPath returns ~/.config/ccc/policy.json
+func globalPolicyPath() string {
+	return filepath.Join(configDir(), "policy.json")
+}
+
+// sessionPolicyPath returns ~/.config/ccc/policies/<session>.json. Per-session
+// policies live in the config dir, not the project, so Claude can't edit them.
+func sessionPolicyPath(sessName string) string {
+	return filepath.Join(configDir(), "policies", sessName+".json")
+}
+
+// loadPolicyFile reads and compiles a policy file. A missing file is an empty policy.
+func loadPolicyFile(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Policy{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range policy.Rules {
+		if err := policy.Rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %w", path, i+1, err)
+		}
+	}
+	return &policy, nil
+}
+
+// compile validates a rule and prepares its regexes
+func (r *PolicyRule) compile() error {
+	switch r.Action {
+	case policyAllow, policyDeny, policyAsk:
+	default:
+		return fmt.Errorf("invalid action %q (want allow, deny or ask)", r.Action)
+	}
+	if r.Command != "" {
+		re, err := regexp.Compile(r.Command)
+		if err != nil {
+			return fmt.Errorf("invalid command regex: %w", err)
+		}
+		r.commandRe = re
+	}
+	return nil
+}
+
+// label returns the rule name for logs
+func (r *PolicyRule) label(index int) string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return fmt.Sprintf("rule %d", index+1)
+}
+
+// matches reports whether the rule applies to a call
+func (r *PolicyRule) matches(call policyCall) bool {
+	if len(r.Sessions) > 0 && !containsString(r.Sessions, call.Session) {
+		return false
+	}
+	if len(r.Tools) > 0 {
+		matched := false
+		for _, t := range r.Tools {
+			if ok, _ := filepath.Match(t, call.Tool); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.commandRe != nil && (call.Command == "" || !r.commandRe.MatchString(call.Command)) {
+		return false
+	}
+	if len(r.Paths) > 0 {
+		if call.Path == "" {
+			return false
+		}
+		matched := false
+		for _, p := range r.Paths {
+			if globToRegexp(expandPolicyPath(p, call.ProjectDir)).MatchString(call.Path) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.OutsideProject && !touchesOutsideProject(call) {
+		return false
+	}
+	return true
+}
+
+// evaluatePolicy finds the first rule matching a call, checking the session
+// policy before the global one. Returns nil if no rule matches. A file that
+// fails to load is reported in err and skipped, so the other still applies;
+// use failClosed to decide such calls.
+func evaluatePolicy(call policyCall) (*PolicyMatch, error) {
+	var paths []string
+	if call.Session != "" {
+		paths = append(paths, sessionPolicyPath(call.Session))
+	}
+	paths = append(paths, globalPolicyPath())
+
+	var errs []error
+	for _, path := range paths {
+		policy, err := loadPolicyFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for i := range policy.Rules {
+			if policy.Rules[i].matches(call) {
+				return &PolicyMatch{Action: policy.Rules[i].Action, Rule: policy.Rules[i].label(i), Source: path}, errors.Join(errs...)
+			}
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// policyErrorRule names the match failClosed makes up
+const policyErrorRule = "policy file error"
+
+// failClosed decides a call when a policy file couldn't be loaded: a deny
+// still applies, anything else needs approval, since the broken file may
+// hold the rule that denies it
+func failClosed(match *PolicyMatch, err error) *PolicyMatch {
+	if err == nil || (match != nil && match.Action == policyDeny) {
+		return match
+	}
+	return &PolicyMatch{Action: policyAsk, Rule: policyErrorRule, Source: err.Error()}
+}
+
+// newPolicyCall extracts the matchable fields of a hook's tool call
+func newPolicyCall(config *Config, hookData HookData, sessName string) policyCall {
+	call := policyCall{
+		Tool:       hookData.ToolName,
+		Command:    hookData.ToolInput.Command,
+		Path:       hookData.ToolInput.FilePath,
+		Session:    sessName,
+		ProjectDir: hookData.Cwd,
+	}
+	if call.Path == "" {
+		call.Path = hookData.ToolInput.Path
+	}
+	if info := config.Sessions[sessName]; info != nil && info.Path != "" {
+		call.ProjectDir = info.Path
+	}
+	if call.Path != "" && !filepath.IsAbs(call.Path) && call.ProjectDir != "" {
+		call.Path = filepath.Join(call.ProjectDir, call.Path)
+	}
+	return call
+}
+
+// expandPolicyPath expands ~ and $PROJECT in a rule path
+func expandPolicyPath(p string, projectDir string) string {
+	p = strings.ReplaceAll(p, "$PROJECT", projectDir)
+	return expandPath(p)
+}
+
+// globToRegexp converts a path glob to an anchored regexp: ** matches across
+// directories, * and ? stay within one path segment
+func globToRegexp(glob string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				sb.WriteString(".*")
+				i++
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+// touchesOutsideProject reports whether a call's file path, or any absolute,
+// ~ or .. path argument of a Bash command, lies outside the project directory
+func touchesOutsideProject(call policyCall) bool {
+	if call.ProjectDir == "" {
+		return false
+	}
+	var paths []string
+	if call.Path != "" {
+		paths = append(paths, call.Path)
+	}
+	for _, arg := range strings.Fields(call.Command) {
+		arg = strings.Trim(arg, `"';`)
+		if strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, "~") || strings.HasPrefix(arg, "..") {
+			if strings.HasPrefix(arg, "..") {
+				arg = filepath.Join(call.ProjectDir, arg)
+			} else if arg == "~" {
+				arg = "~/"
+			}
+			paths = append(paths, expandPath(arg))
+		}
+	}
+	project := filepath.Clean(call.ProjectDir)
+	for _, p := range paths {
+		p = filepath.Clean(p)
+		if p != project && !strings.HasPrefix(p, project+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// policyFiles lists the per-session policy files
+func policyFiles() []string {
+	matches, _ := filepath.Glob(filepath.Join(configDir(), "policies", "*.json"))
+	return matches
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// applyPolicy evaluates the policy for a PreToolUse hook and writes the
+// decision. Returns true if a rule decided (the hook is done), false to fall
+// through to the permission mode. ask goes to Telegram approval when the
+// session is driven from Telegram, otherwise to Claude's own prompt.
+func applyPolicy(config *Config, hookData HookData, sessName string, topicID int64, toolDesc, inputStr string) bool {
+	match, err := evaluatePolicy(newPolicyCall(config, hookData, sessName))
+	if err != nil {
+		hookLog("policy: %v", err)
+	}
+	match = failClosed(match, err)
+	if match == nil {
+		return false
+	}
+	logEvent(sessName, "policy", "hook-permission", match.Rule, fmt.Sprintf("%s %s: %s", match.Action, hookData.ToolName, inputStr))
+	hookLog("policy: %s %s by %q (%s)", match.Action, hookData.ToolName, match.Rule, match.Source)
+
+	reason := fmt.Sprintf("Policy rule %q", match.Rule)
+	if match.Rule == policyErrorRule {
+		reason = fmt.Sprintf("Policy file error (%v)", err)
+	}
+	switch match.Action {
+	case policyAllow:
+		outputPermissionDecision("allow", reason)
+	case policyDeny:
+		outputPermissionDecision("deny", reason)
+	case policyAsk:
+		tmuxName := tmuxSafeName(sessName)
+		if !isTelegramActive(tmuxName, otpGrantDuration) || topicID == 0 {
+			outputPermissionDecision("ask", reason)
+			return true
+		}
+		resp, err := requestRemotePermission(config, sessName, topicID, hookData.ToolName, toolDesc, inputStr)
+		if err != nil {
+			outputPermissionDecision("deny", reason+": approval timed out")
+		} else if resp.Approved {
+			outputPermissionDecision("allow", reason+": approved via Telegram ("+resp.Via+")")
+		} else {
+			outputPermissionDecision("deny", reason+": denied via Telegram")
+		}
+	}
+	return true
+}
+
+// policyTest dry-runs the policy against hook JSON (ccc policy test '<json>')
+func policyTest(rawJSON string) error {
+	hookData, err := parseHookData([]byte(rawJSON))
+	if err != nil {
+		return fmt.Errorf("invalid hook JSON: %w", err)
+	}
+	config, err := loadConfig()
+	if err != nil {
+		config = &Config{Sessions: make(map[string]*SessionInfo)}
+	}
+	sessName, _ := findSession(config, hookData.Cwd, hookData.SessionID)
+
+	call := newPolicyCall(config, hookData, sessName)
+	fmt.Printf("tool:    %s\n", call.Tool)
+	if call.Command != "" {
+		fmt.Printf("command: %s\n", call.Command)
+	}
+	if call.Path != "" {
+		fmt.Printf("path:    %s\n", call.Path)
+	}
+	fmt.Printf("session: %s\n", sessName)
+	fmt.Printf("project: %s\n\n", call.ProjectDir)
+
+	match, err := evaluatePolicy(call)
+	if err != nil {
+		fmt.Printf("⚠️  %v\n\n", err)
+	}
+	match = failClosed(match, err)
+	if match == nil {
+		fmt.Printf("No rule matched → permission mode applies (%s)\n", permissionMode(config))
+		return nil
+	}
+	fmt.Printf("%s ← %q (%s)\n", match.Action, match.Rule, match.Source)
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Message states in the messages table. Telegram prompts that arrive while
+// Claude is busy are queued and sent one per turn instead of being typed
+// into a working TUI. Messages Telegram keeps rejecting end up failed until
+// they are retried or dropped (see deadletter.go).
+const (
+	msgStateQueued  = "queued"
+	msgStateDropped = "dropped"
+	msgStateFailed  = "failed"
+)
+
+// enqueueTopicPrompt queues a Telegram prompt for a busy session and tells
+// the topic its position
+func enqueueTopicPrompt(config *Config, sessName string, rec *MessageRecord, chatID int64, threadID int64) {
+	pos, err := queuePrompt(rec)
+	if err != nil {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to queue: %v", err))
+		return
+	}
+	listenLog("[queue] %s queued %s at #%d", sessName, rec.ID, pos)
+	logEvent(sessName, "prompt_queued", "listener", rec.ID, fmt.Sprintf("pos=%d", pos))
+	notice := fmt.Sprintf("⏳ Claude is busy — queued (#%d)\n/queue to manage, /now to send it right away", pos)
+	if msgID, err := sendMessageGetID(config, chatID, threadID, notice); err == nil {
+		setQueueNotice(rec.ID, msgID)
+	}
+}
+
+// sessionTarget returns the tmux target of a running session
+func sessionTarget(config *Config, sessName string) (string, error) {
+	tmuxName := tmuxSafeName(sessName)
+	windowID := getWindowID(config, sessName)
+	if !tmuxWindowExistsByID(windowID, tmuxName) {
+		return "", fmt.Errorf("session '%s' is not running", sessName)
+	}
+	return tmuxTargetByID(windowID, tmuxName), nil
+}
+
+// injectPrompt types a Telegram prompt into a session's Claude pane
+func injectPrompt(config *Config, sessName string, text string) error {
+	target, err := sessionTarget(config, sessName)
+	if err != nil {
+		return err
+	}
+	tmuxName := tmuxSafeName(sessName)
+	listenLog("sendToTmux: target=%s window=%s", target, tmuxName)
+
+	// Close the previous turn's tool blockquote so new tool calls start fresh
+	if info := config.Sessions[sessName]; info != nil {
+		endToolMessage(config, sessName, info.TopicID)
+	}
+	// Busy from now on, so the next message queues even before the prompt hook fires
+	setThinking(sessName)
+	return sendToTmuxFromTelegram(target, tmuxName, text)
+}
+
+// sendQueuedPrompt takes a prompt off the queue and injects it. A session
+// that isn't running keeps its queue.
+func sendQueuedPrompt(config *Config, sessName string, rec *MessageRecord) error {
+	if _, err := sessionTarget(config, sessName); err != nil {
+		return err
+	}
+	if !setQueuedState(rec.ID, "") {
+		return fmt.Errorf("no longer queued")
+	}
+	if err := injectPrompt(config, sessName, rec.Text); err != nil {
+		return err
+	}
+	logEvent(sessName, "prompt_dequeued", "listener", rec.ID, truncate(rec.Text, 100))
+	listenLog("[queue] %s sent %s", sessName, rec.ID)
+	if info := config.Sessions[sessName]; info != nil && rec.NoticeMsgID != 0 {
+		editMessage(config, config.GroupID, rec.NoticeMsgID, info.TopicID, "▶️ Sent queued prompt: "+truncateRunes(rec.Text, 60))
+	}
+	return nil
+}
+
+// flushPromptQueues sends the next queued prompt of every session that is no
+// longer busy. Called from deliveryLoop, which the Stop hook and the idle
+// notification wake up.
+func flushPromptQueues(config *Config) {
+	for _, sessName := range queuedSessions() {
+		if config.Sessions[sessName] == nil || isThinking(sessName) {
+			continue
+		}
+		queue := queuedPrompts(sessName)
+		if len(queue) == 0 {
+			continue
+		}
+		if err := sendQueuedPrompt(config, sessName, queue[0]); err != nil {
+			listenLog("[queue] %s: %v", sessName, err)
+		}
+	}
+}
+
+// queueIDs returns the message IDs of a queue
+func queueIDs(queue []*MessageRecord) []string {
+	ids := make([]string, len(queue))
+	for i, rec := range queue {
+		ids[i] = rec.ID
+	}
+	return ids
+}
+
+// formatQueue renders the /queue listing
+func formatQueue(config *Config, sessName string, queue []*MessageRecord) string {
+	if len(queue) == 0 {
+		return fmt.Sprintf("📭 No queued prompts for '%s'", sessName)
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("📋 Queue for '%s'\n\n", sessName))
+	for i, rec := range queue {
+		sb.WriteString(fmt.Sprintf("%d. %s%s\n", i+1, truncateRunes(rec.Text, 80), byline(config, rec.Author)))
+	}
+	sb.WriteString("\n/queue drop <n|all> · /queue move <n> <to> · /now")
+	return sb.String()
+}
+
+// handleQueueCommand implements /queue [drop <n|all> | move <n> <to>], and
+// failed | retry | discard for messages that could not be delivered
+func handleQueueCommand(config *Config, sessName string, chatID int64, threadID int64, args []string) {
+	queue := queuedPrompts(sessName)
+	if len(args) == 0 {
+		text := formatQueue(config, sessName, queue)
+		if n := len(failedMessages(sessName)); n > 0 {
+			text += fmt.Sprintf("\n\n⚠️ %d message(s) not delivered — /queue failed", n)
+		}
+		sendMessage(config, chatID, threadID, text)
+		return
+	}
+	if args[0] == "failed" || args[0] == "retry" || args[0] == "discard" {
+		handleFailedCommand(config, sessName, chatID, threadID, args)
+		return
+	}
+
+	// position parses a 1-based queue position
+	position := func(s string) (int, bool) {
+		n, err := strconv.Atoi(s)
+		return n - 1, err == nil && n >= 1 && n <= len(queue)
+	}
+
+	switch {
+	case args[0] == "drop" && len(args) == 2 && args[1] == "all":
+		for _, rec := range queue {
+			setQueuedState(rec.ID, msgStateDropped)
+		}
+		logEvent(sessName, "queue_cleared", "listener", "", fmt.Sprintf("dropped=%d", len(queue)))
+		sendMessage(config, chatID, threadID, fmt.Sprintf("🗑 Dropped %d queued prompt(s)", len(queue)))
+
+	case args[0] == "drop" && len(args) == 2:
+		i, ok := position(args[1])
+		if !ok {
+			sendMessage(config, chatID, threadID, fmt.Sprintf("❌ No queued prompt #%s", args[1]))
+			return
+		}
+		setQueuedState(queue[i].ID, msgStateDropped)
+		logEvent(sessName, "prompt_dropped", "listener", queue[i].ID, truncate(queue[i].Text, 100))
+		sendMessage(config, chatID, threadID, fmt.Sprintf("🗑 Dropped #%d: %s", i+1, truncateRunes(queue[i].Text, 60)))
+
+	case args[0] == "move" && len(args) == 3:
+		from, ok1 := position(args[1])
+		to, ok2 := position(args[2])
+		if !ok1 || !ok2 {
+			sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Positions must be between 1 and %d", len(queue)))
+			return
+		}
+		rec := queue[from]
+		queue = append(queue[:from], queue[from+1:]...)
+		queue = append(queue[:to], append([]*MessageRecord{rec}, queue[to:]...)...)
+		reorderQueue(queueIDs(queue))
+		sendMessage(config, chatID, threadID, formatQueue(config, sessName, queue))
+
+	default:
+		sendMessage(config, chatID, threadID, "Usage:\n/queue — list queued prompts\n/queue drop <n|all>\n/queue move <n> <to>\n/queue failed — messages not delivered\n/queue retry <n|all>\n/queue discard <n|all>")
+	}
+}
+
+// handleNowCommand implements /now: sends the next queued prompt to Claude
+// even while it is busy (/now <text> skips the queue, see handleUpdate)
+func handleNowCommand(config *Config, sessName string, chatID int64, threadID int64) {
+	queue := queuedPrompts(sessName)
+	if len(queue) == 0 {
+		sendMessage(config, chatID, threadID, "📭 Nothing queued")
+		return
+	}
+	if err := sendQueuedPrompt(config, sessName, queue[0]); err != nil {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to send: %v", err))
+	}
+}
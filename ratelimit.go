@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Telegram flood limits (approximate, per Bot API FAQ): ~30 requests/s overall,
+// ~1 message/s in a private chat and ~20 messages/min in a group, with short
+// bursts tolerated. Every session topic shares the one group's limit. Hitting
+// them returns 429 with parameters.retry_after.
+const (
+	globalSendInterval = 35 * time.Millisecond
+	globalSendBurst    = 30
+	chatSendInterval   = time.Second
+	chatSendBurst      = 20
+	groupSendInterval  = 3 * time.Second
+	groupSendBurst     = 5
+)
+
+// maxInlineFloodWait is the longest a caller blocks waiting for the limiter or
+// a retry_after. Longer waits surface as RateLimitError so callers can reschedule.
+const maxInlineFloodWait = 5 * time.Second
+
+// RateLimitError reports that Telegram flood control is active for a chat
+type RateLimitError struct {
+	RetryAfter  time.Duration
+	Description string
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("telegram error: %s (retry after %v)", e.Description, e.RetryAfter)
+}
+
+// rateBucket paces sends using a virtual scheduling time (GCRA): up to burst
+// sends are allowed immediately, then one per interval.
+type rateBucket struct {
+	interval time.Duration
+	burst    int
+	tat      time.Time // theoretical arrival time of the next send
+}
+
+// delay returns how long a send at now must wait
+func (b *rateBucket) delay(now time.Time) time.Duration {
+	allowAt := b.tat.Add(-time.Duration(b.burst-1) * b.interval)
+	if allowAt.After(now) {
+		return allowAt.Sub(now)
+	}
+	return 0
+}
+
+// take books a send at time at
+func (b *rateBucket) take(at time.Time) {
+	if b.tat.Before(at) {
+		b.tat = at
+	}
+	b.tat = b.tat.Add(b.interval)
+}
+
+// telegramRateLimiter is shared by every Telegram call in the process. Flood
+// deadlines from 429 responses are also persisted to cacheDir so hook processes
+// honor a retry_after seen by the listener (and vice versa).
+type telegramRateLimiter struct {
+	mu      sync.Mutex
+	global  *rateBucket
+	chats   map[string]*rateBucket
+	blocked map[string]time.Time // chat_id -> flood control deadline
+}
+
+var telegramLimiter = &telegramRateLimiter{
+	global:  &rateBucket{interval: globalSendInterval, burst: globalSendBurst},
+	chats:   make(map[string]*rateBucket),
+	blocked: make(map[string]time.Time),
+}
+
+// newChatBucket returns the pacing for a chat: groups (negative chat IDs) get
+// the slower group limit
+func newChatBucket(chatKey string) *rateBucket {
+	if strings.HasPrefix(chatKey, "-") {
+		return &rateBucket{interval: groupSendInterval, burst: groupSendBurst}
+	}
+	return &rateBucket{interval: chatSendInterval, burst: chatSendBurst}
+}
+
+// floodFlag returns the path of the file holding a chat's flood control deadline
+func floodFlag(chatKey string) string {
+	return filepath.Join(cacheDir(), "flood-"+chatKey)
+}
+
+// blockedUntil returns the flood control deadline for a chat (zero if none).
+// Deadlines that have passed are forgotten and their file removed.
+func (l *telegramRateLimiter) blockedUntil(chatKey string) time.Time {
+	now := time.Now()
+	until := l.blocked[chatKey]
+	if !until.After(now) {
+		delete(l.blocked, chatKey)
+	}
+	if data, err := os.ReadFile(floodFlag(chatKey)); err == nil {
+		ms, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if fileUntil := time.UnixMilli(ms); err != nil || !fileUntil.After(now) {
+			os.Remove(floodFlag(chatKey))
+		} else if fileUntil.After(until) {
+			until = fileUntil
+		}
+	}
+	return until
+}
+
+// reserve books a send slot for chatKey ("" for calls not bound to a chat) and
+// returns how long the caller must sleep before sending. If the wait would
+// exceed maxWait nothing is booked and ok is false.
+func (l *telegramRateLimiter) reserve(chatKey string, maxWait time.Duration) (wait time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	wait = l.global.delay(now)
+	var chat *rateBucket
+	if chatKey != "" {
+		chat = l.chats[chatKey]
+		if chat == nil {
+			chat = newChatBucket(chatKey)
+			l.chats[chatKey] = chat
+		}
+		if d := chat.delay(now); d > wait {
+			wait = d
+		}
+		if d := time.Until(l.blockedUntil(chatKey)); d > wait {
+			wait = d
+		}
+	}
+	if wait > maxWait {
+		return wait, false
+	}
+
+	at := now.Add(wait)
+	l.global.take(at)
+	if chat != nil {
+		chat.take(at)
+	}
+	return wait, true
+}
+
+// flooded reports whether chatKey is currently under flood control
+func (l *telegramRateLimiter) flooded(chatKey string) bool {
+	if chatKey == "" {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.blockedUntil(chatKey).After(time.Now())
+}
+
+// block records a 429 retry_after for chatKey
+func (l *telegramRateLimiter) block(chatKey string, retryAfter time.Duration) {
+	if chatKey == "" {
+		return
+	}
+	until := time.Now().Add(retryAfter)
+	l.mu.Lock()
+	if until.After(l.blocked[chatKey]) {
+		l.blocked[chatKey] = until
+	}
+	l.mu.Unlock()
+	os.WriteFile(floodFlag(chatKey), []byte(strconv.FormatInt(until.UnixMilli(), 10)), 0600)
+}
+
+// editCoalescer collapses bursts of edits to the same message: while one edit
+// is waiting or in flight, newer texts replace each other and only the latest
+// is sent once the current edit finishes.
+type editCoalescer struct {
+	mu      sync.Mutex
+	pending map[string]*string // chat:message -> newest text waiting (nil if none)
+}
+
+var messageEdits = &editCoalescer{pending: make(map[string]*string)}
+
+// begin registers an edit. Returns false if another edit for the same message
+// is in progress, in which case text was queued for it to send.
+func (c *editCoalescer) begin(key string, text string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, busy := c.pending[key]; busy {
+		c.pending[key] = &text
+		return false
+	}
+	c.pending[key] = nil
+	return true
+}
+
+// next returns text queued while the previous edit was in flight, or
+// ok=false (and releases the message) if there is none
+func (c *editCoalescer) next(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p := c.pending[key]; p != nil {
+		c.pending[key] = nil
+		return *p, true
+	}
+	delete(c.pending, key)
+	return "", false
+}
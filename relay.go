@@ -14,7 +14,11 @@ import (
 	"time"
 )
 
-const maxTelegramFileSize = 50 * 1024 * 1024 // 50MB
+// Bot API file limits. The cloud API caps uploads at 50MB and downloads at
+// 20MB; a self-hosted telegram-bot-api server raises both to 2000MB.
+const maxTelegramFileSize = 50 * 1024 * 1024     // 50MB
+const maxTelegramDownloadSize = 20 * 1024 * 1024 // 20MB
+const maxSelfHostedFileSize = 2000 * 1024 * 1024 // 2000MB
 const defaultRelayURL = "https://ccc-relay.fly.dev"
 
 // handleSendFile sends a file to the current session's Telegram topic
@@ -59,7 +63,7 @@ func handleSendFile(filePath string) error {
 	fileSize := fileInfo.Size()
 
 	// Small file: send directly via Telegram
-	if fileSize < maxTelegramFileSize {
+	if fileSize < maxUploadSize(config) {
 		fmt.Printf("📤 Sending %s (%d MB) via Telegram...\n", fileName, fileSize/(1024*1024))
 		return sendFile(config, config.GroupID, topicID, filePath, "")
 	}
@@ -104,6 +108,22 @@ func handleSendFile(filePath string) error {
 	return streamFileToRelay(relayURL, token, filePath, fileName, fileSize)
 }
 
+// maxUploadSize returns the largest file sendFile can upload
+func maxUploadSize(config *Config) int64 {
+	if isSelfHostedAPI(config) {
+		return maxSelfHostedFileSize
+	}
+	return maxTelegramFileSize
+}
+
+// maxDownloadSize returns the largest file downloadTelegramFile can fetch
+func maxDownloadSize(config *Config) int64 {
+	if isSelfHostedAPI(config) {
+		return maxSelfHostedFileSize
+	}
+	return maxTelegramDownloadSize
+}
+
 func streamFileToRelay(relayURL, token, filePath, fileName string, fileSize int64) error {
 	// Poll for download requests - loop to allow multiple downloads
 	timeout := time.After(10 * time.Minute)
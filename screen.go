@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"strings"
+)
+
+// Limits for /screen
+const (
+	maxScreenLines     = 500  // scrollback lines for text snapshots
+	maxScreenPNGLines  = 200  // taller images get unreadable once Telegram scales them
+	maxScreenTextRunes = 3800 // stays under Telegram's 4096 limit with the header
+	screenPNGScale     = 2    // pixels per font pixel
+)
+
+// Default snapshot colors (dark terminal)
+var (
+	screenDefaultFG = color.RGBA{0xd0, 0xd0, 0xd0, 0xff}
+	screenDefaultBG = color.RGBA{0x1e, 0x1e, 0x1e, 0xff}
+)
+
+// ansiPalette is the standard 16-color xterm palette
+var ansiPalette = [16]color.RGBA{
+	{0x00, 0x00, 0x00, 0xff}, {0xcd, 0x31, 0x31, 0xff}, {0x0d, 0xbc, 0x79, 0xff}, {0xe5, 0xe5, 0x10, 0xff},
+	{0x24, 0x72, 0xc8, 0xff}, {0xbc, 0x3f, 0xbc, 0xff}, {0x11, 0xa8, 0xcd, 0xff}, {0xe5, 0xe5, 0xe5, 0xff},
+	{0x66, 0x66, 0x66, 0xff}, {0xf1, 0x4c, 0x4c, 0xff}, {0x23, 0xd1, 0x8b, 0xff}, {0xf5, 0xf5, 0x43, 0xff},
+	{0x3b, 0x8e, 0xea, 0xff}, {0xd6, 0x70, 0xd6, 0xff}, {0x29, 0xb8, 0xdb, 0xff}, {0xff, 0xff, 0xff, 0xff},
+}
+
+// screenCell is one character of a captured pane with its colors
+type screenCell struct {
+	Rune rune
+	FG   color.RGBA
+	BG   color.RGBA
+	Bold bool
+}
+
+// sgrState is the current text style while parsing escape sequences
+type sgrState struct {
+	fg, bg        color.RGBA
+	bold, reverse bool
+}
+
+// xterm256 converts a 256-color palette index to RGB
+func xterm256(n int) color.RGBA {
+	switch {
+	case n < 16:
+		return ansiPalette[n]
+	case n < 232:
+		n -= 16
+		level := func(v int) uint8 {
+			if v == 0 {
+				return 0
+			}
+			return uint8(55 + v*40)
+		}
+		return color.RGBA{level(n / 36), level(n / 6 % 6), level(n % 6), 0xff}
+	default:
+		v := uint8(8 + (n-232)*10)
+		return color.RGBA{v, v, v, 0xff}
+	}
+}
+
+// apply updates the style from the parameters of an SGR (ESC [ ... m) sequence
+func (s *sgrState) apply(params []int) {
+	if len(params) == 0 {
+		params = []int{0}
+	}
+	for i := 0; i < len(params); i++ {
+		switch p := params[i]; {
+		case p == 0:
+			*s = sgrState{fg: screenDefaultFG, bg: screenDefaultBG}
+		case p == 1:
+			s.bold = true
+		case p == 22:
+			s.bold = false
+		case p == 7:
+			s.reverse = true
+		case p == 27:
+			s.reverse = false
+		case p >= 30 && p <= 37:
+			s.fg = ansiPalette[p-30]
+		case p >= 90 && p <= 97:
+			s.fg = ansiPalette[p-90+8]
+		case p == 39:
+			s.fg = screenDefaultFG
+		case p >= 40 && p <= 47:
+			s.bg = ansiPalette[p-40]
+		case p >= 100 && p <= 107:
+			s.bg = ansiPalette[p-100+8]
+		case p == 49:
+			s.bg = screenDefaultBG
+		case p == 38 || p == 48:
+			// Extended color: 5;n (256 colors) or 2;r;g;b (truecolor)
+			var c color.RGBA
+			if i+2 < len(params) && params[i+1] == 5 {
+				c = xterm256(params[i+2] & 0xff)
+				i += 2
+			} else if i+4 < len(params) && params[i+1] == 2 {
+				c = color.RGBA{uint8(params[i+2]), uint8(params[i+3]), uint8(params[i+4]), 0xff}
+				i += 4
+			} else {
+				return
+			}
+			if p == 38 {
+				s.fg = c
+			} else {
+				s.bg = c
+			}
+		}
+	}
+}
+
+// parseANSI splits captured pane output into lines of styled cells. SGR
+// sequences set colors; other escape sequences are dropped.
+func parseANSI(s string) [][]screenCell {
+	state := sgrState{fg: screenDefaultFG, bg: screenDefaultBG}
+	lines := [][]screenCell{nil}
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == 0x1b && i+1 < len(runes) && runes[i+1] == '[':
+			// CSI: parameters up to a final byte in @-~
+			j := i + 2
+			for j < len(runes) && (runes[j] < 0x40 || runes[j] > 0x7e) {
+				j++
+			}
+			if j < len(runes) && runes[j] == 'm' {
+				var params []int
+				for _, f := range strings.FieldsFunc(string(runes[i+2:j]), func(r rune) bool { return r == ';' || r == ':' }) {
+					n, _ := strconv.Atoi(f)
+					params = append(params, n)
+				}
+				state.apply(params)
+			}
+			i = j
+		case r == 0x1b && i+1 < len(runes) && runes[i+1] == ']':
+			// OSC (e.g. hyperlinks): up to BEL or ESC \
+			j := i + 2
+			for j < len(runes) && runes[j] != 0x07 && !(runes[j] == 0x1b && j+1 < len(runes) && runes[j+1] == '\\') {
+				j++
+			}
+			if j < len(runes) && runes[j] == 0x1b {
+				j++
+			}
+			i = j
+		case r == 0x1b:
+			i++ // two-character escape
+		case r == '\n':
+			lines = append(lines, nil)
+		case r == '\t':
+			n := len(lines) - 1
+			for pad := 8 - len(lines[n])%8; pad > 0; pad-- {
+				lines[n] = append(lines[n], state.cell(' '))
+			}
+		case r < 0x20 || r == 0x7f:
+			// other control characters
+		default:
+			n := len(lines) - 1
+			lines[n] = append(lines[n], state.cell(r))
+		}
+	}
+	// capture-pane ends with a newline; drop trailing blank lines
+	for len(lines) > 0 && strings.TrimSpace(cellText(lines[len(lines)-1])) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// cell returns a rune in the current style
+func (s *sgrState) cell(r rune) screenCell {
+	c := screenCell{Rune: r, FG: s.fg, BG: s.bg, Bold: s.bold}
+	if s.reverse {
+		c.FG, c.BG = c.BG, c.FG
+	}
+	return c
+}
+
+// cellText returns the characters of a line
+func cellText(line []screenCell) string {
+	var sb strings.Builder
+	for _, c := range line {
+		sb.WriteRune(c.Rune)
+	}
+	return sb.String()
+}
+
+// stripANSI returns captured pane output as plain text
+func stripANSI(s string) string {
+	lines := parseANSI(s)
+	text := make([]string, len(lines))
+	for i, line := range lines {
+		text[i] = strings.TrimRight(cellText(line), " ")
+	}
+	return strings.Join(text, "\n")
+}
+
+// Box-drawing directions for procedurally drawn glyphs
+const (
+	boxUp = 1 << iota
+	boxDown
+	boxLeft
+	boxRight
+)
+
+// boxGlyphs maps box-drawing characters to the directions their lines go.
+// Heavy, double and rounded variants are drawn like the light ones.
+var boxGlyphs = map[rune]int{
+	'─': boxLeft | boxRight, '━': boxLeft | boxRight, '═': boxLeft | boxRight, '┄': boxLeft | boxRight, '┈': boxLeft | boxRight, '╌': boxLeft | boxRight,
+	'│': boxUp | boxDown, '┃': boxUp | boxDown, '║': boxUp | boxDown, '┆': boxUp | boxDown, '┊': boxUp | boxDown, '╎': boxUp | boxDown,
+	'┌': boxDown | boxRight, '╭': boxDown | boxRight, '┏': boxDown | boxRight, '╔': boxDown | boxRight,
+	'┐': boxDown | boxLeft, '╮': boxDown | boxLeft, '┓': boxDown | boxLeft, '╗': boxDown | boxLeft,
+	'└': boxUp | boxRight, '╰': boxUp | boxRight, '┗': boxUp | boxRight, '╚': boxUp | boxRight,
+	'┘': boxUp | boxLeft, '╯': boxUp | boxLeft, '┛': boxUp | boxLeft, '╝': boxUp | boxLeft,
+	'├': boxUp | boxDown | boxRight, '┣': boxUp | boxDown | boxRight, '╠': boxUp | boxDown | boxRight,
+	'┤': boxUp | boxDown | boxLeft, '┫': boxUp | boxDown | boxLeft, '╣': boxUp | boxDown | boxLeft,
+	'┬': boxDown | boxLeft | boxRight, '┳': boxDown | boxLeft | boxRight, '╦': boxDown | boxLeft | boxRight,
+	'┴': boxUp | boxLeft | boxRight, '┻': boxUp | boxLeft | boxRight, '╩': boxUp | boxLeft | boxRight,
+	'┼': boxUp | boxDown | boxLeft | boxRight, '╋': boxUp | boxDown | boxLeft | boxRight, '╬': boxUp | boxDown | boxLeft | boxRight,
+	'╴': boxLeft, '╶': boxRight, '╵': boxUp, '╷': boxDown,
+}
+
+// glyphFallbacks draws common TUI symbols with a similar ASCII glyph
+var glyphFallbacks = map[rune]rune{
+	'❯': '>', '›': '>', '⏵': '>', '▶': '>', '▸': '>', '→': '>', '⎿': 'L',
+	'‹': '<', '◀': '<', '←': '<', '↑': '^', '↓': 'v',
+	'✓': 'v', '✔': 'v', '✗': 'x', '✘': 'x', '×': 'x',
+	'✻': '*', '✽': '*', '✶': '*', '✳': '*', '✢': '*', '✱': '*',
+	'·': '.', '∙': '.', '…': '_', '“': '"', '”': '"', '‘': '\'', '’': '\'', '\u00a0': ' ',
+}
+
+// glyphMask returns the 6x13 bitmap for a rune
+func glyphMask(r rune) [screenFontHeight]byte {
+	var m [screenFontHeight]byte
+	if fb, ok := glyphFallbacks[r]; ok {
+		r = fb
+	}
+	switch {
+	case r >= 0x20 && r <= 0x7e:
+		return screenFont[r-0x20]
+	case boxGlyphs[r] != 0:
+		dirs := boxGlyphs[r]
+		const mid = screenFontHeight / 2
+		for y := 0; y < screenFontHeight; y++ {
+			if (dirs&boxUp != 0 && y <= mid) || (dirs&boxDown != 0 && y >= mid) {
+				m[y] |= 0x20
+			}
+		}
+		if dirs&boxLeft != 0 {
+			m[mid] |= 0xe0
+		}
+		if dirs&boxRight != 0 {
+			m[mid] |= 0x3c
+		}
+	case r == '█':
+		for y := range m {
+			m[y] = 0xfc
+		}
+	case r == '▀' || r == '▄':
+		for y := range m {
+			if (r == '▀') == (y < screenFontHeight/2) {
+				m[y] = 0xfc
+			}
+		}
+	case r == '▌':
+		for y := range m {
+			m[y] = 0xe0
+		}
+	case r == '▐':
+		for y := range m {
+			m[y] = 0x1c
+		}
+	case r == '░' || r == '▒' || r == '▓':
+		// Shades alternate between two row patterns
+		pattern := map[rune][2]byte{'░': {0x88, 0x20}, '▒': {0xa8, 0x54}, '▓': {0xfc, 0x54}}[r]
+		for y := range m {
+			m[y] = pattern[y%2]
+		}
+	case r == '●' || r == '⏺' || r == '•' || r == '◉':
+		copy(m[4:], []byte{0x30, 0x78, 0x78, 0x30})
+	case r == '○' || r == '◯':
+		copy(m[4:], []byte{0x30, 0x48, 0x48, 0x30})
+	default:
+		// Anything else (emoji, CJK...) shows as an empty box
+		copy(m[3:], []byte{0x78, 0x48, 0x48, 0x48, 0x48, 0x48, 0x78})
+	}
+	return m
+}
+
+// renderScreenPNG draws styled pane lines as a PNG image
+func renderScreenPNG(lines [][]screenCell) ([]byte, error) {
+	cols := 1
+	for _, line := range lines {
+		if len(line) > cols {
+			cols = len(line)
+		}
+	}
+	rows := len(lines)
+	if rows == 0 {
+		rows = 1
+	}
+	const cellW, cellH = screenFontWidth * screenPNGScale, screenFontHeight * screenPNGScale
+	img := image.NewRGBA(image.Rect(0, 0, cols*cellW, rows*cellH))
+
+	// fill paints one font pixel (a scale x scale block)
+	fill := func(px, py int, c color.RGBA) {
+		for dy := 0; dy < screenPNGScale; dy++ {
+			for dx := 0; dx < screenPNGScale; dx++ {
+				img.SetRGBA(px*screenPNGScale+dx, py*screenPNGScale+dy, c)
+			}
+		}
+	}
+
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			cell := screenCell{Rune: ' ', FG: screenDefaultFG, BG: screenDefaultBG}
+			if row < len(lines) && col < len(lines[row]) {
+				cell = lines[row][col]
+			}
+			mask := glyphMask(cell.Rune)
+			x0, y0 := col*screenFontWidth, row*screenFontHeight
+			for y := 0; y < screenFontHeight; y++ {
+				bits := mask[y]
+				if cell.Bold {
+					bits |= bits >> 1 // double-strike
+				}
+				for x := 0; x < screenFontWidth; x++ {
+					c := cell.BG
+					if bits&(0x80>>x) != 0 {
+						c = cell.FG
+					}
+					fill(x0+x, y0+y, c)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// tailLines keeps the last lines of text that fit in maxRunes
+func tailLines(text string, maxRunes int) (string, bool) {
+	lines := strings.Split(text, "\n")
+	total := 0
+	for i := len(lines) - 1; i >= 0; i-- {
+		total += len([]rune(lines[i])) + 1
+		if total > maxRunes {
+			return strings.Join(lines[i+1:], "\n"), true
+		}
+	}
+	return text, false
+}
+
+// handleScreenCommand implements /screen [png] [lines]: a snapshot of the
+// session's pane as text, or as an image with colors
+func handleScreenCommand(config *Config, sessName string, chatID int64, threadID int64, args []string) {
+	asPNG := false
+	lines := 0
+	for _, a := range args {
+		if a == "png" {
+			asPNG = true
+		} else if n, err := strconv.Atoi(a); err == nil && n > 0 {
+			lines = n
+		} else {
+			sendMessage(config, chatID, threadID, "Usage: /screen [png] [lines]")
+			return
+		}
+	}
+	if lines > maxScreenLines {
+		lines = maxScreenLines
+	}
+	if asPNG && lines > maxScreenPNGLines {
+		lines = maxScreenPNGLines
+	}
+
+	target, err := sessionTarget(config, sessName)
+	if err != nil {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("❌ %v", err))
+		return
+	}
+	raw, err := capturePaneANSI(target, lines)
+	if err != nil {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to capture pane: %v", err))
+		return
+	}
+
+	if asPNG {
+		cells := parseANSI(raw)
+		if lines > 0 && len(cells) > lines {
+			cells = cells[len(cells)-lines:]
+		}
+		data, err := renderScreenPNG(cells)
+		if err == nil {
+			err = sendPhotoBytes(config, chatID, threadID, sessName+".png", data, "🖥 "+sessName)
+		}
+		if err != nil {
+			sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to send screenshot: %v", err))
+		}
+		return
+	}
+
+	text := strings.Split(stripANSI(raw), "\n")
+	if lines > 0 && len(text) > lines {
+		text = text[len(text)-lines:]
+	}
+	snapshot, cut := tailLines(strings.Join(text, "\n"), maxScreenTextRunes)
+	if strings.TrimSpace(snapshot) == "" {
+		snapshot = "(empty pane)"
+	}
+	header := "🖥 " + htmlEscape(sessName)
+	if cut {
+		header += " (truncated to the last lines)"
+	}
+	if _, err := sendMessageHTMLGetID(config, chatID, threadID, fmt.Sprintf("%s\n<pre>%s</pre>", header, htmlEscape(snapshot))); err != nil {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to send snapshot: %v", err))
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+// screenFont is a 6x13 bitmap font for ASCII 0x20-0x7e, used to render pane
+// snapshots. One byte per row, most significant bit leftmost. Glyphs are from
+// the public domain X11 misc-fixed 6x13 font.
+const (
+	screenFontWidth  = 6
+	screenFontHeight = 13
+)
+
+var screenFont = [95][screenFontHeight]byte{
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, // ' '
+	{0x00, 0x00, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x00, 0x10, 0x00, 0x00}, // '!'
+	{0x00, 0x00, 0x28, 0x28, 0x28, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, // '"'
+	{0x00, 0x00, 0x00, 0x28, 0x28, 0x7c, 0x28, 0x7c, 0x28, 0x28, 0x00, 0x00, 0x00}, // '#'
+	{0x00, 0x00, 0x00, 0x10, 0x3c, 0x50, 0x38, 0x14, 0x78, 0x10, 0x00, 0x00, 0x00}, // '$'
+	{0x00, 0x00, 0x44, 0xa4, 0x48, 0x10, 0x10, 0x20, 0x48, 0x94, 0x88, 0x00, 0x00}, // '%'
+	{0x00, 0x00, 0x00, 0x00, 0x60, 0x90, 0x90, 0x60, 0x94, 0x88, 0x74, 0x00, 0x00}, // '&'
+	{0x00, 0x00, 0x10, 0x10, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, // '\''
+	{0x00, 0x00, 0x08, 0x10, 0x10, 0x20, 0x20, 0x20, 0x10, 0x10, 0x08, 0x00, 0x00}, // '('
+	{0x00, 0x00, 0x20, 0x10, 0x10, 0x08, 0x08, 0x08, 0x10, 0x10, 0x20, 0x00, 0x00}, // ')'
+	{0x00, 0x00, 0x00, 0x00, 0x48, 0x30, 0xfc, 0x30, 0x48, 0x00, 0x00, 0x00, 0x00}, // '*'
+	{0x00, 0x00, 0x00, 0x00, 0x10, 0x10, 0x7c, 0x10, 0x10, 0x00, 0x00, 0x00, 0x00}, // '+'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x38, 0x30, 0x40, 0x00}, // ','
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x7c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, // '-'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x38, 0x10, 0x00}, // '.'
+	{0x00, 0x00, 0x04, 0x04, 0x08, 0x08, 0x10, 0x20, 0x20, 0x40, 0x40, 0x00, 0x00}, // '/'
+	{0x00, 0x00, 0x30, 0x48, 0x84, 0x84, 0x84, 0x84, 0x84, 0x48, 0x30, 0x00, 0x00}, // '0'
+	{0x00, 0x00, 0x10, 0x30, 0x50, 0x10, 0x10, 0x10, 0x10, 0x10, 0x7c, 0x00, 0x00}, // '1'
+	{0x00, 0x00, 0x78, 0x84, 0x84, 0x04, 0x08, 0x30, 0x40, 0x80, 0xfc, 0x00, 0x00}, // '2'
+	{0x00, 0x00, 0xfc, 0x04, 0x08, 0x10, 0x38, 0x04, 0x04, 0x84, 0x78, 0x00, 0x00}, // '3'
+	{0x00, 0x00, 0x08, 0x18, 0x28, 0x48, 0x88, 0x88, 0xfc, 0x08, 0x08, 0x00, 0x00}, // '4'
+	{0x00, 0x00, 0xfc, 0x80, 0x80, 0xb8, 0xc4, 0x04, 0x04, 0x84, 0x78, 0x00, 0x00}, // '5'
+	{0x00, 0x00, 0x38, 0x40, 0x80, 0x80, 0xb8, 0xc4, 0x84, 0x84, 0x78, 0x00, 0x00}, // '6'
+	{0x00, 0x00, 0xfc, 0x04, 0x08, 0x10, 0x10, 0x20, 0x20, 0x40, 0x40, 0x00, 0x00}, // '7'
+	{0x00, 0x00, 0x78, 0x84, 0x84, 0x84, 0x78, 0x84, 0x84, 0x84, 0x78, 0x00, 0x00}, // '8'
+	{0x00, 0x00, 0x78, 0x84, 0x84, 0x8c, 0x74, 0x04, 0x04, 0x08, 0x70, 0x00, 0x00}, // '9'
+	{0x00, 0x00, 0x00, 0x00, 0x10, 0x38, 0x10, 0x00, 0x00, 0x10, 0x38, 0x10, 0x00}, // ':'
+	{0x00, 0x00, 0x00, 0x00, 0x10, 0x38, 0x10, 0x00, 0x00, 0x38, 0x30, 0x40, 0x00}, // ';'
+	{0x00, 0x00, 0x04, 0x08, 0x10, 0x20, 0x40, 0x20, 0x10, 0x08, 0x04, 0x00, 0x00}, // '<'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0xfc, 0x00, 0x00, 0xfc, 0x00, 0x00, 0x00, 0x00}, // '='
+	{0x00, 0x00, 0x40, 0x20, 0x10, 0x08, 0x04, 0x08, 0x10, 0x20, 0x40, 0x00, 0x00}, // '>'
+	{0x00, 0x00, 0x78, 0x84, 0x84, 0x04, 0x08, 0x10, 0x10, 0x00, 0x10, 0x00, 0x00}, // '?'
+	{0x00, 0x00, 0x78, 0x84, 0x84, 0x9c, 0xa4, 0xac, 0x94, 0x80, 0x78, 0x00, 0x00}, // '@'
+	{0x00, 0x00, 0x30, 0x48, 0x84, 0x84, 0x84, 0xfc, 0x84, 0x84, 0x84, 0x00, 0x00}, // 'A'
+	{0x00, 0x00, 0xf8, 0x44, 0x44, 0x44, 0x78, 0x44, 0x44, 0x44, 0xf8, 0x00, 0x00}, // 'B'
+	{0x00, 0x00, 0x78, 0x84, 0x80, 0x80, 0x80, 0x80, 0x80, 0x84, 0x78, 0x00, 0x00}, // 'C'
+	{0x00, 0x00, 0xf8, 0x44, 0x44, 0x44, 0x44, 0x44, 0x44, 0x44, 0xf8, 0x00, 0x00}, // 'D'
+	{0x00, 0x00, 0xfc, 0x80, 0x80, 0x80, 0xf0, 0x80, 0x80, 0x80, 0xfc, 0x00, 0x00}, // 'E'
+	{0x00, 0x00, 0xfc, 0x80, 0x80, 0x80, 0xf0, 0x80, 0x80, 0x80, 0x80, 0x00, 0x00}, // 'F'
+	{0x00, 0x00, 0x78, 0x84, 0x80, 0x80, 0x80, 0x9c, 0x84, 0x8c, 0x74, 0x00, 0x00}, // 'G'
+	{0x00, 0x00, 0x84, 0x84, 0x84, 0x84, 0xfc, 0x84, 0x84, 0x84, 0x84, 0x00, 0x00}, // 'H'
+	{0x00, 0x00, 0x7c, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x7c, 0x00, 0x00}, // 'I'
+	{0x00, 0x00, 0x1c, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x88, 0x70, 0x00, 0x00}, // 'J'
+	{0x00, 0x00, 0x84, 0x88, 0x90, 0xa0, 0xc0, 0xa0, 0x90, 0x88, 0x84, 0x00, 0x00}, // 'K'
+	{0x00, 0x00, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0xfc, 0x00, 0x00}, // 'L'
+	{0x00, 0x00, 0x84, 0xcc, 0xcc, 0xb4, 0xb4, 0x84, 0x84, 0x84, 0x84, 0x00, 0x00}, // 'M'
+	{0x00, 0x00, 0x84, 0x84, 0xc4, 0xa4, 0x94, 0x8c, 0x84, 0x84, 0x84, 0x00, 0x00}, // 'N'
+	{0x00, 0x00, 0x78, 0x84, 0x84, 0x84, 0x84, 0x84, 0x84, 0x84, 0x78, 0x00, 0x00}, // 'O'
+	{0x00, 0x00, 0xf8, 0x84, 0x84, 0x84, 0xf8, 0x80, 0x80, 0x80, 0x80, 0x00, 0x00}, // 'P'
+	{0x00, 0x00, 0x78, 0x84, 0x84, 0x84, 0x84, 0x84, 0xa4, 0x94, 0x78, 0x04, 0x00}, // 'Q'
+	{0x00, 0x00, 0xf8, 0x84, 0x84, 0x84, 0xf8, 0xa0, 0x90, 0x88, 0x84, 0x00, 0x00}, // 'R'
+	{0x00, 0x00, 0x78, 0x84, 0x80, 0x80, 0x78, 0x04, 0x04, 0x84, 0x78, 0x00, 0x00}, // 'S'
+	{0x00, 0x00, 0x7c, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x00, 0x00}, // 'T'
+	{0x00, 0x00, 0x84, 0x84, 0x84, 0x84, 0x84, 0x84, 0x84, 0x84, 0x78, 0x00, 0x00}, // 'U'
+	{0x00, 0x00, 0x84, 0x84, 0x84, 0x48, 0x48, 0x48, 0x30, 0x30, 0x30, 0x00, 0x00}, // 'V'
+	{0x00, 0x00, 0x84, 0x84, 0x84, 0x84, 0xb4, 0xb4, 0xcc, 0xcc, 0x84, 0x00, 0x00}, // 'W'
+	{0x00, 0x00, 0x84, 0x84, 0x48, 0x48, 0x30, 0x48, 0x48, 0x84, 0x84, 0x00, 0x00}, // 'X'
+	{0x00, 0x00, 0x44, 0x44, 0x28, 0x28, 0x10, 0x10, 0x10, 0x10, 0x10, 0x00, 0x00}, // 'Y'
+	{0x00, 0x00, 0xfc, 0x04, 0x08, 0x10, 0x30, 0x20, 0x40, 0x80, 0xfc, 0x00, 0x00}, // 'Z'
+	{0x00, 0x78, 0x40, 0x40, 0x40, 0x40, 0x40, 0x40, 0x40, 0x40, 0x40, 0x78, 0x00}, // '['
+	{0x00, 0x00, 0x40, 0x40, 0x20, 0x20, 0x10, 0x08, 0x08, 0x04, 0x04, 0x00, 0x00}, // '\\'
+	{0x00, 0x78, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x78, 0x00}, // ']'
+	{0x00, 0x00, 0x10, 0x28, 0x44, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, // '^'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xfc, 0x00}, // '_'
+	{0x00, 0x20, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, // '`'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x78, 0x04, 0x7c, 0x84, 0x8c, 0x74, 0x00, 0x00}, // 'a'
+	{0x00, 0x00, 0x80, 0x80, 0x80, 0xb8, 0xc4, 0x84, 0x84, 0xc4, 0xb8, 0x00, 0x00}, // 'b'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x78, 0x84, 0x80, 0x80, 0x84, 0x78, 0x00, 0x00}, // 'c'
+	{0x00, 0x00, 0x04, 0x04, 0x04, 0x74, 0x8c, 0x84, 0x84, 0x8c, 0x74, 0x00, 0x00}, // 'd'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x78, 0x84, 0xfc, 0x80, 0x84, 0x78, 0x00, 0x00}, // 'e'
+	{0x00, 0x00, 0x38, 0x44, 0x40, 0x40, 0xf0, 0x40, 0x40, 0x40, 0x40, 0x00, 0x00}, // 'f'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x74, 0x88, 0x88, 0x70, 0x80, 0x78, 0x84, 0x78}, // 'g'
+	{0x00, 0x00, 0x80, 0x80, 0x80, 0xb8, 0xc4, 0x84, 0x84, 0x84, 0x84, 0x00, 0x00}, // 'h'
+	{0x00, 0x00, 0x00, 0x10, 0x00, 0x30, 0x10, 0x10, 0x10, 0x10, 0x7c, 0x00, 0x00}, // 'i'
+	{0x00, 0x00, 0x00, 0x04, 0x00, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x44, 0x44, 0x38}, // 'j'
+	{0x00, 0x00, 0x80, 0x80, 0x80, 0x88, 0x90, 0xe0, 0x90, 0x88, 0x84, 0x00, 0x00}, // 'k'
+	{0x00, 0x00, 0x30, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x7c, 0x00, 0x00}, // 'l'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x68, 0x54, 0x54, 0x54, 0x54, 0x44, 0x00, 0x00}, // 'm'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0xb8, 0xc4, 0x84, 0x84, 0x84, 0x84, 0x00, 0x00}, // 'n'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x78, 0x84, 0x84, 0x84, 0x84, 0x78, 0x00, 0x00}, // 'o'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0xb8, 0xc4, 0x84, 0xc4, 0xb8, 0x80, 0x80, 0x80}, // 'p'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x74, 0x8c, 0x84, 0x8c, 0x74, 0x04, 0x04, 0x04}, // 'q'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0xb8, 0x44, 0x40, 0x40, 0x40, 0x40, 0x00, 0x00}, // 'r'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x78, 0x84, 0x60, 0x18, 0x84, 0x78, 0x00, 0x00}, // 's'
+	{0x00, 0x00, 0x00, 0x40, 0x40, 0xf0, 0x40, 0x40, 0x40, 0x44, 0x38, 0x00, 0x00}, // 't'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x84, 0x84, 0x84, 0x84, 0x8c, 0x74, 0x00, 0x00}, // 'u'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x44, 0x44, 0x44, 0x28, 0x28, 0x10, 0x00, 0x00}, // 'v'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x44, 0x44, 0x54, 0x54, 0x54, 0x28, 0x00, 0x00}, // 'w'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x84, 0x48, 0x30, 0x30, 0x48, 0x84, 0x00, 0x00}, // 'x'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x84, 0x84, 0x84, 0x8c, 0x74, 0x04, 0x84, 0x78}, // 'y'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0xfc, 0x08, 0x10, 0x20, 0x40, 0xfc, 0x00, 0x00}, // 'z'
+	{0x00, 0x1c, 0x20, 0x20, 0x20, 0x10, 0x60, 0x10, 0x20, 0x20, 0x20, 0x1c, 0x00}, // '{'
+	{0x00, 0x00, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x00, 0x00}, // '|'
+	{0x00, 0x70, 0x08, 0x08, 0x08, 0x10, 0x0c, 0x10, 0x08, 0x08, 0x08, 0x70, 0x00}, // '}'
+	{0x00, 0x00, 0x24, 0x54, 0x48, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, // '~'
+}
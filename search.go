@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// searchResultLimit is how many hits /search and ccc search show
+const searchResultLimit = 10
+
+// searchTimeFormat includes the weekday, for "what did Claude say on Tuesday"
+const searchTimeFormat = "Mon 2006-01-02 15:04"
+
+// messageLink builds a t.me link to a message in a session's topic, or "" if
+// the message was never sent to Telegram
+func messageLink(config *Config, hit *SearchHit) string {
+	info := config.Sessions[hit.Session]
+	if info == nil || hit.TgMsgID == 0 {
+		return ""
+	}
+	link := topicLink(config, info.TopicID)
+	if link == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%d", link, hit.TgMsgID)
+}
+
+// searchTypeIcon marks who said a search hit
+func searchTypeIcon(hit *SearchHit) string {
+	if hit.Type == "user_prompt" {
+		return "💬"
+	}
+	return "🤖"
+}
+
+// parseSearchArgs splits /search arguments into the query and an optional
+// trailing session name
+func parseSearchArgs(config *Config, args []string) (string, string) {
+	if len(args) >= 2 {
+		if _, ok := config.Sessions[args[len(args)-1]]; ok {
+			return strings.Join(args[:len(args)-1], " "), args[len(args)-1]
+		}
+	}
+	return strings.Join(args, " "), ""
+}
+
+// formatSearchHTML renders search hits for Telegram
+func formatSearchHTML(config *Config, query string, hits []*SearchHit) string {
+	if len(hits) == 0 {
+		return fmt.Sprintf("🔍 Nothing found for \"%s\"", htmlEscape(query))
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("🔍 %d result(s) for \"%s\"\n", len(hits), htmlEscape(query)))
+	for _, hit := range hits {
+		when := time.UnixMilli(hit.Timestamp).Format(searchTimeFormat)
+		sb.WriteString(fmt.Sprintf("\n%s <b>%s</b> · %s", searchTypeIcon(hit), htmlEscape(hit.Session), when))
+		if link := messageLink(config, hit); link != "" {
+			sb.WriteString(fmt.Sprintf(" · <a href=\"%s\">open</a>", link))
+		}
+		snippet := htmlEscape(strings.ReplaceAll(hit.Snippet, "\n", " "))
+		snippet = strings.NewReplacer(matchStart, "<b>", matchEnd, "</b>").Replace(snippet)
+		sb.WriteString("\n" + snippet + "\n")
+	}
+	return sb.String()
+}
+
+// handleSearchCommand implements /search <query> [session]. Sessions the
+// user may not access are left out of the results.
+func handleSearchCommand(config *Config, msg *TelegramMessage, args []string) {
+	chatID, threadID := msg.Chat.ID, msg.MessageThreadID
+	query, sessName := parseSearchArgs(config, args)
+	if query == "" {
+		sendMessage(config, chatID, threadID, "Usage: /search <query> [session]")
+		return
+	}
+	if !canAccessSession(config, msg.From.ID, sessName) {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("⛔ No access to session '%s'", sessName))
+		return
+	}
+
+	// Fetch extra hits so results from inaccessible sessions don't crowd out the rest
+	hits, err := searchMessages(query, sessName, searchResultLimit*5)
+	if err != nil {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Search failed: %v", err))
+		return
+	}
+	var visible []*SearchHit
+	for _, hit := range hits {
+		if canAccessSession(config, msg.From.ID, hit.Session) && len(visible) < searchResultLimit {
+			visible = append(visible, hit)
+		}
+	}
+	if _, err := sendMessageHTMLGetID(config, chatID, threadID, formatSearchHTML(config, query, visible)); err != nil {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to send results: %v", err))
+	}
+}
+
+// searchCommand implements `ccc search [-s <session>] <query>`
+func searchCommand(args []string) error {
+	sessName := ""
+	if len(args) >= 2 && (args[0] == "-s" || args[0] == "--session") {
+		sessName, args = args[1], args[2:]
+	}
+	query := strings.Join(args, " ")
+	if strings.TrimSpace(query) == "" {
+		return fmt.Errorf("usage: ccc search [-s <session>] <query>")
+	}
+
+	hits, err := searchMessages(query, sessName, searchResultLimit)
+	if err != nil {
+		return err
+	}
+	if len(hits) == 0 {
+		fmt.Printf("Nothing found for %q\n", query)
+		return nil
+	}
+	config, _ := loadConfig()
+	marks := strings.NewReplacer(matchStart, "«", matchEnd, "»", "\n", " ")
+	for _, hit := range hits {
+		when := time.UnixMilli(hit.Timestamp).Format(searchTimeFormat)
+		fmt.Printf("%s  %s  %s\n", when, hit.Session, hit.Type)
+		fmt.Printf("  %s\n", marks.Replace(hit.Snippet))
+		if config != nil {
+			if link := messageLink(config, hit); link != "" {
+				fmt.Printf("  %s\n", link)
+			}
+		}
+	}
+	return nil
+}
@@ -53,14 +53,15 @@ func createSession(config *Config, name string) error {
 	}
 
 	// Save mapping with full path
-	config.Sessions[name] = &SessionInfo{
+	info := &SessionInfo{
 		TopicID:  topicID,
 		Path:     workDir,
 		WindowID: windowID,
 	}
-	if err := saveConfig(config); err != nil {
-		return fmt.Errorf("failed to save config: %w", err)
+	if err := saveSession(name, info); err != nil {
+		return fmt.Errorf("failed to save session: %w", err)
 	}
+	config.Sessions[name] = info
 
 	return nil
 }
@@ -73,13 +74,48 @@ func killSession(config *Config, name string) error {
 	// Kill tmux window
 	killTmuxWindow(getWindowID(config, name), tmuxSafeName(name))
 
-	// Remove from config
+	// Remove from the registry
+	deleteSession(name)
 	delete(config.Sessions, name)
-	saveConfig(config)
 
 	return nil
 }
 
+// restartSessionWindow kills the session's tmux window (if running) and starts a
+// fresh one, optionally continuing the previous conversation.
+// Returns whether the new window is still alive shortly after launch.
+func restartSessionWindow(config *Config, sessName string, continueSession bool) (bool, error) {
+	info := config.Sessions[sessName]
+	if info == nil {
+		return false, fmt.Errorf("session '%s' not found", sessName)
+	}
+
+	tmuxName := tmuxSafeName(sessName)
+	if tmuxWindowExistsByID(info.WindowID, tmuxName) {
+		killTmuxWindow(info.WindowID, tmuxName)
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	// Use the stored path from config, fallback to resolveProjectPath
+	workDir := info.Path
+	if workDir == "" {
+		workDir = resolveProjectPath(config, sessName)
+	}
+	if _, err := os.Stat(workDir); os.IsNotExist(err) {
+		os.MkdirAll(workDir, 0755)
+	}
+
+	windowID, err := createTmuxWindow(tmuxName, workDir, continueSession)
+	if err != nil {
+		return false, err
+	}
+	info.WindowID = windowID
+	updateSession(sessName, func(i *SessionInfo) { i.WindowID = windowID })
+
+	time.Sleep(500 * time.Millisecond)
+	return tmuxWindowExistsByID(windowID, tmuxName), nil
+}
+
 func getSessionByTopic(config *Config, topicID int64) string {
 	for name, info := range config.Sessions {
 		if info != nil && info.TopicID == topicID {
@@ -115,7 +151,7 @@ func startSession(continueSession bool) error {
 					TopicID: topicID,
 					Path:    cwd,
 				}
-				saveConfig(config)
+				saveSession(name, config.Sessions[name])
 				fmt.Printf("📱 Created Telegram topic: %s\n", name)
 			}
 		}
@@ -148,10 +184,10 @@ func startSession(continueSession bool) error {
 		return err
 	}
 
-	// Store window ID back to config
+	// Store window ID back to the registry
 	if config.Sessions[name] != nil {
 		config.Sessions[name].WindowID = windowID
-		saveConfig(config)
+		updateSession(name, func(i *SessionInfo) { i.WindowID = windowID })
 	}
 
 	target := tmuxTargetByID(windowID, winName)
@@ -208,8 +244,8 @@ func startDetached(name string, workDir string, prompt string) error {
 		Path:     workDir,
 		WindowID: windowID,
 	}
-	if err := saveConfig(config); err != nil {
-		return fmt.Errorf("failed to save config: %w", err)
+	if err := saveSession(name, config.Sessions[name]); err != nil {
+		return fmt.Errorf("failed to save session: %w", err)
 	}
 
 	target := tmuxTargetByID(windowID, winName)
@@ -19,6 +19,31 @@ import (
 
 const maxResponseSize = 10 * 1024 * 1024 // 10MB
 
+const defaultAPIBaseURL = "https://api.telegram.org"
+
+// apiBaseURL returns the Bot API server URL, without trailing slash
+func apiBaseURL(config *Config) string {
+	if config == nil || config.APIBaseURL == "" {
+		return defaultAPIBaseURL
+	}
+	return strings.TrimRight(config.APIBaseURL, "/")
+}
+
+// isSelfHostedAPI reports whether ccc talks to a self-hosted telegram-bot-api server
+func isSelfHostedAPI(config *Config) bool {
+	return apiBaseURL(config) != defaultAPIBaseURL
+}
+
+// botURL builds the URL of a Bot API method
+func botURL(config *Config, method string) string {
+	return fmt.Sprintf("%s/bot%s/%s", apiBaseURL(config), config.BotToken, method)
+}
+
+// fileURL builds the download URL for a file_path returned by getFile
+func fileURL(config *Config, filePath string) string {
+	return fmt.Sprintf("%s/file/bot%s/%s", apiBaseURL(config), config.BotToken, filePath)
+}
+
 // redactTokenError replaces the bot token in error messages with "***"
 func redactTokenError(err error, token string) error {
 	if err == nil || token == "" {
@@ -46,7 +71,7 @@ func telegramClientGet(client *http.Client, token string, url string) (*http.Res
 }
 
 // updateCCC downloads the latest ccc binary from GitHub releases and restarts
-func updateCCC(config *Config, chatID, threadID int64, offset int) {
+func updateCCC(config *Config, chatID, threadID int64) {
 	sendMessage(config, chatID, threadID, "🔄 Updating ccc...")
 
 	binaryName := fmt.Sprintf("ccc-%s-%s", runtime.GOOS, runtime.GOARCH)
@@ -132,14 +157,44 @@ func updateCCC(config *Config, chatID, threadID int64, offset int) {
 	os.Remove(backupPath)
 
 	sendMessage(config, chatID, threadID, "✅ Updated. Restarting...")
-	// Confirm offset so the /update message is not reprocessed after restart
-	http.Get(fmt.Sprintf("https://api.telegram.org/bot%s/getUpdates?offset=%d&timeout=1", config.BotToken, offset))
+	// The /update message is fetched again after the restart, but the update
+	// ledger already has it, so it isn't run twice
 	os.Exit(0)
 }
 
+// telegramAPI calls a Bot API method, pacing requests through telegramLimiter.
+// Short 429 retry_after waits are slept through and retried; longer ones come
+// back as a not-OK response with ErrorCode 429 (see apiError).
 func telegramAPI(config *Config, method string, params url.Values) (*TelegramResponse, error) {
-	apiURL := fmt.Sprintf("https://api.telegram.org/bot%s/%s", config.BotToken, method)
-	resp, err := http.PostForm(apiURL, params)
+	chatKey := params.Get("chat_id")
+	for attempt := 0; ; attempt++ {
+		wait, ok := telegramLimiter.reserve(chatKey, maxInlineFloodWait)
+		if !ok {
+			// Still under flood control from an earlier 429: don't hit the API
+			return floodResponse(wait), nil
+		}
+		time.Sleep(wait)
+
+		result, err := telegramPost(config, method, params)
+		if err != nil || result.ErrorCode != 429 {
+			return result, err
+		}
+
+		retryAfter := time.Second
+		if result.Parameters != nil && result.Parameters.RetryAfter > 0 {
+			retryAfter = time.Duration(result.Parameters.RetryAfter) * time.Second
+		}
+		telegramLimiter.block(chatKey, retryAfter)
+		logEvent("", "flood_control", "telegram", method, fmt.Sprintf("chat=%s retry_after=%v", chatKey, retryAfter))
+		if retryAfter > maxInlineFloodWait || attempt >= 2 {
+			return result, nil
+		}
+	}
+}
+
+// telegramPost performs a single Bot API request without rate limiting
+func telegramPost(config *Config, method string, params url.Values) (*TelegramResponse, error) {
+	resp, err := http.PostForm(botURL(config, method), params)
 	if err != nil {
 		return nil, redactTokenError(err, config.BotToken)
 	}
@@ -148,9 +203,33 @@ func telegramAPI(config *Config, method string, params url.Values) (*TelegramRes
 	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
 	var result TelegramResponse
 	json.Unmarshal(body, &result)
+	if result.ErrorCode == 0 && resp.StatusCode == http.StatusTooManyRequests {
+		result.ErrorCode = resp.StatusCode
+	}
 	return &result, nil
 }
 
+// floodResponse builds a synthetic 429 response for a request skipped locally
+func floodResponse(wait time.Duration) *TelegramResponse {
+	return &TelegramResponse{
+		ErrorCode:   429,
+		Description: "Too Many Requests: flood control active",
+		Parameters:  &ResponseParams{RetryAfter: int((wait + time.Second - 1) / time.Second)},
+	}
+}
+
+// apiError converts a failed response into an error, a *RateLimitError for 429
+func apiError(result *TelegramResponse) error {
+	if result.ErrorCode == 429 {
+		retryAfter := time.Second
+		if result.Parameters != nil && result.Parameters.RetryAfter > 0 {
+			retryAfter = time.Duration(result.Parameters.RetryAfter) * time.Second
+		}
+		return &RateLimitError{RetryAfter: retryAfter, Description: result.Description}
+	}
+	return fmt.Errorf("telegram error: %s", result.Description)
+}
+
 func sendMessage(config *Config, chatID int64, threadID int64, text string) error {
 	_, err := sendMessageGetID(config, chatID, threadID, text)
 	return err
@@ -197,10 +276,10 @@ func sendMessageWithMode(config *Config, chatID int64, threadID int64, text stri
 					return 0, err
 				}
 				if !result.OK {
-					return 0, fmt.Errorf("telegram error: %s", result.Description)
+					return 0, apiError(result)
 				}
 			} else {
-				return 0, fmt.Errorf("telegram error: %s", result.Description)
+				return 0, apiError(result)
 			}
 		}
 
@@ -232,7 +311,30 @@ func editMessageHTML(config *Config, chatID int64, messageID int64, threadID int
 	return editMessageWithMode(config, chatID, messageID, threadID, text, "HTML")
 }
 
+// editMessageWithMode edits a message, coalescing concurrent edits to the same
+// message so only the newest text is sent once the current request completes
 func editMessageWithMode(config *Config, chatID int64, messageID int64, threadID int64, text string, parseMode string) error {
+	key := fmt.Sprintf("%d:%d", chatID, messageID)
+	if !messageEdits.begin(key, text) {
+		return nil // superseded text will be sent by the edit already in progress
+	}
+	for {
+		err := editMessageOnce(config, chatID, messageID, threadID, text, parseMode, nil)
+		next, ok := messageEdits.next(key)
+		if !ok {
+			return err
+		}
+		text = next
+	}
+}
+
+// editMessageHTMLWithKeyboard edits a message using HTML parse mode, keeping
+// (or setting) its inline keyboard, which a plain edit removes
+func editMessageHTMLWithKeyboard(config *Config, chatID int64, messageID int64, threadID int64, text string, buttons [][]InlineKeyboardButton) error {
+	return editMessageOnce(config, chatID, messageID, threadID, text, "HTML", buttons)
+}
+
+func editMessageOnce(config *Config, chatID int64, messageID int64, threadID int64, text string, parseMode string, buttons [][]InlineKeyboardButton) error {
 	const maxLen = 4000
 
 	// Split message - first part goes to edit, rest as new messages
@@ -245,14 +347,20 @@ func editMessageWithMode(config *Config, chatID int64, messageID int64, threadID
 		"text":       {messages[0]},
 		"parse_mode": {parseMode},
 	}
+	if buttons != nil {
+		keyboardJSON, _ := json.Marshal(map[string]interface{}{"inline_keyboard": buttons})
+		params.Set("reply_markup", string(keyboardJSON))
+	}
 
 	result, err := telegramAPI(config, "editMessageText", params)
 	if err != nil {
 		return err
 	}
 	if !result.OK {
-		// If edit fails (e.g., message not modified), ignore
-		return nil
+		if strings.Contains(result.Description, "message is not modified") {
+			return nil // already shows this text
+		}
+		return apiError(result)
 	}
 
 	// Send remaining parts as new messages
@@ -265,6 +373,12 @@ func editMessageWithMode(config *Config, chatID int64, messageID int64, threadID
 }
 
 func sendMessageWithKeyboard(config *Config, chatID int64, threadID int64, text string, buttons [][]InlineKeyboardButton) error {
+	_, err := sendMessageWithKeyboardGetID(config, chatID, threadID, text, buttons)
+	return err
+}
+
+// sendMessageWithKeyboardGetID sends a message with an inline keyboard and returns the ID of the message carrying it
+func sendMessageWithKeyboardGetID(config *Config, chatID int64, threadID int64, text string, buttons [][]InlineKeyboardButton) (int64, error) {
 	const maxLen = 4000
 
 	// Split long messages - send all but last as regular messages, last with keyboard
@@ -293,12 +407,17 @@ func sendMessageWithKeyboard(config *Config, chatID int64, threadID int64, text
 
 	result, err := telegramAPI(config, "sendMessage", params)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if !result.OK {
-		return fmt.Errorf("telegram error: %s", result.Description)
+		return 0, apiError(result)
 	}
-	return nil
+
+	var msgResult struct {
+		MessageID int64 `json:"message_id"`
+	}
+	json.Unmarshal(result.Result, &msgResult)
+	return msgResult.MessageID, nil
 }
 
 func answerCallbackQuery(config *Config, callbackID string) {
@@ -308,6 +427,15 @@ func answerCallbackQuery(config *Config, callbackID string) {
 	telegramAPI(config, "answerCallbackQuery", params)
 }
 
+// answerCallbackQueryText answers a button press with a short notice shown to the presser
+func answerCallbackQueryText(config *Config, callbackID string, text string) {
+	params := url.Values{
+		"callback_query_id": {callbackID},
+		"text":              {text},
+	}
+	telegramAPI(config, "answerCallbackQuery", params)
+}
+
 func editMessageRemoveKeyboard(config *Config, chatID int64, messageID int, newText string) {
 	const maxLen = 4000
 	if len(newText) > maxLen {
@@ -330,7 +458,12 @@ func sendTypingAction(config *Config, chatID int64, threadID int64) {
 	if threadID > 0 {
 		params.Set("message_thread_id", fmt.Sprintf("%d", threadID))
 	}
-	telegramAPI(config, "sendChatAction", params)
+	// Typing indicators are refreshed every few seconds per session; keep them
+	// out of the message budget and drop them entirely under flood control
+	if telegramLimiter.flooded(params.Get("chat_id")) {
+		return
+	}
+	telegramPost(config, "sendChatAction", params)
 }
 
 // markdownToHTML converts Markdown text to Telegram-supported HTML subset.
@@ -459,14 +592,49 @@ func splitMessage(text string, maxLen int) []string {
 	return messages
 }
 
-// sendFile sends a file to Telegram (max 50MB)
+// sendFile sends a file to Telegram (see maxUploadSize)
 func sendFile(config *Config, chatID int64, threadID int64, filePath string, caption string) error {
+	// A --local Bot API server reads the file straight from disk
+	if config.APILocal {
+		absPath, err := filepath.Abs(filePath)
+		if err != nil {
+			return err
+		}
+		params := url.Values{
+			"chat_id":  {fmt.Sprintf("%d", chatID)},
+			"document": {"file://" + absPath},
+		}
+		if threadID > 0 {
+			params.Set("message_thread_id", fmt.Sprintf("%d", threadID))
+		}
+		if caption != "" {
+			params.Set("caption", caption)
+		}
+		result, err := telegramAPI(config, "sendDocument", params)
+		if err != nil {
+			return err
+		}
+		if !result.OK {
+			return apiError(result)
+		}
+		return nil
+	}
+
 	file, err := os.Open(filePath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
+	return uploadFile(config, "sendDocument", "document", chatID, threadID, filepath.Base(filePath), file, caption)
+}
 
+// sendPhotoBytes uploads an in-memory image as a photo
+func sendPhotoBytes(config *Config, chatID int64, threadID int64, name string, data []byte, caption string) error {
+	return uploadFile(config, "sendPhoto", "photo", chatID, threadID, name, bytes.NewReader(data), caption)
+}
+
+// uploadFile posts a file as multipart form data to a send* method
+func uploadFile(config *Config, method string, field string, chatID int64, threadID int64, name string, r io.Reader, caption string) error {
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
 
@@ -480,15 +648,22 @@ func sendFile(config *Config, chatID int64, threadID int64, filePath string, cap
 	}
 
 	// Add file
-	part, err := writer.CreateFormFile("document", filepath.Base(filePath))
+	part, err := writer.CreateFormFile(field, name)
 	if err != nil {
 		return err
 	}
-	io.Copy(part, file)
+	io.Copy(part, r)
 	writer.Close()
 
+	chatKey := fmt.Sprintf("%d", chatID)
+	wait, ok := telegramLimiter.reserve(chatKey, maxInlineFloodWait)
+	if !ok {
+		return apiError(floodResponse(wait))
+	}
+	time.Sleep(wait)
+
 	resp, err := http.Post(
-		fmt.Sprintf("https://api.telegram.org/bot%s/sendDocument", config.BotToken),
+		botURL(config, method),
 		writer.FormDataContentType(),
 		body,
 	)
@@ -500,7 +675,10 @@ func sendFile(config *Config, chatID int64, threadID int64, filePath string, cap
 	var result TelegramResponse
 	json.NewDecoder(resp.Body).Decode(&result)
 	if !result.OK {
-		return fmt.Errorf("telegram error: %s", result.Description)
+		if result.ErrorCode == 429 && result.Parameters != nil {
+			telegramLimiter.block(chatKey, time.Duration(result.Parameters.RetryAfter)*time.Second)
+		}
+		return apiError(&result)
 	}
 	return nil
 }
@@ -508,7 +686,7 @@ func sendFile(config *Config, chatID int64, threadID int64, filePath string, cap
 // downloadTelegramFile downloads a file from Telegram
 func downloadTelegramFile(config *Config, fileID string, destPath string) error {
 	// Get file path from Telegram
-	resp, err := telegramGet(config.BotToken, fmt.Sprintf("https://api.telegram.org/bot%s/getFile?file_id=%s", config.BotToken, fileID))
+	resp, err := telegramGet(config.BotToken, botURL(config, "getFile")+"?file_id="+url.QueryEscape(fileID))
 	if err != nil {
 		return err
 	}
@@ -527,9 +705,13 @@ func downloadTelegramFile(config *Config, fileID string, destPath string) error
 		return fmt.Errorf("failed to get file path")
 	}
 
+	// A --local Bot API server returns an absolute path on its own disk
+	if config.APILocal && filepath.IsAbs(result.Result.FilePath) {
+		return copyLocalFile(result.Result.FilePath, destPath)
+	}
+
 	// Download the file
-	fileURL := fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", config.BotToken, result.Result.FilePath)
-	fileResp, err := telegramGet(config.BotToken, fileURL)
+	fileResp, err := telegramGet(config.BotToken, fileURL(config, result.Result.FilePath))
 	if err != nil {
 		return err
 	}
@@ -545,6 +727,24 @@ func downloadTelegramFile(config *Config, fileID string, destPath string) error
 	return err
 }
 
+// copyLocalFile copies src to dst
+func copyLocalFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
 func createForumTopic(config *Config, name string) (int64, error) {
 	if config.GroupID == 0 {
 		return 0, fmt.Errorf("no group configured. Add bot to a group with topics enabled and run: ccc setgroup")
@@ -571,6 +771,39 @@ func createForumTopic(config *Config, name string) (int64, error) {
 	return topic.MessageThreadID, nil
 }
 
+// pinChatMessage pins a message in the group without notifying members
+func pinChatMessage(config *Config, messageID int64) error {
+	params := url.Values{
+		"chat_id":              {fmt.Sprintf("%d", config.GroupID)},
+		"message_id":           {fmt.Sprintf("%d", messageID)},
+		"disable_notification": {"true"},
+	}
+	result, err := telegramAPI(config, "pinChatMessage", params)
+	if err != nil {
+		return err
+	}
+	if !result.OK {
+		return fmt.Errorf("failed to pin message: %s", result.Description)
+	}
+	return nil
+}
+
+// unpinChatMessage unpins a message pinned by pinChatMessage
+func unpinChatMessage(config *Config, messageID int64) error {
+	params := url.Values{
+		"chat_id":    {fmt.Sprintf("%d", config.GroupID)},
+		"message_id": {fmt.Sprintf("%d", messageID)},
+	}
+	result, err := telegramAPI(config, "unpinChatMessage", params)
+	if err != nil {
+		return err
+	}
+	if !result.OK {
+		return fmt.Errorf("failed to unpin message: %s", result.Description)
+	}
+	return nil
+}
+
 func deleteForumTopic(config *Config, topicID int64) error {
 	if config.GroupID == 0 {
 		return fmt.Errorf("no group configured")
@@ -593,17 +826,29 @@ func deleteForumTopic(config *Config, topicID int64) error {
 }
 
 // setBotCommands sets the bot commands in Telegram
-func setBotCommands(botToken string) {
+func setBotCommands(config *Config) {
 	commands := []map[string]string{
 		{"command": "new", "description": "Create/restart session: /new <name>"},
 		{"command": "delete", "description": "Delete current session and thread"},
 		{"command": "cleanup", "description": "Delete ALL sessions, folders and threads"},
 		{"command": "c", "description": "Execute shell command: /c <cmd>"},
 		{"command": "continue", "description": "Restart session with history"},
+		{"command": "list", "description": "Show all sessions and their state"},
 		{"command": "update", "description": "Update ccc binary from GitHub"},
 		{"command": "version", "description": "Show ccc version"},
 		{"command": "stats", "description": "Show system stats (RAM, disk, etc)"},
 		{"command": "auth", "description": "Re-authenticate Claude OAuth"},
+		{"command": "diffs", "description": "Send diffs of Claude's edits: /diffs [on|off]"},
+		{"command": "screen", "description": "Snapshot of the terminal: /screen [png] [lines]"},
+		{"command": "stop", "description": "Cancel Claude's current turn (Escape)"},
+		{"command": "interrupt", "description": "Send Ctrl-C to the session"},
+		{"command": "mode", "description": "Cycle permission mode (Shift-Tab)"},
+		{"command": "keys", "description": "Send tmux keys: /keys Down Enter"},
+		{"command": "queue", "description": "Queued prompts and undelivered messages"},
+		{"command": "now", "description": "Send the next queued prompt now"},
+		{"command": "search", "description": "Search conversations: /search <query> [session]"},
+		{"command": "export", "description": "Export the conversation: /export [md|html|json] [since]"},
+		{"command": "users", "description": "Manage users and roles"},
 	}
 
 	// Set for default scope
@@ -611,7 +856,7 @@ func setBotCommands(botToken string) {
 		"commands": commands,
 	})
 	resp, err := http.Post(
-		fmt.Sprintf("https://api.telegram.org/bot%s/setMyCommands", botToken),
+		botURL(config, "setMyCommands"),
 		"application/json",
 		bytes.NewReader(defaultBody),
 	)
@@ -625,7 +870,7 @@ func setBotCommands(botToken string) {
 		"scope":    map[string]string{"type": "all_group_chats"},
 	})
 	resp, err = http.Post(
-		fmt.Sprintf("https://api.telegram.org/bot%s/setMyCommands", botToken),
+		botURL(config, "setMyCommands"),
 		"application/json",
 		bytes.NewReader(groupBody),
 	)
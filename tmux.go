@@ -180,7 +180,7 @@ func runClaudeRaw(continueSession bool) error {
 	if winName, err := exec.Command(tmuxPath, "display-message", "-p", "#{window_name}").Output(); err == nil {
 		name := strings.TrimSpace(string(winName))
 		if name != "" {
-			os.Remove(telegramActiveFlag(name))
+			clearTelegramActive(name)
 		}
 	}
 
@@ -238,12 +238,12 @@ func windowNameFromTarget(target string) string {
 }
 
 func sendToTmuxFromTelegram(target string, windowName string, text string) error {
-	os.WriteFile(telegramActiveFlag(windowName), []byte("1"), 0600)
+	setTelegramActive(windowName)
 	return sendToTmux(target, text)
 }
 
 func sendToTmuxFromTelegramWithDelay(target string, windowName string, text string, delay time.Duration) error {
-	os.WriteFile(telegramActiveFlag(windowName), []byte("1"), 0600)
+	setTelegramActive(windowName)
 	return sendToTmuxWithDelay(target, text, delay)
 }
 
@@ -287,6 +287,38 @@ func sendToTmuxWithDelay(target string, text string, delay time.Duration) error
 	return nil
 }
 
+// sendKeys sends tmux key names (Escape, C-c, BTab, Down...) to a target
+func sendKeys(target string, keys ...string) error {
+	args := append([]string{"send-keys", "-t", target}, keys...)
+	if out, err := exec.Command(tmuxPath, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// capturePaneANSI returns a pane's content with color escape sequences.
+// history > 0 also includes that many lines of scrollback.
+func capturePaneANSI(target string, history int) (string, error) {
+	args := []string{"capture-pane", "-t", target, "-p", "-e"}
+	if history > 0 {
+		args = append(args, "-S", fmt.Sprintf("-%d", history))
+	}
+	out, err := exec.Command(tmuxPath, args...).Output()
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// capturePane returns the visible content of a pane, without trailing blank lines
+func capturePane(target string) (string, error) {
+	out, err := exec.Command(tmuxPath, "capture-pane", "-t", target, "-p").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\n "), nil
+}
+
 func killTmuxWindow(windowID string, windowName string) error {
 	target := tmuxTargetByID(windowID, windowName)
 	cmd := exec.Command(tmuxPath, "kill-window", "-t", target)
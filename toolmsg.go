@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// toolEditInterval is the minimum time between edits of a tool blockquote.
+// Tool events arriving in between (e.g. parallel tool calls) are coalesced
+// into the next edit.
+const toolEditInterval = time.Second
+
+// toolEdit tracks whether a session's blockquote on Telegram is behind its
+// tool state
+type toolEdit struct {
+	Dirty     bool      // tool state has events the message doesn't show yet
+	Last      time.Time // last send or edit of the message
+	Scheduled bool      // a wakeup is pending for the next allowed edit
+	Failures  int
+}
+
+var (
+	toolEdits   = make(map[string]*toolEdit) // session -> blockquote edit state
+	toolEditsMu sync.Mutex
+)
+
+// questionPrompt is an AskUserQuestion question queued by the PreToolUse
+// hook, stored as JSON in the message text
+type questionPrompt struct {
+	Text    string                   `json:"text"`
+	Buttons [][]InlineKeyboardButton `json:"buttons"`
+}
+
+// toolCallFromRecord turns a tool_call or tool_text record into a blockquote line
+func toolCallFromRecord(rec *MessageRecord) ToolCall {
+	if rec.Type == "tool_text" {
+		return ToolCall{IsText: true, Input: rec.Text, Time: rec.Timestamp, Ref: rec.ID}
+	}
+	name, input, _ := strings.Cut(rec.Text, ": ")
+	return ToolCall{Name: name, Input: input, Time: rec.Timestamp, Ref: rec.ID}
+}
+
+// hasToolMessage reports whether a session has a blockquote for the current turn
+func hasToolMessage(sessName string) bool {
+	return loadToolState(sessName).MsgID != 0
+}
+
+// addToolEvent adds a tool call or text to the session's blockquote. The
+// first event of a turn sends the message; later ones are edited in by
+// flushToolEdit. Returns the blockquote's message ID.
+func addToolEvent(config *Config, sessName string, topicID int64, rec *MessageRecord) (int64, error) {
+	state := loadToolState(sessName)
+	state.Tools = append(state.Tools, toolCallFromRecord(rec))
+
+	toolEditsMu.Lock()
+	defer toolEditsMu.Unlock()
+	e := toolEdits[sessName]
+	if e == nil {
+		e = &toolEdit{}
+		toolEdits[sessName] = e
+	}
+
+	if state.MsgID == 0 {
+		msgID, err := sendMessageHTMLGetID(config, config.GroupID, topicID, formatToolMessage(state))
+		if err != nil {
+			return 0, err
+		}
+		state.MsgID = msgID
+		e.Dirty, e.Last = false, time.Now()
+	} else {
+		e.Dirty = true
+	}
+	saveToolState(sessName, state)
+	return state.MsgID, nil
+}
+
+// markToolEditDirty has the next flushToolEdit edit the session's blockquote
+func markToolEditDirty(sessName string) {
+	toolEditsMu.Lock()
+	defer toolEditsMu.Unlock()
+	e := toolEdits[sessName]
+	if e == nil {
+		e = &toolEdit{}
+		toolEdits[sessName] = e
+	}
+	e.Dirty = true
+}
+
+// reviseText applies a revised reply to the Telegram message it was sent in:
+// its line in the current blockquote, or the message itself. A line in a
+// finished blockquote is left as sent.
+func reviseText(config *Config, sessName string, topicID int64, rec *MessageRecord, html string) (int64, error) {
+	state := loadToolState(sessName)
+	if state.MsgID == rec.TgMsgID {
+		for i := range state.Tools {
+			if state.Tools[i].Ref == rec.ID {
+				state.Tools[i].Input = rec.Text
+				saveToolState(sessName, state)
+				markToolEditDirty(sessName)
+				return rec.TgMsgID, nil
+			}
+		}
+	}
+	if sharesTgMessage(sessName, rec.TgMsgID, rec.ID) {
+		return rec.TgMsgID, nil
+	}
+	return rec.TgMsgID, editMessageHTML(config, config.GroupID, rec.TgMsgID, topicID, html)
+}
+
+// flushToolEdit edits the session's blockquote if it is behind, at most once
+// per toolEditInterval unless force is set. Failed edits stay pending and
+// are retried on later passes of deliveryLoop.
+func flushToolEdit(config *Config, sessName string, topicID int64, force bool) {
+	toolEditsMu.Lock()
+	e := toolEdits[sessName]
+	if e == nil || !e.Dirty {
+		toolEditsMu.Unlock()
+		return
+	}
+	if wait := toolEditInterval - time.Since(e.Last); wait > 0 && !force {
+		if !e.Scheduled {
+			e.Scheduled = true
+			time.AfterFunc(wait, func() {
+				toolEditsMu.Lock()
+				e.Scheduled = false
+				toolEditsMu.Unlock()
+				wakeDelivery()
+			})
+		}
+		toolEditsMu.Unlock()
+		return
+	}
+	toolEditsMu.Unlock()
+
+	state := loadToolState(sessName)
+	if state.MsgID == 0 {
+		return
+	}
+	var err error
+	if buttons := toolOutputKeyboard(sessName, state); buttons != nil {
+		err = editMessageHTMLWithKeyboard(config, config.GroupID, state.MsgID, topicID, formatToolMessage(state), buttons)
+	} else {
+		err = editMessageHTML(config, config.GroupID, state.MsgID, topicID, formatToolMessage(state))
+	}
+
+	toolEditsMu.Lock()
+	defer toolEditsMu.Unlock()
+	e.Last = time.Now()
+	if err == nil {
+		e.Dirty, e.Failures = false, 0
+		return
+	}
+	e.Failures++
+	listenLog("[tools] %s: edit failed (%d/%d): %v", sessName, e.Failures, maxRetries, err)
+	if e.Failures >= maxRetries {
+		// The next tool event edits the message again
+		e.Dirty, e.Failures = false, 0
+	}
+}
+
+// endToolMessage finishes the session's blockquote before a new prompt or
+// Claude's reply, so the next tool call starts a new one
+func endToolMessage(config *Config, sessName string, topicID int64) {
+	flushToolEdit(config, sessName, topicID, true)
+	clearToolState(sessName)
+	toolEditsMu.Lock()
+	delete(toolEdits, sessName)
+	toolEditsMu.Unlock()
+}
+
+// sendQuestion sends a queued AskUserQuestion question with its option buttons
+func sendQuestion(config *Config, topicID int64, rec *MessageRecord) (int64, error) {
+	var q questionPrompt
+	if err := json.Unmarshal([]byte(rec.Text), &q); err != nil || len(q.Buttons) == 0 {
+		return 0, nil // nothing to ask
+	}
+	return sendMessageWithKeyboardGetID(config, config.GroupID, topicID, q.Text, q.Buttons)
+}
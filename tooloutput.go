@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// outputCallbackPrefix marks the "show output" button of a tool blockquote:
+// out:<blockquote message ID>:<session>
+const outputCallbackPrefix = "out:"
+
+// maxToolOutput caps the output stored per tool call
+const maxToolOutput = 64 * 1024
+
+// toolResult is how a tool call ended, recorded as a tool_result message by
+// the PostToolUse hook, or from the transcript for calls that failed (Claude
+// Code doesn't run PostToolUse for those)
+type toolResult struct {
+	Call     string `json:"call,omitempty"` // ID of the tool_call message, if known
+	Name     string `json:"name"`
+	Input    string `json:"input"`
+	Failed   bool   `json:"failed,omitempty"`
+	Output   string `json:"output,omitempty"`
+	ToolID   string `json:"tool_use_id,omitempty"`
+	Finished int64  `json:"finished"` // unix ms
+}
+
+// toolCallID returns the message ID of a tool call: its tool_use_id when the
+// hook payload has one, so its result can find it
+func toolCallID(hookData HookData) string {
+	if hookData.ToolUseID != "" {
+		return "tool:" + hookData.ToolUseID
+	}
+	return fmt.Sprintf("tool:%s:%s:%d", hookData.SessionID, contentHash(hookData.ToolName+toolInputSummary(hookData)), time.Now().UnixNano())
+}
+
+// toolResponseOutput extracts the output of a PostToolUse tool_response and
+// whether it reports a failure. Built-in tools answer with objects of their
+// own shape; anything not recognized is kept as JSON.
+func toolResponseOutput(raw json.RawMessage) (string, bool) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", false
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s, false
+	}
+	var r struct {
+		Stdout      string          `json:"stdout"`
+		Stderr      string          `json:"stderr"`
+		Interrupted bool            `json:"interrupted"`
+		ExitCode    *int            `json:"exit_code"`
+		Error       string          `json:"error"`
+		IsError     bool            `json:"is_error"`
+		Content     json.RawMessage `json:"content"`
+	}
+	if json.Unmarshal(raw, &r) != nil {
+		// A list of content blocks (MCP tools)
+		b := ContentBlock{Content: raw}
+		return b.ResultText(), false
+	}
+	failed := r.Interrupted || r.Error != "" || r.IsError || (r.ExitCode != nil && *r.ExitCode != 0)
+	switch {
+	case r.Stdout != "" || r.Stderr != "":
+		return strings.Trim(strings.TrimRight(r.Stdout, "\n")+"\n"+strings.TrimRight(r.Stderr, "\n"), "\n"), failed
+	case r.Error != "":
+		return r.Error, failed
+	case len(r.Content) > 0:
+		b := ContentBlock{Content: r.Content}
+		return b.ResultText(), failed
+	}
+	out, _ := json.MarshalIndent(raw, "", "  ")
+	return string(out), failed
+}
+
+// recordToolResult records how a tool call ended for deliveryLoop to show
+// in the blockquote. A result seen again (hook and transcript) is ignored.
+func recordToolResult(sessName string, res *toolResult) {
+	if len(res.Output) > maxToolOutput {
+		cut := maxToolOutput
+		for cut > 0 && !utf8.RuneStart(res.Output[cut]) {
+			cut--
+		}
+		res.Output = res.Output[:cut] + "\n… (truncated)"
+	}
+	id := "result:" + res.ToolID
+	if res.ToolID == "" {
+		id = fmt.Sprintf("result:%s:%d", contentHash(res.Name+res.Input), time.Now().UnixNano())
+	}
+	data, _ := json.Marshal(res)
+	appendMessage(&MessageRecord{ID: id, Session: sessName, Type: "tool_result", Text: string(data), Origin: "claude"})
+}
+
+// recordTranscriptResults records the failed tool calls among transcript
+// entries. Returns how many were new.
+func recordTranscriptResults(sessName string, entries []*TranscriptEntry) int {
+	n := 0
+	for _, e := range entries {
+		if e.Type != "user" || e.IsSidechain {
+			continue
+		}
+		for _, b := range e.Blocks {
+			if b.Type != "tool_result" || !b.IsError || b.ToolUseID == "" || hasMessage("result:"+b.ToolUseID) {
+				continue
+			}
+			finished := e.Time().UnixMilli()
+			if e.Time().IsZero() {
+				finished = time.Now().UnixMilli()
+			}
+			res := &toolResult{Call: "tool:" + b.ToolUseID, Failed: true, Output: b.ResultText(), ToolID: b.ToolUseID, Finished: finished}
+			res.Name, res.Input, _ = strings.Cut(messageText(res.Call), ": ")
+			recordToolResult(sessName, res)
+			n++
+		}
+	}
+	return n
+}
+
+// applyToolResult marks the tool call a result belongs to in the session's
+// blockquote. Returns the blockquote's message ID, or 0 if the call isn't in
+// the current one.
+func applyToolResult(sessName string, rec *MessageRecord) int64 {
+	var res toolResult
+	if json.Unmarshal([]byte(rec.Text), &res) != nil {
+		return 0
+	}
+	state := loadToolState(sessName)
+	if state.MsgID == 0 {
+		return 0
+	}
+	found := -1
+	for i := len(state.Tools) - 1; i >= 0; i-- {
+		t := state.Tools[i]
+		if t.IsText || t.Status != "" {
+			continue
+		}
+		if (res.Call != "" && t.Ref == res.Call) || (res.Name != "" && t.Name == res.Name && t.Input == res.Input) {
+			found = i
+			break
+		}
+	}
+	if found < 0 {
+		return 0
+	}
+	t := &state.Tools[found]
+	t.Status = "ok"
+	if res.Failed {
+		t.Status = "error"
+	}
+	if t.Time > 0 && res.Finished > t.Time {
+		t.Duration = res.Finished - t.Time
+	}
+	t.Excerpt = outputExcerpt(res.Output)
+	saveToolState(sessName, state)
+	markToolEditDirty(sessName)
+	return state.MsgID
+}
+
+// outputExcerpt returns the last non-empty line of a tool's output, where
+// errors and summaries usually are
+func outputExcerpt(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return truncateRunes(strings.TrimSpace(lines[len(lines)-1]), 80)
+}
+
+// formatToolDuration renders a tool's elapsed time: 0.4s, 12s, 3m
+func formatToolDuration(ms int64) string {
+	d := time.Duration(ms) * time.Millisecond
+	if d < 10*time.Second {
+		return fmt.Sprintf("%.1fs", d.Seconds())
+	}
+	return formatAge(d)
+}
+
+// toolOutputKeyboard returns the "show output" button of a blockquote once
+// any of its tool calls has finished
+func toolOutputKeyboard(sessName string, state *ToolState) [][]InlineKeyboardButton {
+	for _, t := range state.Tools {
+		if t.Status != "" {
+			data := fmt.Sprintf("%s%d:%s", outputCallbackPrefix, state.MsgID, sessName)
+			if len(data) > 64 {
+				return nil // session name too long for callback data
+			}
+			return [][]InlineKeyboardButton{{{Text: "📄 Show output", CallbackData: data}}}
+		}
+	}
+	return nil
+}
+
+// transcriptToolOutput looks up a tool_result in a transcript, for results
+// recorded without output
+func transcriptToolOutput(path string, toolUseID string) string {
+	output := ""
+	readTranscript(path, func(e *TranscriptEntry) {
+		for _, b := range e.Blocks {
+			if b.Type == "tool_result" && b.ToolUseID == toolUseID {
+				output = b.ResultText()
+			}
+		}
+	})
+	return output
+}
+
+// handleOutputCallback sends the output of the tool calls of a blockquote:
+// as collapsed quotes when short, as a text file otherwise
+func handleOutputCallback(config *Config, cb *CallbackQuery) {
+	idStr, sessName, ok := strings.Cut(strings.TrimPrefix(cb.Data, outputCallbackPrefix), ":")
+	msgID, err := strconv.ParseInt(idStr, 10, 64)
+	if !ok || err != nil || cb.Message == nil {
+		return
+	}
+	chatID, threadID := cb.Message.Chat.ID, cb.Message.MessageThreadID
+
+	type call struct{ head, output string }
+	var calls []call
+	for _, rec := range toolResults(sessName, msgID) {
+		var res toolResult
+		if json.Unmarshal([]byte(rec.Text), &res) != nil {
+			continue
+		}
+		if res.Output == "" && res.ToolID != "" {
+			if info := config.Sessions[sessName]; info != nil && info.TranscriptPath != "" {
+				res.Output = transcriptToolOutput(info.TranscriptPath, res.ToolID)
+			}
+		}
+		head := "✅ " + res.Name
+		if res.Failed {
+			head = "❌ " + res.Name
+		}
+		if res.Input != "" {
+			head += ": " + res.Input
+		}
+		calls = append(calls, call{head, res.Output})
+	}
+	if len(calls) == 0 {
+		sendMessage(config, chatID, threadID, "📄 No output recorded for these tools")
+		return
+	}
+
+	var sb strings.Builder
+	for _, c := range calls {
+		sb.WriteString(fmt.Sprintf("<b>%s</b>\n<blockquote expandable>%s</blockquote>\n", htmlEscape(c.head), htmlEscape(c.output)))
+	}
+	if sb.Len() <= 4000 {
+		sendMessageHTMLGetID(config, chatID, threadID, sb.String())
+		return
+	}
+
+	var text strings.Builder
+	for _, c := range calls {
+		text.WriteString(c.head + "\n" + c.output + "\n\n")
+	}
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("%s-tools-%d.txt", sessName, msgID))
+	if err := os.WriteFile(path, []byte(text.String()), 0600); err != nil {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to write output: %v", err))
+		return
+	}
+	defer os.Remove(path)
+	if err := sendFile(config, chatID, threadID, path, fmt.Sprintf("📄 Tool output (%d calls)", len(calls))); err != nil {
+		sendMessage(config, chatID, threadID, fmt.Sprintf("❌ Failed to send output: %v", err))
+	}
+}
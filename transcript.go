@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// TranscriptEntry is one line of a Claude Code transcript (JSONL). Most lines
+// are user or assistant messages; the rest are system, summary, progress
+// and file-history-snapshot entries (see "Claude Code Transcript Format" in
+// the README).
+type TranscriptEntry struct {
+	Type              string `json:"type"`
+	Subtype           string `json:"subtype,omitempty"` // system entries, e.g. compact_boundary
+	UUID              string `json:"uuid,omitempty"`
+	ParentUUID        string `json:"parentUuid,omitempty"`
+	RequestID         string `json:"requestId,omitempty"`
+	SessionID         string `json:"sessionId,omitempty"`
+	Timestamp         string `json:"timestamp,omitempty"`
+	Cwd               string `json:"cwd,omitempty"`
+	Version           string `json:"version,omitempty"`
+	GitBranch         string `json:"gitBranch,omitempty"`
+	Slug              string `json:"slug,omitempty"`
+	UserType          string `json:"userType,omitempty"`
+	IsSidechain       bool   `json:"isSidechain,omitempty"` // subagent conversation
+	IsMeta            bool   `json:"isMeta,omitempty"`      // injected by Claude Code, not typed by the user
+	IsApiErrorMessage bool   `json:"isApiErrorMessage,omitempty"`
+	ToolUseID         string `json:"toolUseID,omitempty"` // progress entries
+	Message           struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"` // a string or a list of blocks
+	} `json:"message"`
+	Content json.RawMessage `json:"content,omitempty"` // system and summary entries
+	Summary string          `json:"summary,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"` // progress entries
+
+	Blocks []ContentBlock `json:"-"` // Message.Content, a string becoming one text block
+}
+
+// ContentBlock is an element of a message's content
+type ContentBlock struct {
+	Type      string          `json:"type"` // text / thinking / tool_use / tool_result / image
+	Text      string          `json:"text,omitempty"`
+	Thinking  string          `json:"thinking,omitempty"`
+	ID        string          `json:"id,omitempty"`          // tool_use
+	Name      string          `json:"name,omitempty"`        // tool_use
+	Input     json.RawMessage `json:"input,omitempty"`       // tool_use
+	ToolUseID string          `json:"tool_use_id,omitempty"` // tool_result
+	Content   json.RawMessage `json:"content,omitempty"`     // tool_result: a string or a list of blocks
+	IsError   bool            `json:"is_error,omitempty"`    // tool_result
+}
+
+// parseTranscriptLine decodes a transcript line and its content blocks
+func parseTranscriptLine(line []byte) (*TranscriptEntry, error) {
+	var e TranscriptEntry
+	if err := json.Unmarshal(line, &e); err != nil {
+		return nil, err
+	}
+	e.Blocks = parseContentBlocks(e.Message.Content)
+	return &e, nil
+}
+
+// parseContentBlocks decodes message content, which is a plain string in
+// some user entries and a list of blocks everywhere else
+func parseContentBlocks(raw json.RawMessage) []ContentBlock {
+	if len(raw) == 0 {
+		return nil
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return []ContentBlock{{Type: "text", Text: text}}
+	}
+	var blocks []ContentBlock
+	json.Unmarshal(raw, &blocks)
+	return blocks
+}
+
+// Time returns when the entry was written, or the zero time
+func (e *TranscriptEntry) Time() time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, e.Timestamp)
+	return t
+}
+
+// Role returns the message role, or "" for entries without a message
+func (e *TranscriptEntry) Role() string {
+	return e.Message.Role
+}
+
+// text returns the entry's text outside of message blocks (system content,
+// summaries, progress data)
+func (e *TranscriptEntry) text() string {
+	if e.Summary != "" {
+		return e.Summary
+	}
+	for _, raw := range []json.RawMessage{e.Content, e.Data} {
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			return s
+		}
+		if len(raw) > 0 {
+			return string(raw)
+		}
+	}
+	return ""
+}
+
+// ResultText returns a tool_result's output as text
+func (b *ContentBlock) ResultText() string {
+	var s string
+	if json.Unmarshal(b.Content, &s) == nil {
+		return s
+	}
+	var parts []string
+	for _, inner := range parseContentBlocks(b.Content) {
+		if inner.Type == "text" {
+			parts = append(parts, inner.Text)
+		} else {
+			parts = append(parts, "["+inner.Type+"]")
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// ToolSummary describes a tool_use block the way tool blockquotes do,
+// e.g. "Bash: npm test"
+func (b *ContentBlock) ToolSummary() string {
+	hd := HookData{ToolName: b.Name}
+	json.Unmarshal(b.Input, &hd.ToolInput)
+	if summary := toolInputSummary(hd); summary != "" {
+		return b.Name + ": " + summary
+	}
+	return b.Name
+}
+
+// readTranscript calls fn for each entry of a transcript, in file order.
+// Lines that aren't valid JSON (e.g. one still being written) are skipped.
+func readTranscript(path string, fn func(e *TranscriptEntry)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = readTranscriptFrom(f, fn)
+	return err
+}
+
+// readTranscriptFrom reads lines from r and returns the number of bytes
+// consumed. A trailing line that isn't valid JSON yet is left unread, so a
+// follower can pick it up once it is complete.
+func readTranscriptFrom(r io.Reader, fn func(e *TranscriptEntry)) (int64, error) {
+	// Lines can be larger than bufio.Scanner allows (tool results, images)
+	br := bufio.NewReader(r)
+	var n int64
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			if e, perr := parseTranscriptLine(line); len(line) > 0 && perr == nil {
+				fn(e)
+				n += int64(len(line))
+			}
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n += int64(len(line))
+		if e, err := parseTranscriptLine(line); err == nil {
+			fn(e)
+		}
+	}
+}
+
+// transcriptTailWindow is how much of a transcript is read when its cursor
+// can't be used: the first read, or after the file was replaced or rewritten
+const transcriptTailWindow = 512 * 1024
+
+// readNewTranscript returns the entries written to a transcript since the
+// last call for that path (by any process), advancing its cursor past the
+// last complete line
+func readNewTranscript(path string) ([]*TranscriptEntry, error) {
+	var entries []*TranscriptEntry
+	err := advanceTranscriptCursor(path, func(cur *transcriptCursor) (*transcriptCursor, error) {
+		entries = nil
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		start, resync := int64(0), !cursorValid(f, fi, cur)
+		if !resync {
+			start = cur.Offset
+		} else if fi.Size() > transcriptTailWindow {
+			start = fi.Size() - transcriptTailWindow
+		}
+		f.Seek(start, io.SeekStart)
+		br := bufio.NewReader(f)
+		if resync && start > 0 {
+			// Skip the partial line the window starts in
+			partial, _ := br.ReadBytes('\n')
+			start += int64(len(partial))
+		}
+		n, err := readTranscriptFrom(br, func(e *TranscriptEntry) { entries = append(entries, e) })
+		if err != nil {
+			return nil, err
+		}
+		return &transcriptCursor{Offset: start + n, Inode: fileInode(fi), Size: fi.Size()}, nil
+	})
+	return entries, err
+}
+
+// cursorValid reports whether a transcript is still the file its cursor was
+// taken on, at most grown since: same inode, not shorter, and the cursor
+// still right after a line
+func cursorValid(f *os.File, fi os.FileInfo, cur *transcriptCursor) bool {
+	if cur == nil || cur.Inode != fileInode(fi) || fi.Size() < cur.Offset {
+		return false
+	}
+	if cur.Offset == 0 {
+		return true
+	}
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, cur.Offset-1); err != nil {
+		return false
+	}
+	// A last line read without its newline ends in '}'
+	return b[0] == '\n' || b[0] == '}'
+}
+
+// watchTranscripts delivers replies Claude writes after its turn ended: the
+// Stop hook can fire before the transcript is flushed. Called from
+// deliveryLoop. Sessions mid-turn are left to their hooks, which know
+// whether text came before a tool call; transcripts no hook has read yet
+// are skipped, so old replies aren't sent when the listener starts.
+func watchTranscripts(config *Config) {
+	if config.GroupID == 0 {
+		return
+	}
+	for sessName, info := range config.Sessions {
+		if info == nil || info.TopicID == 0 || info.TranscriptPath == "" || isThinking(sessName) {
+			continue
+		}
+		cur := loadTranscriptCursor(info.TranscriptPath)
+		if cur == nil {
+			continue
+		}
+		fi, err := os.Stat(info.TranscriptPath)
+		if err != nil || (cur.Inode == fileInode(fi) && cur.Size == fi.Size()) {
+			continue
+		}
+		if n := deliverUnsentTexts(config, sessName, info.TopicID, info.TranscriptPath, false); n > 0 {
+			listenLog("[transcript] %s: %d late message(s)", sessName, n)
+		}
+	}
+}
+
+// --- ccc transcript ---
+
+// transcriptRow is a line of `ccc transcript` output: one per content block,
+// or one for an entry without blocks
+type transcriptRow struct {
+	Entry       *TranscriptEntry
+	ContentType string
+	ToolName    string
+	ToolUseID   string
+	IsError     bool
+	Content     string
+}
+
+// transcriptCSVHeader lists the columns of `ccc transcript --csv`
+var transcriptCSVHeader = []string{
+	"time", "type", "uuid", "parentUuid", "requestId", "sessionId", "isApiErrorMessage", "isSidechain", "userType",
+	"cwd", "version", "gitBranch", "slug", "message_role", "content_type", "tool_name", "tool_use_id", "is_error", "content",
+}
+
+// transcriptRows flattens an entry into rows
+func transcriptRows(e *TranscriptEntry) []transcriptRow {
+	if len(e.Blocks) == 0 {
+		return []transcriptRow{{Entry: e, ToolUseID: e.ToolUseID, Content: e.text()}}
+	}
+	rows := make([]transcriptRow, 0, len(e.Blocks))
+	for _, b := range e.Blocks {
+		row := transcriptRow{Entry: e, ContentType: b.Type}
+		switch b.Type {
+		case "text":
+			row.Content = b.Text
+		case "thinking":
+			row.Content = b.Thinking
+		case "tool_use":
+			row.ToolName, row.ToolUseID, row.Content = b.Name, b.ID, string(b.Input)
+		case "tool_result":
+			row.ToolUseID, row.IsError, row.Content = b.ToolUseID, b.IsError, b.ResultText()
+		default:
+			raw, _ := json.Marshal(b)
+			row.Content = string(raw)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// csvRecord renders a row for --csv, with the full content
+func (r transcriptRow) csvRecord() []string {
+	e := r.Entry
+	when, isError := "", ""
+	if t := e.Time(); !t.IsZero() {
+		when = t.Local().Format("2006-01-02 15:04:05")
+	}
+	if r.ContentType == "tool_result" {
+		isError = strconv.FormatBool(r.IsError)
+	}
+	return []string{
+		when, e.Type, e.UUID, e.ParentUUID, e.RequestID, e.SessionID,
+		strconv.FormatBool(e.IsApiErrorMessage), strconv.FormatBool(e.IsSidechain), e.UserType,
+		e.Cwd, e.Version, e.GitBranch, e.Slug, e.Role(), r.ContentType, r.ToolName, r.ToolUseID,
+		isError, r.Content,
+	}
+}
+
+// tableLine renders a row for the terminal table, content on one line
+func (r transcriptRow) tableLine() string {
+	e := r.Entry
+	when := ""
+	if t := e.Time(); !t.IsZero() {
+		when = t.Local().Format("15:04:05")
+	}
+	content := truncateRunes(strings.ReplaceAll(r.Content, "\n", " | "), 100)
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\t%s", when, e.Type, e.Role(), r.ContentType, r.ToolName, truncate(e.RequestID, 18), content)
+}
+
+// resolveTranscriptPath takes a transcript path or a session name
+func resolveTranscriptPath(arg string) (string, error) {
+	if _, err := os.Stat(arg); err == nil {
+		return arg, nil
+	}
+	config, err := loadConfig()
+	if err != nil {
+		return "", fmt.Errorf("no transcript file '%s'", arg)
+	}
+	info := config.Sessions[arg]
+	if info == nil {
+		return "", fmt.Errorf("no transcript file or session '%s'", arg)
+	}
+	if info.TranscriptPath == "" {
+		return "", fmt.Errorf("no transcript recorded for session '%s' yet", arg)
+	}
+	return info.TranscriptPath, nil
+}
+
+// transcriptCommand implements `ccc transcript <path|session> [--tail N] [--csv] [--follow]`
+func transcriptCommand(args []string) error {
+	usage := fmt.Errorf("usage: ccc transcript <path|session> [--tail N] [--csv] [--follow]")
+	var target string
+	tail, asCSV, follow := 0, false, false
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--tail", "-n":
+			if i+1 >= len(args) {
+				return usage
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				return usage
+			}
+			tail = n
+			i++
+		case "--csv":
+			asCSV = true
+		case "--follow", "-f":
+			follow = true
+		default:
+			if target != "" {
+				return usage
+			}
+			target = args[i]
+		}
+	}
+	if target == "" {
+		return usage
+	}
+	path, err := resolveTranscriptPath(target)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var rows []transcriptRow
+	offset, err := readTranscriptFrom(f, func(e *TranscriptEntry) {
+		rows = append(rows, transcriptRows(e)...)
+		if tail > 0 && len(rows) > 2*tail {
+			rows = append(rows[:0], rows[len(rows)-tail:]...)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if tail > 0 && len(rows) > tail {
+		rows = rows[len(rows)-tail:]
+	}
+
+	var cw *csv.Writer
+	var tw *tabwriter.Writer
+	if asCSV {
+		cw = csv.NewWriter(os.Stdout)
+		cw.Write(transcriptCSVHeader)
+	} else {
+		tw = tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+		fmt.Fprintln(tw, "TIME\tTYPE\tROLE\tC_TYPE\tTOOL\tRID\tCONTENT")
+	}
+	print := func(rows []transcriptRow) {
+		for _, r := range rows {
+			if asCSV {
+				cw.Write(r.csvRecord())
+			} else {
+				fmt.Fprintln(tw, r.tableLine())
+			}
+		}
+		if asCSV {
+			cw.Flush()
+		} else {
+			tw.Flush()
+		}
+	}
+	print(rows)
+	if !follow {
+		return nil
+	}
+	return followTranscript(path, offset, func(e *TranscriptEntry) { print(transcriptRows(e)) })
+}
+
+// followTranscript polls a transcript for lines appended after offset. If
+// the file shrinks or is replaced, it is read again from the start.
+func followTranscript(path string, offset int64, fn func(e *TranscriptEntry)) error {
+	var lastInode int64
+	if fi, err := os.Stat(path); err == nil {
+		lastInode = fileInode(fi)
+	}
+	for {
+		time.Sleep(500 * time.Millisecond)
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue // being rotated
+		}
+		if inode := fileInode(fi); fi.Size() < offset || inode != lastInode {
+			offset, lastInode = 0, inode
+		}
+		if fi.Size() == offset {
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		f.Seek(offset, io.SeekStart)
+		n, err := readTranscriptFrom(f, fn)
+		f.Close()
+		offset += n
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// fileInode identifies a file across renames, to notice it being replaced
+func fileInode(fi os.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// User roles; roleGrants says which rights each one has
+const (
+	roleOwner    = "owner"    // everything, including /c, /users and session management
+	roleOperator = "operator" // prompt sessions, answer questions, restart sessions
+	roleApprover = "approver" // permission decisions
+	roleViewer   = "viewer"   // read-only commands
+)
+
+// roleGrants lists the roles whose rights each role has. Operator and
+// approver are separate: prompting a session doesn't let a user approve the
+// tool calls Claude makes for them, nor the other way around.
+var roleGrants = map[string][]string{
+	roleOwner:    {roleOwner, roleOperator, roleApprover, roleViewer},
+	roleOperator: {roleOperator, roleViewer},
+	roleApprover: {roleApprover, roleViewer},
+	roleViewer:   {roleViewer},
+}
+
+// UserInfo is an entry of the user registry
+type UserInfo struct {
+	Name     string   `json:"name,omitempty"`
+	Role     string   `json:"role"`
+	Sessions []string `json:"sessions,omitempty"` // sessions this user may act on (empty = all)
+}
+
+// commandRoles is the role each Telegram command needs. Commands not listed
+// are forwarded to Claude as prompts and need roleOperator.
+var commandRoles = map[string]string{
+	"/c":         roleOwner,
+	"/update":    roleOwner,
+	"/restart":   roleOwner,
+	"/auth":      roleOwner,
+	"/cleanup":   roleOwner,
+	"/delete":    roleOwner,
+	"/users":     roleOwner,
+	"/new":       roleOperator, // creating a new session (/new <name>) needs roleOwner
+	"/continue":  roleOperator,
+	"/stop":      roleOperator,
+	"/interrupt": roleOperator,
+	"/keys":      roleOperator,
+	"/mode":      roleOperator,
+	"/queue":     roleOperator,
+	"/now":       roleOperator,
+	"/diffs":     roleOperator,
+	"/stats":     roleViewer,
+	"/list":      roleViewer,
+	"/version":   roleViewer,
+	"/screen":    roleViewer,
+	"/search":    roleViewer,
+	"/export":    roleViewer,
+}
+
+// userRole returns a Telegram user's role, or "" if unknown.
+// The configured ChatID is always the owner.
+func userRole(config *Config, userID int64) string {
+	if userID == 0 {
+		return ""
+	}
+	if userID == config.ChatID {
+		return roleOwner
+	}
+	if u := config.Users[userID]; u != nil && roleGrants[u.Role] != nil {
+		return u.Role
+	}
+	return ""
+}
+
+// canAccessSession reports whether a user may act on a session
+func canAccessSession(config *Config, userID int64, sessName string) bool {
+	if sessName == "" || userRole(config, userID) == roleOwner {
+		return true
+	}
+	u := config.Users[userID]
+	if u == nil {
+		return false
+	}
+	return len(u.Sessions) == 0 || containsString(u.Sessions, sessName)
+}
+
+// authorize reports whether a user's role grants minRole and the user may act
+// on sessName ("" for none)
+func authorize(config *Config, userID int64, minRole string, sessName string) bool {
+	if !containsString(roleGrants[userRole(config, userID)], minRole) {
+		return false
+	}
+	return canAccessSession(config, userID, sessName)
+}
+
+// commandRole returns the role needed for a command message
+func commandRole(text string) string {
+	cmd, args, _ := strings.Cut(text, " ")
+	if cmd == "/new" && strings.TrimSpace(args) != "" {
+		return roleOwner
+	}
+	if role, ok := commandRoles[cmd]; ok {
+		return role
+	}
+	return roleOperator
+}
+
+// userLabel names a Telegram user for logs and "by" lines
+func userLabel(userID int64, username string, firstName string) string {
+	switch {
+	case username != "":
+		return "@" + username
+	case firstName != "":
+		return firstName
+	default:
+		return strconv.FormatInt(userID, 10)
+	}
+}
+
+// byline returns " by <user>" for multi-user setups and "" when the owner is the only user
+func byline(config *Config, label string) string {
+	if len(config.Users) == 0 || label == "" {
+		return ""
+	}
+	return " by " + label
+}
+
+// callbackAccess returns the role and session a button press needs
+func callbackAccess(cb *CallbackQuery) (string, string) {
+	switch {
+	case strings.HasPrefix(cb.Data, listCallbackPrefix):
+		parts := strings.SplitN(strings.TrimPrefix(cb.Data, listCallbackPrefix), ":", 2)
+		if len(parts) == 2 && (parts[0] == "r" || parts[0] == "c") {
+			return roleOperator, parts[1]
+		}
+		return roleOwner, ""
+	case strings.HasPrefix(cb.Data, dialogCallbackPrefix):
+		// dlg:<kind>:<option>:<hash>:<session>
+		parts := strings.SplitN(strings.TrimPrefix(cb.Data, dialogCallbackPrefix), ":", 4)
+		if len(parts) != 4 {
+			return roleOwner, ""
+		}
+		if parts[0] == dialogPermission {
+			return roleApprover, parts[3]
+		}
+		return roleOperator, parts[3]
+	case strings.HasPrefix(cb.Data, outputCallbackPrefix):
+		// out:<message ID>:<session>
+		parts := strings.SplitN(strings.TrimPrefix(cb.Data, outputCallbackPrefix), ":", 2)
+		if len(parts) != 2 {
+			return roleOwner, ""
+		}
+		return roleViewer, parts[1]
+	case strings.HasPrefix(cb.Data, permCallbackPrefix):
+		reqID := cb.Data[strings.LastIndex(cb.Data, ":")+1:]
+		if req, err := getPendingOTPRequest(reqID); err == nil {
+			return roleApprover, req.SessionName
+		}
+		return roleApprover, ""
+	default:
+		// AskUserQuestion answer: session:questionIndex:totalQuestions:optionIndex
+		sessName, _, _ := strings.Cut(cb.Data, ":")
+		return roleOperator, sessName
+	}
+}
+
+// handleUsersCommand implements /users [add|remove|role|sessions]
+func handleUsersCommand(config *Config, msg *TelegramMessage, args []string) {
+	chatID, threadID := msg.Chat.ID, msg.MessageThreadID
+	usage := "Usage:\n" +
+		"/users — list users\n" +
+		"/users add <user_id> <role> [name]\n" +
+		"/users remove <user_id>\n" +
+		"/users role <user_id> <role>\n" +
+		"/users sessions <user_id> <name,name|all>\n\n" +
+		"Roles: owner, operator, approver, viewer\n" +
+		"Reply to someone's message to use their ID: /users add <role>"
+
+	if len(args) == 0 {
+		sendMessage(config, chatID, threadID, formatUserList(config))
+		return
+	}
+
+	var targetID int64
+	targetName := ""
+	rest := args[1:]
+	if len(rest) > 0 {
+		if id, err := strconv.ParseInt(rest[0], 10, 64); err == nil {
+			targetID = id
+			rest = rest[1:]
+		}
+	}
+	// Replying to someone's message supplies their ID. In forum topics every
+	// message replies to the topic's root message, which doesn't count.
+	if reply := msg.ReplyToMessage; targetID == 0 && reply != nil && int64(reply.MessageID) != msg.MessageThreadID {
+		targetID = reply.From.ID
+		targetName = userLabel(reply.From.ID, reply.From.Username, reply.From.FirstName)
+	}
+	if targetID == 0 {
+		sendMessage(config, chatID, threadID, usage)
+		return
+	}
+	if targetID == config.ChatID {
+		sendMessage(config, chatID, threadID, "❌ The owner set up with ccc setup can't be changed")
+		return
+	}
+
+	config, _ = loadConfig()
+	if config.Users == nil {
+		config.Users = make(map[int64]*UserInfo)
+	}
+	u := config.Users[targetID]
+
+	switch args[0] {
+	case "add", "role":
+		if len(rest) == 0 || roleGrants[rest[0]] == nil {
+			sendMessage(config, chatID, threadID, "❌ Role must be one of: owner, operator, approver, viewer")
+			return
+		}
+		if u == nil {
+			if args[0] == "role" {
+				sendMessage(config, chatID, threadID, fmt.Sprintf("❌ User %d not found", targetID))
+				return
+			}
+			u = &UserInfo{}
+			config.Users[targetID] = u
+		}
+		u.Role = rest[0]
+		if len(rest) > 1 {
+			u.Name = strings.Join(rest[1:], " ")
+		} else if u.Name == "" {
+			u.Name = targetName
+		}
+		saveConfig(config)
+		listenLog("[users] %d (%s) role=%s", targetID, u.Name, u.Role)
+		sendMessage(config, chatID, threadID, fmt.Sprintf("✅ %s is now %s", describeUser(targetID, u), u.Role))
+
+	case "remove":
+		if u == nil {
+			sendMessage(config, chatID, threadID, fmt.Sprintf("❌ User %d not found", targetID))
+			return
+		}
+		delete(config.Users, targetID)
+		saveConfig(config)
+		listenLog("[users] removed %d (%s)", targetID, u.Name)
+		sendMessage(config, chatID, threadID, fmt.Sprintf("🗑 Removed %s", describeUser(targetID, u)))
+
+	case "sessions":
+		if u == nil || len(rest) == 0 {
+			sendMessage(config, chatID, threadID, usage)
+			return
+		}
+		u.Sessions = nil
+		if rest[0] != "all" {
+			for _, s := range strings.Split(rest[0], ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					u.Sessions = append(u.Sessions, s)
+				}
+			}
+		}
+		saveConfig(config)
+		scope := "all sessions"
+		if len(u.Sessions) > 0 {
+			scope = strings.Join(u.Sessions, ", ")
+		}
+		sendMessage(config, chatID, threadID, fmt.Sprintf("✅ %s can act on: %s", describeUser(targetID, u), scope))
+
+	default:
+		sendMessage(config, chatID, threadID, usage)
+	}
+}
+
+// describeUser renders "name (id)" for messages
+func describeUser(userID int64, u *UserInfo) string {
+	if u != nil && u.Name != "" {
+		return fmt.Sprintf("%s (%d)", u.Name, userID)
+	}
+	return strconv.FormatInt(userID, 10)
+}
+
+// formatUserList renders the /users listing
+func formatUserList(config *Config) string {
+	var sb strings.Builder
+	sb.WriteString("👥 Users\n\n")
+	sb.WriteString(fmt.Sprintf("%d — owner (setup)\n", config.ChatID))
+
+	ids := make([]int64, 0, len(config.Users))
+	for id := range config.Users {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		u := config.Users[id]
+		sb.WriteString(fmt.Sprintf("%s — %s", describeUser(id, u), u.Role))
+		if len(u.Sessions) > 0 {
+			sb.WriteString(fmt.Sprintf(" [%s]", strings.Join(u.Sessions, ", ")))
+		}
+		sb.WriteString("\n")
+	}
+	if len(ids) == 0 {
+		sb.WriteString("\nAdd teammates with /users add <user_id> <role>")
+	}
+	return sb.String()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const defaultWebhookAddr = ":8443"
+
+// setWebhook registers a webhook URL with Telegram. Updates sent to it carry
+// secret in the X-Telegram-Bot-Api-Secret-Token header.
+func setWebhook(config *Config, webhookURL string, secret string) error {
+	params := url.Values{
+		"url":             {webhookURL},
+		"secret_token":    {secret},
+		"allowed_updates": {`["message","callback_query"]`},
+	}
+	result, err := telegramAPI(config, "setWebhook", params)
+	if err != nil {
+		return err
+	}
+	if !result.OK {
+		return fmt.Errorf("failed to set webhook: %s", result.Description)
+	}
+	return nil
+}
+
+// deleteWebhook removes any registered webhook so getUpdates polling works again.
+// Pending updates are kept and will be returned by the next getUpdates call.
+func deleteWebhook(config *Config) error {
+	result, err := telegramAPI(config, "deleteWebhook", url.Values{})
+	if err != nil {
+		return err
+	}
+	if !result.OK {
+		return fmt.Errorf("failed to delete webhook: %s", result.Description)
+	}
+	return nil
+}
+
+// listenWebhook serves Telegram updates over HTTP on addr and hands them to
+// disp in arrival order. TLS is expected to be terminated by a
+// reverse proxy in front of addr.
+func listenWebhook(config *Config, disp *updateDispatcher, webhookURL string, addr string) error {
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return fmt.Errorf("failed to generate webhook secret: %w", err)
+	}
+	secret := hex.EncodeToString(secretBytes)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		got := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(secret)) != 1 {
+			listenLog("[webhook] rejected request from %s: bad secret token", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var update Update
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxResponseSize)).Decode(&update); err != nil {
+			listenLog("[webhook] parse error: %v", err)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		// Acknowledge once queued; slow handlers (voice, /c) must not make
+		// Telegram redeliver, and dispatch never waits on a busy topic
+		disp.accept(update)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Listen before registering so Telegram's first delivery finds us ready
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.Serve(ln) }()
+
+	if err := setWebhook(config, webhookURL, secret); err != nil {
+		server.Close()
+		return err
+	}
+	listenLog("Webhook mode: %s (listening on %s)", webhookURL, addr)
+
+	return <-serveErr
+}